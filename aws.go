@@ -1,18 +1,33 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"strings"
+	"time"
+	"unicode"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/autoscaling"
 	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
 )
 
-func setAsgDesired(svc autoscalingiface.AutoScalingAPI, asg *autoscaling.Group, count int64) error {
+const (
+	// maxDescribeGroupNames is the most ASG names DescribeAutoScalingGroups accepts at once
+	maxDescribeGroupNames = 50
+	// maxDescribeInstanceIds is the most instance IDs we send in a single DescribeInstances
+	maxDescribeInstanceIds = 1000
+	// errCodeInstanceNotFound is the EC2 error when any of the instances described does not exist
+	errCodeInstanceNotFound = "InvalidInstanceID.NotFound"
+)
+
+func setAsgDesired(ctx context.Context, svc autoscalingiface.AutoScalingAPI, asg *autoscaling.Group, count int64) error {
 	// increase the desired capacity by 1
 	desiredInput := &autoscaling.SetDesiredCapacityInput{
 		AutoScalingGroupName: asg.AutoScalingGroupName,
@@ -20,8 +35,9 @@ func setAsgDesired(svc autoscalingiface.AutoScalingAPI, asg *autoscaling.Group,
 		HonorCooldown:        aws.Bool(true),
 	}
 
-	_, err := svc.SetDesiredCapacity(desiredInput)
+	_, err := svc.SetDesiredCapacityWithContext(ctx, desiredInput)
 	if err != nil {
+		recordAwsError("SetDesiredCapacity", err)
 		if aerr, ok := err.(awserr.Error); ok {
 			switch aerr.Code() {
 			case autoscaling.ErrCodeScalingActivityInProgressFault:
@@ -38,34 +54,95 @@ func setAsgDesired(svc autoscalingiface.AutoScalingAPI, asg *autoscaling.Group,
 	return nil
 }
 
-func awsGetHostname(svc ec2iface.EC2API, id string) (string, error) {
-	hostnames, err := awsGetHostnames(svc, []string{id})
+func setAsgMaxSize(ctx context.Context, svc autoscalingiface.AutoScalingAPI, asg *autoscaling.Group, size int64) error {
+	input := &autoscaling.UpdateAutoScalingGroupInput{
+		AutoScalingGroupName: asg.AutoScalingGroupName,
+		MaxSize:              aws.Int64(size),
+	}
+
+	_, err := svc.UpdateAutoScalingGroupWithContext(ctx, input)
 	if err != nil {
-		return "", err
+		recordAwsError("UpdateAutoScalingGroup", err)
+		if aerr, ok := err.(awserr.Error); ok {
+			switch aerr.Code() {
+			case autoscaling.ErrCodeScalingActivityInProgressFault:
+				return fmt.Errorf("%s %v", autoscaling.ErrCodeScalingActivityInProgressFault, aerr.Error())
+			case autoscaling.ErrCodeResourceContentionFault:
+				return fmt.Errorf("%s %v", autoscaling.ErrCodeResourceContentionFault, aerr.Error())
+			default:
+				return fmt.Errorf("Unexpected and unknown AWS error: %v", aerr.Error())
+			}
+		} else {
+			return fmt.Errorf("Unexpected and unknown non-AWS error: %v", err.Error())
+		}
+	}
+	return nil
+}
+
+// awsSuspendProcesses suspends the named scaling processes of the ASG, e.g. AlarmNotification
+func awsSuspendProcesses(ctx context.Context, svc autoscalingiface.AutoScalingAPI, name string, processes []string) error {
+	input := &autoscaling.ScalingProcessQuery{
+		AutoScalingGroupName: aws.String(name),
+		ScalingProcesses:     aws.StringSlice(processes),
+	}
+	_, err := svc.SuspendProcessesWithContext(ctx, input)
+	if err != nil {
+		recordAwsError("SuspendProcesses", err)
+		if aerr, ok := err.(awserr.Error); ok {
+			switch aerr.Code() {
+			case autoscaling.ErrCodeResourceInUseFault, autoscaling.ErrCodeResourceContentionFault:
+				return fmt.Errorf("Could not suspend processes of ASG %s, resource in use, will try next loop: %v", name, aerr.Error())
+			default:
+				return fmt.Errorf("Unknown aws error when suspending processes of ASG %s: %v", name, aerr.Error())
+			}
+		} else {
+			return fmt.Errorf("Unknown non-aws error when suspending processes of ASG %s: %v", name, err.Error())
+		}
+	}
+	return nil
+}
+
+// awsResumeProcesses resumes the named scaling processes of the ASG
+func awsResumeProcesses(ctx context.Context, svc autoscalingiface.AutoScalingAPI, name string, processes []string) error {
+	input := &autoscaling.ScalingProcessQuery{
+		AutoScalingGroupName: aws.String(name),
+		ScalingProcesses:     aws.StringSlice(processes),
 	}
-	if len(hostnames) < 1 {
-		return "", err
+	_, err := svc.ResumeProcessesWithContext(ctx, input)
+	if err != nil {
+		recordAwsError("ResumeProcesses", err)
+		if aerr, ok := err.(awserr.Error); ok {
+			switch aerr.Code() {
+			case autoscaling.ErrCodeResourceInUseFault, autoscaling.ErrCodeResourceContentionFault:
+				return fmt.Errorf("Could not resume processes of ASG %s, resource in use, will try next loop: %v", name, aerr.Error())
+			default:
+				return fmt.Errorf("Unknown aws error when resuming processes of ASG %s: %v", name, aerr.Error())
+			}
+		} else {
+			return fmt.Errorf("Unknown non-aws error when resuming processes of ASG %s: %v", name, err.Error())
+		}
 	}
-	return hostnames[0], nil
+	return nil
 }
-func awsGetLaunchTemplateByID(svc ec2iface.EC2API, id string) (*ec2.LaunchTemplate, error) {
+
+func awsGetLaunchTemplateByID(ctx context.Context, svc ec2iface.EC2API, id string) (*ec2.LaunchTemplate, error) {
 	input := &ec2.DescribeLaunchTemplatesInput{
 		LaunchTemplateIds: []*string{
 			aws.String(id),
 		},
 	}
-	return awsGetLaunchTemplate(svc, input)
+	return awsGetLaunchTemplate(ctx, svc, input)
 }
-func awsGetLaunchTemplateByName(svc ec2iface.EC2API, name string) (*ec2.LaunchTemplate, error) {
+func awsGetLaunchTemplateByName(ctx context.Context, svc ec2iface.EC2API, name string) (*ec2.LaunchTemplate, error) {
 	input := &ec2.DescribeLaunchTemplatesInput{
 		LaunchTemplateNames: []*string{
 			aws.String(name),
 		},
 	}
-	return awsGetLaunchTemplate(svc, input)
+	return awsGetLaunchTemplate(ctx, svc, input)
 }
-func awsGetLaunchTemplate(svc ec2iface.EC2API, input *ec2.DescribeLaunchTemplatesInput) (*ec2.LaunchTemplate, error) {
-	templatesOutput, err := svc.DescribeLaunchTemplates(input)
+func awsGetLaunchTemplate(ctx context.Context, svc ec2iface.EC2API, input *ec2.DescribeLaunchTemplatesInput) (*ec2.LaunchTemplate, error) {
+	templatesOutput, err := svc.DescribeLaunchTemplatesWithContext(ctx, input)
 	descriptiveMsg := fmt.Sprintf("%v / %v", input.LaunchTemplateIds, input.LaunchTemplateNames)
 	if err != nil {
 		return nil, fmt.Errorf("Unable to get description for Launch Template %s: %v", descriptiveMsg, err)
@@ -75,58 +152,142 @@ func awsGetLaunchTemplate(svc ec2iface.EC2API, input *ec2.DescribeLaunchTemplate
 	}
 	return templatesOutput.LaunchTemplates[0], nil
 }
-func awsGetHostnames(svc ec2iface.EC2API, ids []string) ([]string, error) {
+
+// awsDescribeInstances describes the given EC2 instances, in batches and following pagination. Instances
+// that EC2 no longer knows about, e.g. because they were terminated some time ago, are left out.
+func awsDescribeInstances(ctx context.Context, svc ec2iface.EC2API, ids []string) ([]*ec2.Instance, error) {
+	instances := make([]*ec2.Instance, 0)
+	for start := 0; start < len(ids); start += maxDescribeInstanceIds {
+		end := start + maxDescribeInstanceIds
+		if end > len(ids) {
+			end = len(ids)
+		}
+		batch := ids[start:end]
+		for len(batch) > 0 {
+			found, err := awsDescribeInstanceBatch(ctx, svc, batch)
+			if err == nil {
+				instances = append(instances, found...)
+				break
+			}
+			// a single ID that does not exist fails the whole batch, so leave those out and try again
+			missing := missingInstanceIds(err, batch)
+			if len(missing) == 0 {
+				return nil, fmt.Errorf("Unable to get description for node %v: %v", batch, err)
+			}
+			batch = withoutIds(batch, missing)
+		}
+	}
+	return instances, nil
+}
+
+// awsDescribeInstanceBatch describes a single batch of EC2 instances, following pagination
+func awsDescribeInstanceBatch(ctx context.Context, svc ec2iface.EC2API, ids []string) ([]*ec2.Instance, error) {
+	instances := make([]*ec2.Instance, 0)
 	ec2input := &ec2.DescribeInstancesInput{
 		InstanceIds: aws.StringSlice(ids),
 	}
-	nodesResult, err := svc.DescribeInstances(ec2input)
-	if err != nil {
-		return nil, fmt.Errorf("Unable to get description for node %v: %v", ids, err)
+	for {
+		nodesResult, err := svc.DescribeInstancesWithContext(ctx, ec2input)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range nodesResult.Reservations {
+			instances = append(instances, r.Instances...)
+		}
+		if aws.StringValue(nodesResult.NextToken) == "" {
+			break
+		}
+		ec2input.NextToken = nodesResult.NextToken
 	}
-	if len(nodesResult.Reservations) < 1 {
-		return nil, fmt.Errorf("Did not get any reservations for node %v", ids)
+	return instances, nil
+}
+
+// missingInstanceIds returns those of the ids that a DescribeInstances error says do not exist, e.g.
+// "The instance IDs 'i-1, i-2' do not exist"; empty if it is any other error
+func missingInstanceIds(err error, ids []string) []string {
+	aerr, ok := err.(awserr.Error)
+	if !ok || aerr.Code() != errCodeInstanceNotFound {
+		return nil
 	}
-	hostnames := make([]string, 0)
-	for _, i := range nodesResult.Reservations {
-		for _, j := range i.Instances {
-			hostnames = append(hostnames, *j.PrivateDnsName)
+	mentioned := map[string]bool{}
+	for _, word := range strings.FieldsFunc(aerr.Message(), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '-'
+	}) {
+		mentioned[word] = true
+	}
+	missing := make([]string, 0)
+	for _, id := range ids {
+		if mentioned[id] {
+			missing = append(missing, id)
 		}
 	}
-	return hostnames, nil
+	return missing
 }
 
-func awsDescribeGroups(svc autoscalingiface.AutoScalingAPI, names []string) ([]*autoscaling.Group, error) {
-	input := &autoscaling.DescribeAutoScalingGroupsInput{
-		AutoScalingGroupNames: aws.StringSlice(names),
+// withoutIds returns ids, leaving out any in remove
+func withoutIds(ids []string, remove []string) []string {
+	removed := map[string]bool{}
+	for _, id := range remove {
+		removed[id] = true
 	}
-	result, err := svc.DescribeAutoScalingGroups(input)
-	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok {
-			switch aerr.Code() {
-			case autoscaling.ErrCodeInvalidNextToken:
-				return nil, fmt.Errorf("Unexpected AWS NextToken error when doing non-pagination describe")
-			case autoscaling.ErrCodeResourceContentionFault:
-				return nil, fmt.Errorf("Unexpected AWS ResourceContentionFault when doing describe")
-			default:
-				return nil, fmt.Errorf("Unexpected and unknown AWS error when doing describe: %v", aerr)
+	ret := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if !removed[id] {
+			ret = append(ret, id)
+		}
+	}
+	return ret
+}
+
+// awsDescribeGroups describes the named ASGs, in batches and following pagination
+func awsDescribeGroups(ctx context.Context, svc autoscalingiface.AutoScalingAPI, names []string) ([]*autoscaling.Group, error) {
+	groups := make([]*autoscaling.Group, 0)
+	for start := 0; start < len(names); start += maxDescribeGroupNames {
+		end := start + maxDescribeGroupNames
+		if end > len(names) {
+			end = len(names)
+		}
+		input := &autoscaling.DescribeAutoScalingGroupsInput{
+			AutoScalingGroupNames: aws.StringSlice(names[start:end]),
+		}
+		for {
+			result, err := svc.DescribeAutoScalingGroupsWithContext(ctx, input)
+			if err != nil {
+				recordAwsError("DescribeAutoScalingGroups", err)
+				if aerr, ok := err.(awserr.Error); ok {
+					switch aerr.Code() {
+					case autoscaling.ErrCodeInvalidNextToken:
+						return nil, fmt.Errorf("Unexpected AWS NextToken error when doing describe: %v", aerr.Error())
+					case autoscaling.ErrCodeResourceContentionFault:
+						return nil, fmt.Errorf("Unexpected AWS ResourceContentionFault when doing describe")
+					default:
+						return nil, fmt.Errorf("Unexpected and unknown AWS error when doing describe: %v", aerr)
+					}
+				} else {
+					// Print the error, cast err to awserr.Error to get the Code and
+					// Message from an error.
+					return nil, fmt.Errorf("Unexpected and unknown non-AWS error when doing describe: %v", err.Error())
+				}
 			}
-		} else {
-			// Print the error, cast err to awserr.Error to get the Code and
-			// Message from an error.
-			return nil, fmt.Errorf("Unexpected and unknown non-AWS error when doing describe: %v", err.Error())
+			groups = append(groups, result.AutoScalingGroups...)
+			if aws.StringValue(result.NextToken) == "" {
+				break
+			}
+			input.NextToken = result.NextToken
 		}
 	}
-	return result.AutoScalingGroups, nil
+	return groups, nil
 }
 
-func awsTerminateNode(svc autoscalingiface.AutoScalingAPI, id string) error {
+func awsTerminateNode(ctx context.Context, svc autoscalingiface.AutoScalingAPI, id string) error {
 	input := &autoscaling.TerminateInstanceInAutoScalingGroupInput{
 		InstanceId:                     aws.String(id),
 		ShouldDecrementDesiredCapacity: aws.Bool(false),
 	}
 
-	_, err := svc.TerminateInstanceInAutoScalingGroup(input)
+	_, err := svc.TerminateInstanceInAutoScalingGroupWithContext(ctx, input)
 	if err != nil {
+		recordAwsError("TerminateInstanceInAutoScalingGroup", err)
 		if aerr, ok := err.(awserr.Error); ok {
 			switch aerr.Code() {
 			case autoscaling.ErrCodeScalingActivityInProgressFault:
@@ -154,3 +315,170 @@ func awsGetServices() (ec2iface.EC2API, autoscalingiface.AutoScalingAPI, error)
 	ec2svc := ec2.New(sess)
 	return ec2svc, asgSvc, nil
 }
+
+func awsGetDynamoDBService() (dynamodbiface.DynamoDBAPI, error) {
+	sess, err := session.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	return dynamodb.New(sess), nil
+}
+
+// awsDescribeTags gets all of the tags with the given keys on the named ASGs, following pagination
+func awsDescribeTags(ctx context.Context, svc autoscalingiface.AutoScalingAPI, names []string, keys []string) ([]*autoscaling.TagDescription, error) {
+	return awsDescribeTagsByFilters(ctx, svc, []*autoscaling.Filter{
+		{
+			Name:   aws.String("auto-scaling-group"),
+			Values: aws.StringSlice(names),
+		},
+		{
+			Name:   aws.String("key"),
+			Values: aws.StringSlice(keys),
+		},
+	})
+}
+
+// awsDescribeTagsByFilters gets all of the ASG tags that match the filters, following pagination
+func awsDescribeTagsByFilters(ctx context.Context, svc autoscalingiface.AutoScalingAPI, filters []*autoscaling.Filter) ([]*autoscaling.TagDescription, error) {
+	input := &autoscaling.DescribeTagsInput{
+		Filters: filters,
+	}
+	tags := make([]*autoscaling.TagDescription, 0)
+	for {
+		result, err := svc.DescribeTagsWithContext(ctx, input)
+		if err != nil {
+			if aerr, ok := err.(awserr.Error); ok {
+				switch aerr.Code() {
+				case autoscaling.ErrCodeInvalidNextToken:
+					return nil, fmt.Errorf("Unexpected AWS NextToken error when describing tags: %v", aerr.Error())
+				case autoscaling.ErrCodeResourceContentionFault:
+					return nil, fmt.Errorf("Unexpected AWS ResourceContentionFault when describing tags")
+				default:
+					return nil, fmt.Errorf("Unexpected and unknown AWS error when describing tags: %v", aerr.Error())
+				}
+			} else {
+				return nil, fmt.Errorf("Unexpected and unknown non-AWS error when describing tags: %v", err.Error())
+			}
+		}
+		tags = append(tags, result.Tags...)
+		if aws.StringValue(result.NextToken) == "" {
+			break
+		}
+		input.NextToken = result.NextToken
+	}
+	return tags, nil
+}
+
+// awsSetTags creates or updates the given tags on an ASG, without propagating them to instances
+func awsSetTags(ctx context.Context, svc autoscalingiface.AutoScalingAPI, name string, tags map[string]string) error {
+	input := &autoscaling.CreateOrUpdateTagsInput{
+		Tags: make([]*autoscaling.Tag, 0),
+	}
+	for k, v := range tags {
+		input.Tags = append(input.Tags, &autoscaling.Tag{
+			ResourceId:        aws.String(name),
+			ResourceType:      aws.String("auto-scaling-group"),
+			Key:               aws.String(k),
+			Value:             aws.String(v),
+			PropagateAtLaunch: aws.Bool(false),
+		})
+	}
+	_, err := svc.CreateOrUpdateTagsWithContext(ctx, input)
+	if err != nil {
+		recordAwsError("CreateOrUpdateTags", err)
+		if aerr, ok := err.(awserr.Error); ok {
+			switch aerr.Code() {
+			case autoscaling.ErrCodeResourceContentionFault:
+				return fmt.Errorf("Could not tag ASG %s, resource in contention, will try next loop", name)
+			default:
+				return fmt.Errorf("Unknown aws error when tagging ASG %s: %v", name, aerr.Error())
+			}
+		} else {
+			return fmt.Errorf("Unknown non-aws error when tagging ASG %s: %v", name, err.Error())
+		}
+	}
+	return nil
+}
+
+// awsDeleteTags removes the tags with the given keys from an ASG
+func awsDeleteTags(ctx context.Context, svc autoscalingiface.AutoScalingAPI, name string, keys []string) error {
+	input := &autoscaling.DeleteTagsInput{
+		Tags: make([]*autoscaling.Tag, 0),
+	}
+	for _, k := range keys {
+		input.Tags = append(input.Tags, &autoscaling.Tag{
+			ResourceId:   aws.String(name),
+			ResourceType: aws.String("auto-scaling-group"),
+			Key:          aws.String(k),
+		})
+	}
+	_, err := svc.DeleteTagsWithContext(ctx, input)
+	if err != nil {
+		recordAwsError("DeleteTags", err)
+		if aerr, ok := err.(awserr.Error); ok {
+			switch aerr.Code() {
+			case autoscaling.ErrCodeResourceContentionFault:
+				return fmt.Errorf("Could not remove tags from ASG %s, resource in contention, will try next loop", name)
+			default:
+				return fmt.Errorf("Unknown aws error when removing tags from ASG %s: %v", name, aerr.Error())
+			}
+		} else {
+			return fmt.Errorf("Unknown non-aws error when removing tags from ASG %s: %v", name, err.Error())
+		}
+	}
+	return nil
+}
+
+// instanceInfo is what we know about an EC2 instance, from describing it
+type instanceInfo struct {
+	id               string
+	privateDNSName   string
+	privateIP        string
+	availabilityZone string
+	launchTime       time.Time
+	// lifecycle is spot or scheduled, or on-demand if neither
+	lifecycle string
+	// state is the EC2 state, e.g. running or shutting-down
+	state string
+	tags  map[string]string
+}
+
+const lifecycleOnDemand = "on-demand"
+
+func newInstanceInfo(i *ec2.Instance) *instanceInfo {
+	info := &instanceInfo{
+		id:             aws.StringValue(i.InstanceId),
+		privateDNSName: aws.StringValue(i.PrivateDnsName),
+		privateIP:      aws.StringValue(i.PrivateIpAddress),
+		launchTime:     aws.TimeValue(i.LaunchTime),
+		lifecycle:      aws.StringValue(i.InstanceLifecycle),
+		tags:           map[string]string{},
+	}
+	if info.lifecycle == "" {
+		info.lifecycle = lifecycleOnDemand
+	}
+	if i.Placement != nil {
+		info.availabilityZone = aws.StringValue(i.Placement.AvailabilityZone)
+	}
+	if i.State != nil {
+		info.state = aws.StringValue(i.State.Name)
+	}
+	for _, t := range i.Tags {
+		info.tags[aws.StringValue(t.Key)] = aws.StringValue(t.Value)
+	}
+	return info
+}
+
+// awsGetInstanceInfo describes the given EC2 instances, keyed by instance ID. Instances that EC2
+// does not return, e.g. because they are long gone, are not in the map.
+func awsGetInstanceInfo(ctx context.Context, svc ec2iface.EC2API, ids []string) (map[string]*instanceInfo, error) {
+	instances, err := awsDescribeInstances(ctx, svc, ids)
+	if err != nil {
+		return nil, err
+	}
+	ret := map[string]*instanceInfo{}
+	for _, i := range instances {
+		ret[aws.StringValue(i.InstanceId)] = newInstanceInfo(i)
+	}
+	return ret, nil
+}
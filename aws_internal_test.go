@@ -1,12 +1,16 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"sort"
+	"strconv"
 	"strings"
 	"testing"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/autoscaling"
 	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
 	"github.com/aws/aws-sdk-go/service/ec2"
@@ -59,6 +63,11 @@ type mockEc2Svc struct {
 	ec2iface.EC2API
 	autodescribe bool
 	counter      funcCounter
+	instances    map[string]*ec2.Instance
+	// pageSize, if set, is how many instances to return per page
+	pageSize int
+	// reverse returns the instances in the opposite order to the one asked for
+	reverse bool
 }
 
 func (m *mockEc2Svc) DescribeInstances(in *ec2.DescribeInstancesInput) (*ec2.DescribeInstancesOutput, error) {
@@ -68,7 +77,17 @@ func (m *mockEc2Svc) DescribeInstances(in *ec2.DescribeInstancesInput) (*ec2.Des
 		"67890": "host67890",
 	}
 	instances := make([]*ec2.Instance, 0)
+	missing := make([]string, 0)
 	for _, i := range in.InstanceIds {
+		if instance, ok := m.instances[*i]; ok {
+			// a nil instance is one EC2 no longer knows about
+			if instance != nil {
+				instances = append(instances, instance)
+			} else {
+				missing = append(missing, *i)
+			}
+			continue
+		}
 		if name, ok := hostMap[*i]; ok {
 			instances = append(instances, &ec2.Instance{
 				InstanceId:     i,
@@ -86,11 +105,35 @@ func (m *mockEc2Svc) DescribeInstances(in *ec2.DescribeInstancesInput) (*ec2.Des
 		}
 		return nil, fmt.Errorf("Unknown ID %s", *i)
 	}
-	ret := &ec2.DescribeInstancesOutput{
-		Reservations: []*ec2.Reservation{
-			{
-				Instances: instances,
-			},
+	// like EC2, fail the whole request if any of them does not exist
+	if len(missing) > 0 {
+		return nil, awserr.New(errCodeInstanceNotFound, fmt.Sprintf("The instance IDs '%s' do not exist", strings.Join(missing, ", ")), nil)
+	}
+	if m.reverse {
+		for i, j := 0, len(instances)-1; i < j; i, j = i+1, j-1 {
+			instances[i], instances[j] = instances[j], instances[i]
+		}
+	}
+	// serve a page at a time if asked to, one reservation per instance
+	start := 0
+	if in.NextToken != nil {
+		start, _ = strconv.Atoi(*in.NextToken)
+	}
+	end := len(instances)
+	ret := &ec2.DescribeInstancesOutput{}
+	if m.pageSize > 0 {
+		if start+m.pageSize < end {
+			end = start + m.pageSize
+			ret.NextToken = aws.String(strconv.Itoa(end))
+		}
+		for _, i := range instances[start:end] {
+			ret.Reservations = append(ret.Reservations, &ec2.Reservation{Instances: []*ec2.Instance{i}})
+		}
+		return ret, nil
+	}
+	ret.Reservations = []*ec2.Reservation{
+		{
+			Instances: instances,
 		},
 	}
 	return ret, nil
@@ -124,6 +167,9 @@ type mockAsgSvc struct {
 	err     error
 	counter funcCounter
 	groups  map[string]*autoscaling.Group
+	tags    map[string]map[string]string
+	// pageSize, if set, is how many results to return per page
+	pageSize int
 }
 
 func (m *mockAsgSvc) TerminateInstanceInAutoScalingGroup(in *autoscaling.TerminateInstanceInAutoScalingGroupInput) (*autoscaling.TerminateInstanceInAutoScalingGroupOutput, error) {
@@ -133,68 +179,210 @@ func (m *mockAsgSvc) TerminateInstanceInAutoScalingGroup(in *autoscaling.Termina
 }
 func (m *mockAsgSvc) DescribeAutoScalingGroups(in *autoscaling.DescribeAutoScalingGroupsInput) (*autoscaling.DescribeAutoScalingGroupsOutput, error) {
 	m.counter.add("DescribeAutoScalingGroups", in)
+	if len(in.AutoScalingGroupNames) > maxDescribeGroupNames {
+		return nil, awserr.New("ValidationError", "too many names", nil)
+	}
 	groups := make([]*autoscaling.Group, 0)
 	for _, n := range in.AutoScalingGroupNames {
 		if group, ok := m.groups[*n]; ok {
 			groups = append(groups, group)
 		}
 	}
-	return &autoscaling.DescribeAutoScalingGroupsOutput{
-		AutoScalingGroups: groups,
-	}, m.err
+	// serve a page at a time if asked to
+	out := &autoscaling.DescribeAutoScalingGroupsOutput{}
+	start := 0
+	if in.NextToken != nil {
+		start, _ = strconv.Atoi(*in.NextToken)
+	}
+	end := len(groups)
+	if m.pageSize > 0 && start+m.pageSize < end {
+		end = start + m.pageSize
+		out.NextToken = aws.String(strconv.Itoa(end))
+	}
+	out.AutoScalingGroups = groups[start:end]
+	return out, m.err
+}
+func (m *mockAsgSvc) DescribeTags(in *autoscaling.DescribeTagsInput) (*autoscaling.DescribeTagsOutput, error) {
+	m.counter.add("DescribeTags", in)
+	filters := map[string]map[string]bool{}
+	for _, f := range in.Filters {
+		filters[*f.Name] = map[string]bool{}
+		for _, v := range f.Values {
+			filters[*f.Name][*v] = true
+		}
+	}
+	// a filter that is not given matches everything
+	matches := func(name, value string) bool {
+		values, ok := filters[name]
+		return !ok || values[value]
+	}
+	names := make([]string, 0)
+	for name := range m.tags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	tags := make([]*autoscaling.TagDescription, 0)
+	for _, name := range names {
+		if !matches("auto-scaling-group", name) {
+			continue
+		}
+		keys := make([]string, 0)
+		for k := range m.tags[name] {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			v := m.tags[name][k]
+			if !matches("key", k) || !matches("value", v) {
+				continue
+			}
+			tags = append(tags, &autoscaling.TagDescription{
+				ResourceId: aws.String(name),
+				Key:        aws.String(k),
+				Value:      aws.String(v),
+			})
+		}
+	}
+	// serve a page at a time if asked to
+	out := &autoscaling.DescribeTagsOutput{}
+	start := 0
+	if in.NextToken != nil {
+		start, _ = strconv.Atoi(*in.NextToken)
+	}
+	end := len(tags)
+	if m.pageSize > 0 && start+m.pageSize < end {
+		end = start + m.pageSize
+		out.NextToken = aws.String(strconv.Itoa(end))
+	}
+	out.Tags = tags[start:end]
+	return out, m.err
+}
+func (m *mockAsgSvc) CreateOrUpdateTags(in *autoscaling.CreateOrUpdateTagsInput) (*autoscaling.CreateOrUpdateTagsOutput, error) {
+	m.counter.add("CreateOrUpdateTags", in)
+	if m.err != nil {
+		return nil, m.err
+	}
+	if m.tags == nil {
+		m.tags = map[string]map[string]string{}
+	}
+	// as AWS does, reject the whole request if any of the values has a comma
+	for _, t := range in.Tags {
+		if strings.Contains(aws.StringValue(t.Value), ",") {
+			return nil, awserr.New("ValidationError", fmt.Sprintf("tag %s has invalid value %s", aws.StringValue(t.Key), aws.StringValue(t.Value)), nil)
+		}
+	}
+	for _, t := range in.Tags {
+		if _, ok := m.tags[*t.ResourceId]; !ok {
+			m.tags[*t.ResourceId] = map[string]string{}
+		}
+		m.tags[*t.ResourceId][*t.Key] = *t.Value
+	}
+	return &autoscaling.CreateOrUpdateTagsOutput{}, nil
+}
+func (m *mockAsgSvc) DeleteTags(in *autoscaling.DeleteTagsInput) (*autoscaling.DeleteTagsOutput, error) {
+	m.counter.add("DeleteTags", in)
+	if m.err != nil {
+		return nil, m.err
+	}
+	for _, t := range in.Tags {
+		delete(m.tags[*t.ResourceId], *t.Key)
+	}
+	return &autoscaling.DeleteTagsOutput{}, nil
+}
+func (m *mockAsgSvc) UpdateAutoScalingGroup(in *autoscaling.UpdateAutoScalingGroupInput) (*autoscaling.UpdateAutoScalingGroupOutput, error) {
+	m.counter.add("UpdateAutoScalingGroup", in)
+	ret := &autoscaling.UpdateAutoScalingGroupOutput{}
+	return ret, m.err
 }
 func (m *mockAsgSvc) SetDesiredCapacity(in *autoscaling.SetDesiredCapacityInput) (*autoscaling.SetDesiredCapacityOutput, error) {
 	m.counter.add("SetDesiredCapacity", in)
 	ret := &autoscaling.SetDesiredCapacityOutput{}
 	return ret, m.err
 }
+func (m *mockAsgSvc) SuspendProcesses(in *autoscaling.ScalingProcessQuery) (*autoscaling.SuspendProcessesOutput, error) {
+	m.counter.add("SuspendProcesses", in)
+	ret := &autoscaling.SuspendProcessesOutput{}
+	return ret, m.err
+}
+func (m *mockAsgSvc) ResumeProcesses(in *autoscaling.ScalingProcessQuery) (*autoscaling.ResumeProcessesOutput, error) {
+	m.counter.add("ResumeProcesses", in)
+	ret := &autoscaling.ResumeProcessesOutput{}
+	return ret, m.err
+}
 
-func TestAwsGetHostnames(t *testing.T) {
-	tests := []struct {
-		ids       []string
-		hostnames []string
-		err       error
-	}{
-		{[]string{"12345", "67890"}, []string{"host12345", "host67890"}, nil},
-		{[]string{"67890"}, []string{"host67890"}, nil},
-		{[]string{"notexist"}, nil, fmt.Errorf("Unable to get description")},
+// the WithContext variants fail as the SDK does once ctx is cancelled, and otherwise behave as above
+
+func mockCanceled(ctx aws.Context) error {
+	if err := ctx.Err(); err != nil {
+		return awserr.New(request.CanceledErrorCode, "request context canceled", err)
 	}
-	for _, tt := range tests {
-		hostnames, err := awsGetHostnames(&mockEc2Svc{}, tt.ids)
-		switch {
-		case (err == nil && tt.err != nil) || (err != nil && tt.err == nil) || (err != nil && tt.err != nil && !strings.HasPrefix(err.Error(), tt.err.Error())):
-			t.Errorf("Mismatched error, actual then expected")
-			t.Logf("%v", err)
-			t.Logf("%v", tt.err)
-		case !testStringEq(hostnames, tt.hostnames):
-			t.Errorf("Mismatched results, actual then expected")
-			t.Logf("%v", hostnames)
-			t.Logf("%v", tt.hostnames)
-		}
+	return nil
+}
+func (m *mockEc2Svc) DescribeInstancesWithContext(ctx aws.Context, in *ec2.DescribeInstancesInput, opts ...request.Option) (*ec2.DescribeInstancesOutput, error) {
+	if err := mockCanceled(ctx); err != nil {
+		return nil, err
 	}
+	return m.DescribeInstances(in)
 }
-func TestAwsGetHostname(t *testing.T) {
-	tests := []struct {
-		id       string
-		hostname string
-		err      error
-	}{
-		{"12345", "host12345", nil},
-		{"notexist", "", fmt.Errorf("Unable to get description")},
+func (m *mockEc2Svc) DescribeLaunchTemplatesWithContext(ctx aws.Context, in *ec2.DescribeLaunchTemplatesInput, opts ...request.Option) (*ec2.DescribeLaunchTemplatesOutput, error) {
+	if err := mockCanceled(ctx); err != nil {
+		return nil, err
 	}
-	for _, tt := range tests {
-		hostname, err := awsGetHostname(&mockEc2Svc{}, tt.id)
-		switch {
-		case (err == nil && tt.err != nil) || (err != nil && tt.err == nil) || (err != nil && tt.err != nil && !strings.HasPrefix(err.Error(), tt.err.Error())):
-			t.Errorf("Mismatched error, actual then expected")
-			t.Logf("%v", err)
-			t.Logf("%v", tt.err)
-		case hostname != tt.hostname:
-			t.Errorf("Mismatched results, actual then expected")
-			t.Logf("%v", hostname)
-			t.Logf("%v", tt.hostname)
-		}
+	return m.DescribeLaunchTemplates(in)
+}
+func (m *mockAsgSvc) DescribeTagsWithContext(ctx aws.Context, in *autoscaling.DescribeTagsInput, opts ...request.Option) (*autoscaling.DescribeTagsOutput, error) {
+	if err := mockCanceled(ctx); err != nil {
+		return nil, err
+	}
+	return m.DescribeTags(in)
+}
+func (m *mockAsgSvc) TerminateInstanceInAutoScalingGroupWithContext(ctx aws.Context, in *autoscaling.TerminateInstanceInAutoScalingGroupInput, opts ...request.Option) (*autoscaling.TerminateInstanceInAutoScalingGroupOutput, error) {
+	if err := mockCanceled(ctx); err != nil {
+		return nil, err
+	}
+	return m.TerminateInstanceInAutoScalingGroup(in)
+}
+func (m *mockAsgSvc) DescribeAutoScalingGroupsWithContext(ctx aws.Context, in *autoscaling.DescribeAutoScalingGroupsInput, opts ...request.Option) (*autoscaling.DescribeAutoScalingGroupsOutput, error) {
+	if err := mockCanceled(ctx); err != nil {
+		return nil, err
+	}
+	return m.DescribeAutoScalingGroups(in)
+}
+func (m *mockAsgSvc) CreateOrUpdateTagsWithContext(ctx aws.Context, in *autoscaling.CreateOrUpdateTagsInput, opts ...request.Option) (*autoscaling.CreateOrUpdateTagsOutput, error) {
+	if err := mockCanceled(ctx); err != nil {
+		return nil, err
+	}
+	return m.CreateOrUpdateTags(in)
+}
+func (m *mockAsgSvc) DeleteTagsWithContext(ctx aws.Context, in *autoscaling.DeleteTagsInput, opts ...request.Option) (*autoscaling.DeleteTagsOutput, error) {
+	if err := mockCanceled(ctx); err != nil {
+		return nil, err
+	}
+	return m.DeleteTags(in)
+}
+func (m *mockAsgSvc) UpdateAutoScalingGroupWithContext(ctx aws.Context, in *autoscaling.UpdateAutoScalingGroupInput, opts ...request.Option) (*autoscaling.UpdateAutoScalingGroupOutput, error) {
+	if err := mockCanceled(ctx); err != nil {
+		return nil, err
+	}
+	return m.UpdateAutoScalingGroup(in)
+}
+func (m *mockAsgSvc) SetDesiredCapacityWithContext(ctx aws.Context, in *autoscaling.SetDesiredCapacityInput, opts ...request.Option) (*autoscaling.SetDesiredCapacityOutput, error) {
+	if err := mockCanceled(ctx); err != nil {
+		return nil, err
 	}
+	return m.SetDesiredCapacity(in)
+}
+func (m *mockAsgSvc) SuspendProcessesWithContext(ctx aws.Context, in *autoscaling.ScalingProcessQuery, opts ...request.Option) (*autoscaling.SuspendProcessesOutput, error) {
+	if err := mockCanceled(ctx); err != nil {
+		return nil, err
+	}
+	return m.SuspendProcesses(in)
+}
+func (m *mockAsgSvc) ResumeProcessesWithContext(ctx aws.Context, in *autoscaling.ScalingProcessQuery, opts ...request.Option) (*autoscaling.ResumeProcessesOutput, error) {
+	if err := mockCanceled(ctx); err != nil {
+		return nil, err
+	}
+	return m.ResumeProcesses(in)
 }
 
 func TestAwsGetServices(t *testing.T) {
@@ -222,7 +410,7 @@ func TestAwsTerminateNode(t *testing.T) {
 		{fmt.Errorf("test it new"), fmt.Errorf("Unknown non-aws error when terminating old instance")},
 	}
 	for i, tt := range tests {
-		err := awsTerminateNode(&mockAsgSvc{
+		err := awsTerminateNode(context.Background(), &mockAsgSvc{
 			err: tt.awserr,
 		}, id)
 		if (err == nil && tt.err != nil) || (err != nil && tt.err == nil) || (err != nil && tt.err != nil && !strings.HasPrefix(err.Error(), tt.err.Error())) {
@@ -256,7 +444,7 @@ func TestAwsDescribeGroups(t *testing.T) {
 				AutoScalingGroupName: &name,
 			}
 		}
-		groups, err := awsDescribeGroups(&mockAsgSvc{
+		groups, err := awsDescribeGroups(context.Background(), &mockAsgSvc{
 			err:    tt.setErr,
 			groups: validGroups,
 		}, tt.names)
@@ -283,6 +471,115 @@ func TestAwsDescribeGroups(t *testing.T) {
 	}
 }
 
+func TestAwsDescribeGroupsPagination(t *testing.T) {
+	tests := []struct {
+		count    int
+		pageSize int
+		calls    int
+	}{
+		{0, 0, 0},
+		{3, 0, 1},
+		{3, 2, 2},
+		{50, 0, 1},
+		{51, 0, 2},
+		{120, 7, 19},
+	}
+	for i, tt := range tests {
+		names := make([]string, 0)
+		validGroups := map[string]*autoscaling.Group{}
+		for j := 0; j < tt.count; j++ {
+			name := fmt.Sprintf("asg%03d", j)
+			names = append(names, name)
+			validGroups[name] = &autoscaling.Group{AutoScalingGroupName: aws.String(name)}
+		}
+		asgSvc := &mockAsgSvc{groups: validGroups, pageSize: tt.pageSize}
+		groups, err := awsDescribeGroups(context.Background(), asgSvc, names)
+		if err != nil {
+			t.Errorf("%d: unexpected error: %v", i, err)
+			continue
+		}
+		found := make([]string, 0)
+		for _, g := range groups {
+			found = append(found, *g.AutoScalingGroupName)
+		}
+		if !testStringEq(found, names) {
+			t.Errorf("%d: mismatched groups, actual %v expected %v", i, found, names)
+		}
+		if calls := len(asgSvc.counter.filterByName("DescribeAutoScalingGroups")); calls != tt.calls {
+			t.Errorf("%d: expected %d calls, had %d", i, tt.calls, calls)
+		}
+	}
+}
+
+func TestAwsDescribeInstancesPagination(t *testing.T) {
+	tests := []struct {
+		count    int
+		pageSize int
+		calls    int
+	}{
+		{1, 0, 1},
+		{5, 2, 3},
+		{1000, 0, 1},
+		{2500, 300, 10},
+	}
+	for i, tt := range tests {
+		ids := make([]string, 0)
+		for j := 0; j < tt.count; j++ {
+			ids = append(ids, fmt.Sprintf("i-%04d", j))
+		}
+		ec2Svc := &mockEc2Svc{autodescribe: true, pageSize: tt.pageSize}
+		instances, err := awsGetInstanceInfo(context.Background(), ec2Svc, ids)
+		if err != nil {
+			t.Errorf("%d: unexpected error: %v", i, err)
+			continue
+		}
+		if len(instances) != tt.count {
+			t.Errorf("%d: expected %d instances, had %d", i, tt.count, len(instances))
+		}
+		for _, id := range ids {
+			if instances[id] == nil || instances[id].privateDNSName != "host"+id {
+				t.Errorf("%d: missing or mismatched instance %s: %v", i, id, instances[id])
+				break
+			}
+		}
+		calls := ec2Svc.counter.filterByName("DescribeInstances")
+		if len(calls) != tt.calls {
+			t.Errorf("%d: expected %d calls, had %d", i, tt.calls, len(calls))
+		}
+		for _, c := range calls {
+			if n := len(c.params[0].(*ec2.DescribeInstancesInput).InstanceIds); n > maxDescribeInstanceIds {
+				t.Errorf("%d: called with %d IDs, more than the limit of %d", i, n, maxDescribeInstanceIds)
+			}
+		}
+	}
+}
+
+func TestAwsDescribeInstancesNotFound(t *testing.T) {
+	ec2Svc := &mockEc2Svc{autodescribe: true, instances: map[string]*ec2.Instance{"i-2": nil, "i-4": nil}}
+	instances, err := awsGetInstanceInfo(context.Background(), ec2Svc, []string{"i-1", "i-2", "i-3", "i-4"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(instances) != 2 || instances["i-1"] == nil || instances["i-3"] == nil {
+		t.Errorf("expected only the instances that exist, actual %v", instances)
+	}
+	// once with all of them, and again without those that do not exist
+	if calls := ec2Svc.counter.filterByName("DescribeInstances"); len(calls) != 2 {
+		t.Errorf("expected 2 calls, had %d", len(calls))
+	}
+
+	// none of them exist
+	ec2Svc = &mockEc2Svc{instances: map[string]*ec2.Instance{"i-2": nil}}
+	if instances, err := awsGetInstanceInfo(context.Background(), ec2Svc, []string{"i-2"}); err != nil || len(instances) != 0 {
+		t.Errorf("expected no instances and no error, actual %v, %v", instances, err)
+	}
+
+	// any other error is still an error
+	if _, err := awsGetInstanceInfo(context.Background(), &mockEc2Svc{}, []string{"notexist"}); err == nil || !strings.HasPrefix(err.Error(), "Unable to get description") {
+		t.Errorf("mismatched error, actual %v", err)
+	}
+}
+
 func TestAwsSetAsgDesired(t *testing.T) {
 	groupName := "mygroup"
 	tests := []struct {
@@ -300,7 +597,7 @@ func TestAwsSetAsgDesired(t *testing.T) {
 		asg := &autoscaling.Group{
 			AutoScalingGroupName: &groupName,
 		}
-		err := setAsgDesired(&mockAsgSvc{
+		err := setAsgDesired(context.Background(), &mockAsgSvc{
 			err: tt.setErr,
 		}, asg, tt.desired)
 		switch {
@@ -331,7 +628,7 @@ func TestAwsGetLaunchTemplate(t *testing.T) {
 			LaunchTemplateNames: aws.StringSlice(tt.names),
 			LaunchTemplateIds:   aws.StringSlice(tt.ids),
 		}
-		template, err := awsGetLaunchTemplate(&mockEc2Svc{}, input)
+		template, err := awsGetLaunchTemplate(context.Background(), &mockEc2Svc{}, input)
 		switch {
 		case (err == nil && tt.err != nil) || (err != nil && tt.err == nil) || (err != nil && tt.err != nil && !strings.HasPrefix(err.Error(), tt.err.Error())):
 			t.Errorf("%d: Mismatched error, actual then expected", i)
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/ghodss/yaml"
+)
+
+// configFile is the optional YAML or JSON configuration file. Anything set in it takes precedence over
+// the environment variables of the same name, e.g. check-delay over ROLLER_CHECK_DELAY.
+type configFile struct {
+	// CheckDelay is the time, in seconds, between checks of ASG status
+	CheckDelay *int `json:"check-delay"`
+	// IgnoreDaemonSets is whether to ignore DaemonSet pods when draining a node
+	IgnoreDaemonSets *bool `json:"ignore-daemonsets"`
+	// Defaults are the settings for every ASG, by the name of their tag without the aws-asg-roller/
+	// prefix, e.g. max-surge
+	Defaults map[string]configValue `json:"defaults"`
+	// ASGs are ASGs to manage, each with its name and any settings to override for it
+	ASGs []map[string]configValue `json:"asgs"`
+}
+
+// configValue is a single setting in the config file, which may be written as a string, number,
+// boolean or list, but is parsed the same way as the tag of the same name
+type configValue string
+
+func (v *configValue) UnmarshalJSON(b []byte) error {
+	var value interface{}
+	if err := json.Unmarshal(b, &value); err != nil {
+		return err
+	}
+	switch value := value.(type) {
+	case string:
+		*v = configValue(value)
+	case bool, float64:
+		*v = configValue(strings.TrimSpace(string(b)))
+	case []interface{}:
+		items := make([]string, 0, len(value))
+		for _, item := range value {
+			s, ok := item.(string)
+			if !ok {
+				return fmt.Errorf("list %s must only contain strings", string(b))
+			}
+			items = append(items, s)
+		}
+		*v = configValue(strings.Join(items, ","))
+	default:
+		return fmt.Errorf("%s must be a string, number, boolean or list", string(b))
+	}
+	return nil
+}
+
+const (
+	// configNameKey is the key of the name of each ASG in the asgs list of the config file
+	configNameKey = "name"
+	// configTagPrefix is the prefix of the tags that correspond to settings in the config file
+	configTagPrefix = "aws-asg-roller/"
+)
+
+// asgSettingTags are the tags that may also be set in the config file, without their prefix
+var asgSettingTags = []string{
+	tagMaxSurge,
+	tagMaxUnavailable,
+	tagStrategy,
+	tagRaiseMaxSize,
+	tagTerminationOrder,
+	tagCordonOldNodes,
+	tagCordonTaint,
+	tagProtectNewNodes,
+	tagSuspendProcesses,
+	tagReconcileDesired,
+	tagDrainTimeout,
+	tagDrainGracePeriod,
+	tagDrainDeleteEmptyDirData,
+	tagDrainForce,
+	tagDrainSkipPods,
+	tagDrainTimeoutPolicy,
+	tagWaitForReschedule,
+	tagRescheduleTimeout,
+	tagNodeUnhealthyConditions,
+	tagNodeBlockingTaints,
+}
+
+// Returns the path of the config file from the --config flag, or ROLLER_CONFIG_FILE, empty if neither is set
+func getConfigFilePath(flagValue string) string {
+	if flagValue != "" {
+		return flagValue
+	}
+	return os.Getenv("ROLLER_CONFIG_FILE")
+}
+
+// loadConfigFile reads and validates the config file at path, returning nil if path is empty
+func loadConfigFile(path string) (*configFile, error) {
+	if path == "" {
+		return nil, nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read config file %s: %v", path, err)
+	}
+	file, err := parseConfigFile(b)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid config file %s: %v", path, err)
+	}
+	return file, nil
+}
+
+// parseConfigFile parses the YAML or JSON contents of a config file, and checks that every setting in it is known
+// and valid, so that mistakes are reported at startup rather than when an ASG is next rolled
+func parseConfigFile(b []byte) (*configFile, error) {
+	j, err := yaml.YAMLToJSON(b)
+	if err != nil {
+		return nil, err
+	}
+	file := &configFile{}
+	decoder := json.NewDecoder(bytes.NewReader(j))
+	decoder.DisallowUnknownFields()
+	// an empty file is null, which leaves everything unset
+	if err := decoder.Decode(file); err != nil {
+		return nil, err
+	}
+	if file.CheckDelay != nil && *file.CheckDelay < 0 {
+		return nil, fmt.Errorf("check-delay must not be negative: %d", *file.CheckDelay)
+	}
+	if err := validateConfigSettings(file.Defaults, false); err != nil {
+		return nil, fmt.Errorf("defaults: %v", err)
+	}
+	seen := map[string]bool{}
+	for i, values := range file.ASGs {
+		name := string(values[configNameKey])
+		if name == "" {
+			return nil, fmt.Errorf("asgs[%d] has no name", i)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("asgs[%d]: ASG %s is listed more than once", i, name)
+		}
+		seen[name] = true
+		if err := validateConfigSettings(values, true); err != nil {
+			return nil, fmt.Errorf("asgs[%d] (%s): %v", i, name, err)
+		}
+	}
+	// the settings themselves are checked when building the rollerConfig from them
+	if _, err := getRollerConfig(file); err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// validateConfigSettings checks that every key is the name of a setting
+func validateConfigSettings(values map[string]configValue, named bool) error {
+	known := map[string]bool{}
+	for _, tag := range asgSettingTags {
+		known[strings.TrimPrefix(tag, configTagPrefix)] = true
+	}
+	unknown := make([]string, 0)
+	for key := range values {
+		if !known[key] && !(named && key == configNameKey) {
+			unknown = append(unknown, key)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("unknown settings %v", unknown)
+	}
+	return nil
+}
+
+// asgNames returns the names of the ASGs listed in the config file
+func (f *configFile) asgNames() []string {
+	names := make([]string, 0)
+	if f == nil {
+		return names
+	}
+	for _, values := range f.ASGs {
+		names = append(names, string(values[configNameKey]))
+	}
+	return names
+}
+
+// asTags returns settings from the config file keyed by their full tag names, so they can be applied like tags
+func asTags(values map[string]configValue) map[string]string {
+	tags := map[string]string{}
+	for key, value := range values {
+		if key != configNameKey {
+			tags[configTagPrefix+key] = string(value)
+		}
+	}
+	return tags
+}
+
+// getIgnoreDaemonSets reads whether to ignore DaemonSet pods when draining from the config file, or ROLLER_IGNORE_DAEMONSETS
+func getIgnoreDaemonSets(file *configFile) bool {
+	if file != nil && file.IgnoreDaemonSets != nil {
+		return *file.IgnoreDaemonSets
+	}
+	return os.Getenv("ROLLER_IGNORE_DAEMONSETS") != "false"
+}
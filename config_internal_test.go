@@ -0,0 +1,158 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const testConfigYAML = `
+check-delay: 60
+ignore-daemonsets: false
+defaults:
+  max-surge: 25%
+  drain-timeout: 600
+  drain-timeout-policy: skip
+  node-unhealthy-conditions: [NetworkUnavailable, DiskPressure]
+asgs:
+- name: workers
+  max-surge: 3
+  cordon-old-nodes: true
+  wait-for-reschedule: true
+  reschedule-timeout: 120
+- name: ingress
+  strategy: unavailable
+  node-blocking-taints: node.cloudprovider.kubernetes.io/uninitialized:NoSchedule
+`
+
+func TestParseConfigFile(t *testing.T) {
+	tests := []struct {
+		desc     string
+		contents string
+		err      string
+	}{
+		{"yaml", testConfigYAML, ""},
+		{"json", `{"check-delay": 10, "defaults": {"max-surge": 2}, "asgs": [{"name": "workers", "raise-max-size": true}]}`, ""},
+		{"empty", ``, ""},
+		{"unknown top level key", "check-delays: 10", "unknown field"},
+		{"unknown default", "defaults:\n  max-surges: 2", "defaults: unknown settings [max-surges]"},
+		{"unknown asg setting", "asgs:\n- name: workers\n  drain-timout: 5", "asgs[0] (workers): unknown settings [drain-timout]"},
+		{"invalid default", "defaults:\n  max-surge: 0", "config file defaults setting max-surge is invalid"},
+		{"invalid asg setting", "asgs:\n- name: workers\n  drain-timeout-policy: wait", "config file ASG workers setting drain-timeout-policy is invalid"},
+		{"missing name", "asgs:\n- max-surge: 2", "asgs[0] has no name"},
+		{"duplicate name", "asgs:\n- name: workers\n- name: workers", "asgs[1]: ASG workers is listed more than once"},
+		{"negative check delay", "check-delay: -1", "check-delay must not be negative"},
+		{"object setting", "defaults:\n  max-surge: {value: 2}", "must be a string, number, boolean or list"},
+		{"not yaml", "defaults: [", "yaml"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			_, err := parseConfigFile([]byte(tt.contents))
+			switch {
+			case err != nil && tt.err == "":
+				t.Errorf("unexpected error: %v", err)
+			case err == nil && tt.err != "":
+				t.Errorf("expected error containing %q", tt.err)
+			case err != nil && !strings.Contains(err.Error(), tt.err):
+				t.Errorf("mismatched error, actual %v expected to contain %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	file, err := loadConfigFile("")
+	if err != nil || file != nil {
+		t.Errorf("expected no config file without a path, got %v, %v", file, err)
+	}
+	if _, err := loadConfigFile("/nonexistent/roller.yaml"); err == nil {
+		t.Errorf("expected error reading missing config file")
+	}
+
+	dir, err := ioutil.TempDir("", "roller")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "roller.yaml")
+	if err := ioutil.WriteFile(path, []byte(testConfigYAML), 0644); err != nil {
+		t.Fatalf("unable to write config file: %v", err)
+	}
+	file, err = loadConfigFile(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if names := file.asgNames(); !testStringEq(names, []string{"workers", "ingress"}) {
+		t.Errorf("mismatched ASG names %v", names)
+	}
+	if delay, err := getDelay(file); err != nil || delay != 60 {
+		t.Errorf("mismatched check delay %d, %v", delay, err)
+	}
+	if getIgnoreDaemonSets(file) {
+		t.Errorf("expected DaemonSets not to be ignored")
+	}
+	if !getIgnoreDaemonSets(nil) {
+		t.Errorf("expected DaemonSets to be ignored by default")
+	}
+}
+
+func TestConfigFileSettings(t *testing.T) {
+	file, err := parseConfigFile([]byte(testConfigYAML))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	config, err := getRollerConfig(file)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	tests := []struct {
+		name              string
+		tags              map[string]string
+		maxSurge          intOrPercent
+		strategy          string
+		cordonOldNodes    bool
+		drainTimeout      time.Duration
+		waitForReschedule bool
+		rescheduleTimeout time.Duration
+		blockingTaints    int
+	}{
+		// only the defaults apply to ASGs that are not listed
+		{"other", nil, intOrPercent{value: 25, percent: true}, strategySurge, false, 10 * time.Minute, false, defaultRescheduleTimeout * time.Second, 0},
+		{"workers", nil, intOrPercent{value: 3}, strategySurge, true, 10 * time.Minute, true, 2 * time.Minute, 0},
+		{"ingress", nil, intOrPercent{value: 25, percent: true}, strategyUnavailable, false, 10 * time.Minute, false, defaultRescheduleTimeout * time.Second, 1},
+		// tags override the config file
+		{"workers", map[string]string{tagMaxSurge: "5", tagDrainTimeout: "60"}, intOrPercent{value: 5}, strategySurge, true, time.Minute, true, 2 * time.Minute, 0},
+	}
+	for i, tt := range tests {
+		asg := &autoscaling.Group{AutoScalingGroupName: aws.String(tt.name)}
+		for k, v := range tt.tags {
+			asg.Tags = append(asg.Tags, &autoscaling.TagDescription{Key: aws.String(k), Value: aws.String(v)})
+		}
+		settings, err := config.settingsFor(asg)
+		switch {
+		case err != nil:
+			t.Errorf("%d: unexpected error: %v", i, err)
+		case settings.maxSurge != tt.maxSurge:
+			t.Errorf("%d: mismatched maxSurge, actual %v expected %v", i, settings.maxSurge, tt.maxSurge)
+		case settings.strategy != tt.strategy:
+			t.Errorf("%d: mismatched strategy, actual %s expected %s", i, settings.strategy, tt.strategy)
+		case settings.cordonOldNodes != tt.cordonOldNodes:
+			t.Errorf("%d: mismatched cordonOldNodes, actual %v expected %v", i, settings.cordonOldNodes, tt.cordonOldNodes)
+		case settings.drain.timeout != tt.drainTimeout || settings.drain.timeoutPolicy != drainTimeoutSkip:
+			t.Errorf("%d: mismatched drain timeout, actual %v %s expected %v %s", i, settings.drain.timeout, settings.drain.timeoutPolicy, tt.drainTimeout, drainTimeoutSkip)
+		case settings.drain.waitForReschedule != tt.waitForReschedule || settings.drain.rescheduleTimeout != tt.rescheduleTimeout:
+			t.Errorf("%d: mismatched reschedule, actual %v %v expected %v %v", i, settings.drain.waitForReschedule, settings.drain.rescheduleTimeout, tt.waitForReschedule, tt.rescheduleTimeout)
+		case len(settings.readiness.unhealthyConditions) != 2 || settings.readiness.unhealthyConditions[1] != corev1.NodeDiskPressure:
+			t.Errorf("%d: mismatched unhealthy conditions %v", i, settings.readiness.unhealthyConditions)
+		case len(settings.readiness.blockingTaints) != tt.blockingTaints:
+			t.Errorf("%d: mismatched blocking taints %v", i, settings.readiness.blockingTaints)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"syscall"
+	"time"
+)
+
+const configPollInterval = 10 * time.Second // How often to check the config file for changes
+
+// configReloader asks for the config file to be reloaded when it changes, or on SIGHUP
+type configReloader struct {
+	path string
+	// reload has a value when a reload has been asked for, but not yet done
+	reload chan struct{}
+}
+
+// newConfigReloader watches the config file at path, checking it for changes every poll
+func newConfigReloader(path string, poll time.Duration) *configReloader {
+	r := &configReloader{path: path, reload: make(chan struct{}, 1)}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			log.Printf("Received SIGHUP, reloading config file %s", path)
+			r.request()
+		}
+	}()
+	go r.poll(poll)
+	return r
+}
+
+// poll asks for a reload whenever the contents of the config file change. A ConfigMap volume replaces the
+// file rather than writing to it, so we compare its contents rather than waiting for writes.
+func (r *configReloader) poll(interval time.Duration) {
+	last, _ := ioutil.ReadFile(r.path)
+	for {
+		time.Sleep(interval)
+		contents, err := ioutil.ReadFile(r.path)
+		if err != nil {
+			// it may be in the middle of being replaced, so wait for it to come back
+			continue
+		}
+		if !bytes.Equal(contents, last) {
+			log.Printf("Config file %s changed, reloading", r.path)
+			last = contents
+			r.request()
+		}
+	}
+}
+
+func (r *configReloader) request() {
+	select {
+	case r.reload <- struct{}{}:
+	default:
+		// already asked for
+	}
+}
+
+// requested returns whether a reload has been asked for since it last returned true
+func (r *configReloader) requested() bool {
+	select {
+	case <-r.reload:
+		return true
+	default:
+		return false
+	}
+}
+
+// reloadedConfig is everything that comes from the config file, as used by the main loop
+type reloadedConfig struct {
+	file             *configFile
+	discovery        *asgDiscovery
+	config           *rollerConfig
+	checkDelay       int
+	maxLoopAge       time.Duration
+	ignoreDaemonSets bool
+}
+
+// reloadConfig loads the config file at path, and everything that depends on it. If anything is invalid,
+// it returns an error, and the current config should be kept.
+func reloadConfig(path string) (*reloadedConfig, error) {
+	var (
+		r   = &reloadedConfig{}
+		err error
+	)
+	if r.file, err = loadConfigFile(path); err != nil {
+		return nil, err
+	}
+	if r.discovery, err = getAsgDiscovery(r.file); err != nil {
+		return nil, err
+	}
+	if r.config, err = getRollerConfig(r.file); err != nil {
+		return nil, err
+	}
+	if r.checkDelay, err = getDelay(r.file); err != nil {
+		return nil, err
+	}
+	if r.maxLoopAge, err = getMaxLoopAge(r.checkDelay); err != nil {
+		return nil, err
+	}
+	r.ignoreDaemonSets = getIgnoreDaemonSets(r.file)
+	return r, nil
+}
+
+// diffConfigFiles describes what changed between two versions of the config file, either of which may be nil
+func diffConfigFiles(previous, current *configFile) []string {
+	if previous == nil {
+		previous = &configFile{}
+	}
+	if current == nil {
+		current = &configFile{}
+	}
+	changes := make([]string, 0)
+	if !reflect.DeepEqual(previous.CheckDelay, current.CheckDelay) {
+		changes = append(changes, fmt.Sprintf("check-delay: %s -> %s", describeIntPtr(previous.CheckDelay), describeIntPtr(current.CheckDelay)))
+	}
+	if !reflect.DeepEqual(previous.IgnoreDaemonSets, current.IgnoreDaemonSets) {
+		changes = append(changes, fmt.Sprintf("ignore-daemonsets: %s -> %s", describeBoolPtr(previous.IgnoreDaemonSets), describeBoolPtr(current.IgnoreDaemonSets)))
+	}
+	changes = append(changes, diffConfigSettings("defaults", previous.Defaults, current.Defaults)...)
+	previousASGs, currentASGs := previous.asgSettingsByName(), current.asgSettingsByName()
+	for _, name := range previous.asgNames() {
+		if _, ok := currentASGs[name]; !ok {
+			changes = append(changes, fmt.Sprintf("ASG %s removed", name))
+		}
+	}
+	for _, name := range current.asgNames() {
+		values, ok := previousASGs[name]
+		if !ok {
+			changes = append(changes, fmt.Sprintf("ASG %s added", name))
+			values = map[string]configValue{configNameKey: configValue(name)}
+		}
+		changes = append(changes, diffConfigSettings(fmt.Sprintf("ASG %s", name), values, currentASGs[name])...)
+	}
+	return changes
+}
+
+// diffConfigSettings describes the settings that changed in one section of the config file
+func diffConfigSettings(section string, previous, current map[string]configValue) []string {
+	keys := map[string]bool{}
+	for key := range previous {
+		keys[key] = true
+	}
+	for key := range current {
+		keys[key] = true
+	}
+	sorted := make([]string, 0, len(keys))
+	for key := range keys {
+		sorted = append(sorted, key)
+	}
+	sort.Strings(sorted)
+	changes := make([]string, 0)
+	for _, key := range sorted {
+		before, hadBefore := previous[key]
+		after, hasAfter := current[key]
+		if before == after && hadBefore == hasAfter {
+			continue
+		}
+		changes = append(changes, fmt.Sprintf("%s %s: %s -> %s", section, key, describeConfigValue(before, hadBefore), describeConfigValue(after, hasAfter)))
+	}
+	return changes
+}
+
+// asgSettingsByName returns the settings of each ASG listed in the config file, by its name
+func (f *configFile) asgSettingsByName() map[string]map[string]configValue {
+	byName := map[string]map[string]configValue{}
+	for _, values := range f.ASGs {
+		byName[string(values[configNameKey])] = values
+	}
+	return byName
+}
+
+func describeConfigValue(v configValue, ok bool) string {
+	if !ok {
+		return "(unset)"
+	}
+	return string(v)
+}
+
+func describeIntPtr(i *int) string {
+	if i == nil {
+		return "(unset)"
+	}
+	return fmt.Sprintf("%d", *i)
+}
+
+func describeBoolPtr(b *bool) string {
+	if b == nil {
+		return "(unset)"
+	}
+	return fmt.Sprintf("%v", *b)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestDiffConfigFiles(t *testing.T) {
+	tests := []struct {
+		desc     string
+		previous string
+		current  string
+		changes  []string
+	}{
+		{"unchanged", testConfigYAML, testConfigYAML, []string{}},
+		{"no file", "", "", []string{}},
+		{"check delay", "check-delay: 30", "check-delay: 60", []string{"check-delay: 30 -> 60"}},
+		{"ignore daemonsets", "", "ignore-daemonsets: false", []string{"ignore-daemonsets: (unset) -> false"}},
+		{"defaults", "defaults:\n  max-surge: 1\n  drain-timeout: 60", "defaults:\n  max-surge: 2\n  strategy: unavailable",
+			[]string{"defaults drain-timeout: 60 -> (unset)", "defaults max-surge: 1 -> 2", "defaults strategy: (unset) -> unavailable"}},
+		{"asgs", "asgs:\n- name: a\n- name: b\n  max-surge: 2", "asgs:\n- name: b\n  max-surge: 3\n- name: c\n  max-surge: 4",
+			[]string{"ASG a removed", "ASG b max-surge: 2 -> 3", "ASG c added", "ASG c max-surge: (unset) -> 4"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			previous, err := parseConfigFile([]byte(tt.previous))
+			if err != nil {
+				t.Fatalf("invalid previous config: %v", err)
+			}
+			current, err := parseConfigFile([]byte(tt.current))
+			if err != nil {
+				t.Fatalf("invalid current config: %v", err)
+			}
+			if changes := diffConfigFiles(previous, current); !testStringEq(changes, tt.changes) {
+				t.Errorf("mismatched changes, actual %v expected %v", changes, tt.changes)
+			}
+		})
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "roller")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "roller.yaml")
+
+	if err := ioutil.WriteFile(path, []byte(testConfigYAML), 0644); err != nil {
+		t.Fatalf("unable to write config file: %v", err)
+	}
+	reloaded, err := reloadConfig(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if reloaded.checkDelay != 60 || reloaded.maxLoopAge != 20*time.Minute || reloaded.ignoreDaemonSets {
+		t.Errorf("mismatched reloaded config %+v", reloaded)
+	}
+	if !reloaded.discovery.manages("workers") || reloaded.discovery.manages("other") {
+		t.Errorf("mismatched managed ASGs %v", reloaded.discovery.static)
+	}
+	if _, ok := reloaded.config.overrides["ingress"]; !ok {
+		t.Errorf("missing settings for ASG ingress")
+	}
+
+	for _, invalid := range []string{"defaults:\n  max-surge: 0", "check-delay: [", "asgs: []"} {
+		if err := ioutil.WriteFile(path, []byte(invalid), 0644); err != nil {
+			t.Fatalf("unable to write config file: %v", err)
+		}
+		if _, err := reloadConfig(path); err == nil {
+			t.Errorf("expected error reloading %q", invalid)
+		}
+	}
+}
+
+func TestConfigReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "roller")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "roller.yaml")
+	if err := ioutil.WriteFile(path, []byte("check-delay: 30"), 0644); err != nil {
+		t.Fatalf("unable to write config file: %v", err)
+	}
+
+	r := newConfigReloader(path, 10*time.Millisecond)
+	waitRequested := func(what string) {
+		deadline := time.Now().Add(5 * time.Second)
+		for !r.requested() {
+			if time.Now().After(deadline) {
+				t.Fatalf("no reload requested after %s", what)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if r.requested() {
+		t.Errorf("reload requested without a change")
+	}
+	if err := ioutil.WriteFile(path, []byte("check-delay: 60"), 0644); err != nil {
+		t.Fatalf("unable to write config file: %v", err)
+	}
+	waitRequested("changing the file")
+
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatalf("unable to send SIGHUP: %v", err)
+	}
+	waitRequested("SIGHUP")
+	if r.requested() {
+		t.Errorf("reload requested again without a change")
+	}
+}
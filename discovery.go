@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
+)
+
+const (
+	tagEnabled = "aws-asg-roller/enabled"
+
+	defaultDiscoveryTags = tagEnabled + "=true"
+	// clusterTagPrefix is the tag, with the cluster name appended, that marks resources as belonging to a kubernetes cluster
+	clusterTagPrefix = "kubernetes.io/cluster/"
+)
+
+// tagFilter matches ASGs with a tag key, and optionally a specific value
+type tagFilter struct {
+	key   string
+	value string
+	// anyValue matches the key regardless of its value
+	anyValue bool
+}
+
+func (t tagFilter) String() string {
+	if t.anyValue {
+		return t.key
+	}
+	return fmt.Sprintf("%s=%s", t.key, t.value)
+}
+
+// parseTagFilters parses a comma-separated list of key=value or key filters
+func parseTagFilters(s string) ([]tagFilter, error) {
+	filters := make([]tagFilter, 0)
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		parts := strings.SplitN(f, "=", 2)
+		key := strings.TrimSpace(parts[0])
+		if key == "" {
+			return nil, fmt.Errorf("tag filter %s has no key", f)
+		}
+		if len(parts) == 1 {
+			filters = append(filters, tagFilter{key: key, anyValue: true})
+			continue
+		}
+		filters = append(filters, tagFilter{key: key, value: strings.TrimSpace(parts[1])})
+	}
+	return filters, nil
+}
+
+// asgDiscovery works out which ASGs to manage, from a static list and from their tags
+type asgDiscovery struct {
+	// static are always managed
+	static []string
+	// filters, if any, find additional ASGs that have all of the tags
+	filters []tagFilter
+}
+
+// getAsgDiscovery reads the ASGs to manage from ROLLER_ASG and the config file and, if ROLLER_DISCOVERY
+// is enabled, the tags to discover others by
+func getAsgDiscovery(file *configFile) (*asgDiscovery, error) {
+	d := &asgDiscovery{static: make([]string, 0)}
+	for _, name := range strings.Split(os.Getenv("ROLLER_ASG"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			d.static = append(d.static, name)
+		}
+	}
+	d.static = append(d.static, file.asgNames()...)
+	if os.Getenv("ROLLER_DISCOVERY") == "true" {
+		tags := os.Getenv("ROLLER_DISCOVERY_TAGS")
+		if tags == "" {
+			tags = defaultDiscoveryTags
+		}
+		filters, err := parseTagFilters(tags)
+		if err != nil {
+			return nil, fmt.Errorf("ROLLER_DISCOVERY_TAGS is invalid: %v", err)
+		}
+		if cluster := os.Getenv("ROLLER_DISCOVERY_CLUSTER"); cluster != "" {
+			filters = append(filters, tagFilter{key: clusterTagPrefix + cluster, anyValue: true})
+		}
+		if len(filters) == 0 {
+			return nil, fmt.Errorf("ROLLER_DISCOVERY requires at least one tag in ROLLER_DISCOVERY_TAGS")
+		}
+		d.filters = filters
+	}
+	if len(d.static) == 0 && len(d.filters) == 0 {
+		return nil, fmt.Errorf("Must supply at least one ASG in ROLLER_ASG environment variable or the config file, or enable ROLLER_DISCOVERY")
+	}
+	return d, nil
+}
+
+// manages returns whether the ASG is listed to be managed, or may be discovered by its tags
+func (d *asgDiscovery) manages(name string) bool {
+	if len(d.filters) > 0 {
+		return true
+	}
+	for _, static := range d.static {
+		if static == name {
+			return true
+		}
+	}
+	return false
+}
+
+// names returns the sorted names of all of the ASGs to manage right now
+func (d *asgDiscovery) names(ctx context.Context, svc autoscalingiface.AutoScalingAPI) ([]string, error) {
+	found := map[string]bool{}
+	for _, name := range d.static {
+		found[name] = true
+	}
+	if len(d.filters) > 0 {
+		discovered, err := awsDiscoverGroups(ctx, svc, d.filters)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range discovered {
+			found[name] = true
+		}
+	}
+	names := make([]string, 0, len(found))
+	for name := range found {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// awsDiscoverGroups returns the names of all ASGs that match every one of the tag filters
+func awsDiscoverGroups(ctx context.Context, svc autoscalingiface.AutoScalingAPI, filters []tagFilter) ([]string, error) {
+	var matching map[string]bool
+	for _, f := range filters {
+		awsFilters := []*autoscaling.Filter{
+			{
+				Name:   aws.String("key"),
+				Values: aws.StringSlice([]string{f.key}),
+			},
+		}
+		if !f.anyValue {
+			awsFilters = append(awsFilters, &autoscaling.Filter{
+				Name:   aws.String("value"),
+				Values: aws.StringSlice([]string{f.value}),
+			})
+		}
+		tags, err := awsDescribeTagsByFilters(ctx, svc, awsFilters)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to discover ASGs with tag %s: %v", f, err)
+		}
+		found := map[string]bool{}
+		for _, t := range tags {
+			// the key and value filters may match different tags, so check the tag itself
+			if aws.StringValue(t.Key) != f.key || (!f.anyValue && aws.StringValue(t.Value) != f.value) {
+				continue
+			}
+			name := aws.StringValue(t.ResourceId)
+			if matching == nil || matching[name] {
+				found[name] = true
+			}
+		}
+		matching = found
+	}
+	names := make([]string, 0, len(matching))
+	for name := range matching {
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// addedNames returns the names in current that were not in previous
+func addedNames(previous, current []string) []string {
+	known := map[string]bool{}
+	for _, name := range previous {
+		known[name] = true
+	}
+	added := make([]string, 0)
+	for _, name := range current {
+		if !known[name] {
+			added = append(added, name)
+		}
+	}
+	return added
+}
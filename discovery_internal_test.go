@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestParseTagFilters(t *testing.T) {
+	tests := []struct {
+		input       string
+		expected    string
+		shouldError bool
+	}{
+		{"", "", false},
+		{"aws-asg-roller/enabled=true", "aws-asg-roller/enabled=true", false},
+		{" a=b , c ", "a=b,c", false},
+		{"a=", "a=", false},
+		{"=b", "", true},
+	}
+	for i, tt := range tests {
+		filters, err := parseTagFilters(tt.input)
+		switch {
+		case err != nil && !tt.shouldError:
+			t.Errorf("%d: unexpected error: %v", i, err)
+		case err == nil && tt.shouldError:
+			t.Errorf("%d: expected error", i)
+		case err == nil:
+			s := make([]string, 0)
+			for _, f := range filters {
+				s = append(s, f.String())
+			}
+			if strings.Join(s, ",") != tt.expected {
+				t.Errorf("%d: mismatched filters, actual %v expected %s", i, s, tt.expected)
+			}
+		}
+	}
+}
+
+func TestGetAsgDiscovery(t *testing.T) {
+	tests := []struct {
+		name        string
+		env         map[string]string
+		static      string
+		filters     int
+		shouldError bool
+	}{
+		{"should require some ASGs", nil, "", 0, true},
+		{"should split the static list", map[string]string{"ROLLER_ASG": "a, b,"}, "a,b", 0, false},
+		{"should use the default tag", map[string]string{"ROLLER_DISCOVERY": "true"}, "", 1, false},
+		{"should add the cluster tag", map[string]string{"ROLLER_DISCOVERY": "true", "ROLLER_DISCOVERY_CLUSTER": "prod"}, "", 2, false},
+		{"should use custom tags", map[string]string{"ROLLER_DISCOVERY": "true", "ROLLER_DISCOVERY_TAGS": "team=a,pool"}, "", 2, false},
+		{"should ignore tags unless enabled", map[string]string{"ROLLER_ASG": "a", "ROLLER_DISCOVERY_TAGS": "team=a"}, "a", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, k := range []string{"ROLLER_ASG", "ROLLER_DISCOVERY", "ROLLER_DISCOVERY_TAGS", "ROLLER_DISCOVERY_CLUSTER"} {
+				os.Unsetenv(k)
+			}
+			for k, v := range tt.env {
+				os.Setenv(k, v)
+				defer os.Unsetenv(k)
+			}
+			d, err := getAsgDiscovery(nil)
+			switch {
+			case err != nil && !tt.shouldError:
+				t.Errorf("unexpected error: %v", err)
+			case err == nil && tt.shouldError:
+				t.Error("expected error")
+			case err != nil:
+			case strings.Join(d.static, ",") != tt.static:
+				t.Errorf("mismatched static, actual %v expected %s", d.static, tt.static)
+			case len(d.filters) != tt.filters:
+				t.Errorf("mismatched filters, actual %v expected %d", d.filters, tt.filters)
+			}
+		})
+	}
+}
+
+func TestDiscoveryNames(t *testing.T) {
+	asgSvc := &mockAsgSvc{
+		pageSize: 2,
+		tags: map[string]map[string]string{
+			"pool-a":    {tagEnabled: "true", clusterTagPrefix + "prod": "owned"},
+			"pool-b":    {tagEnabled: "true", clusterTagPrefix + "prod": "shared"},
+			"pool-c":    {tagEnabled: "false", clusterTagPrefix + "prod": "owned"},
+			"pool-d":    {tagEnabled: "true", clusterTagPrefix + "dev": "owned"},
+			"pool-e":    {"Name": "true", clusterTagPrefix + "prod": "owned"},
+			"unrelated": {"Name": "unrelated"},
+		},
+	}
+	tests := []struct {
+		name      string
+		discovery *asgDiscovery
+		expected  string
+	}{
+		{"static only", &asgDiscovery{static: []string{"b", "a"}}, "a,b"},
+		{"by tag", &asgDiscovery{filters: []tagFilter{{key: tagEnabled, value: "true"}}}, "pool-a,pool-b,pool-d"},
+		{"by tag and cluster", &asgDiscovery{filters: []tagFilter{{key: tagEnabled, value: "true"}, {key: clusterTagPrefix + "prod", anyValue: true}}}, "pool-a,pool-b"},
+		{"static and by tag", &asgDiscovery{static: []string{"pool-a", "other"}, filters: []tagFilter{{key: clusterTagPrefix + "dev", anyValue: true}}}, "other,pool-a,pool-d"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			names, err := tt.discovery.names(context.Background(), asgSvc)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if strings.Join(names, ",") != tt.expected {
+				t.Errorf("mismatched names, actual %v expected %s", names, tt.expected)
+			}
+		})
+	}
+}
+
+func TestAddedNames(t *testing.T) {
+	added := addedNames([]string{"a", "b"}, []string{"a", "c", "d"})
+	if !testStringEq(added, []string{"c", "d"}) {
+		t.Errorf("mismatched added names, actual %v", added)
+	}
+}
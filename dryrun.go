@@ -0,0 +1,353 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+// rolloutPlan is what a single adjust would have done to each ASG, had it not been a dry run
+type rolloutPlan struct {
+	Groups map[string]*groupPlan `json:"groups"`
+}
+
+// groupPlan is what adjust would have done to a single ASG
+type groupPlan struct {
+	// CurrentDesired is the desired capacity when we looked at the ASG
+	CurrentDesired int64 `json:"currentDesired"`
+	// Desired is the desired capacity adjust would set, nil if it would not set it
+	Desired *int64 `json:"desired,omitempty"`
+	// MaxSize is the max size adjust would set, nil if it would not change it
+	MaxSize *int64 `json:"maxSize,omitempty"`
+	// Cordon are the old instances that would be cordoned at the start of the rollout
+	Cordon []string `json:"cordon,omitempty"`
+	// Suspend are the scaling processes that would be suspended
+	Suspend []string `json:"suspend,omitempty"`
+	// Resume are the scaling processes that would be resumed
+	Resume []string `json:"resume,omitempty"`
+	// Drain are the instances that would be prepared for termination, e.g. drained in Kubernetes
+	Drain []string `json:"drain,omitempty"`
+	// Terminate are the instances that would be terminated
+	Terminate []string `json:"terminate,omitempty"`
+	// State is the rollout state that would be saved, nil if unchanged or removed
+	State *rolloutState `json:"state,omitempty"`
+	// Complete is whether the rollout would be finished, and its state removed
+	Complete bool `json:"complete,omitempty"`
+}
+
+// dryRunRecorder builds a rolloutPlan from the changes adjust tries to make
+type dryRunRecorder struct {
+	mu   sync.Mutex
+	plan rolloutPlan
+	// instanceGroups maps each instance ID we have seen to the name of its ASG
+	instanceGroups map[string]string
+}
+
+func newDryRunRecorder() *dryRunRecorder {
+	return &dryRunRecorder{
+		plan:           rolloutPlan{Groups: map[string]*groupPlan{}},
+		instanceGroups: map[string]string{},
+	}
+}
+
+// group returns the plan for the named ASG, creating it if needed. Must be called with mu held.
+func (d *dryRunRecorder) group(name string) *groupPlan {
+	g, ok := d.plan.Groups[name]
+	if !ok {
+		g = &groupPlan{}
+		d.plan.Groups[name] = g
+	}
+	return g
+}
+
+func (d *dryRunRecorder) groupForInstance(id string) *groupPlan {
+	name, ok := d.instanceGroups[id]
+	if !ok {
+		name = "unknown"
+	}
+	return d.group(name)
+}
+
+func (d *dryRunRecorder) recordGroups(groups []*autoscaling.Group) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, asg := range groups {
+		name := aws.StringValue(asg.AutoScalingGroupName)
+		d.group(name).CurrentDesired = aws.Int64Value(asg.DesiredCapacity)
+		for _, i := range asg.Instances {
+			d.instanceGroups[aws.StringValue(i.InstanceId)] = name
+		}
+	}
+}
+
+// writeText writes the plan in human-readable form
+func (d *dryRunRecorder) writeText(w io.Writer) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	names := make([]string, 0)
+	for name := range d.plan.Groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		g := d.plan.Groups[name]
+		lines := make([]string, 0)
+		if g.State != nil {
+			lines = append(lines, fmt.Sprintf("save rollout state: original desired %d, target %s", g.State.OriginalDesired, g.State.TargetVersion))
+		}
+		if g.MaxSize != nil {
+			lines = append(lines, fmt.Sprintf("set max size to %d", *g.MaxSize))
+		}
+		if g.Desired != nil && *g.Desired != g.CurrentDesired {
+			lines = append(lines, fmt.Sprintf("set desired from %d to %d", g.CurrentDesired, *g.Desired))
+		}
+		if len(g.Suspend) > 0 {
+			lines = append(lines, fmt.Sprintf("suspend processes %s", strings.Join(g.Suspend, ", ")))
+		}
+		if len(g.Resume) > 0 {
+			lines = append(lines, fmt.Sprintf("resume processes %s", strings.Join(g.Resume, ", ")))
+		}
+		if len(g.Cordon) > 0 {
+			lines = append(lines, fmt.Sprintf("cordon %s", strings.Join(g.Cordon, ", ")))
+		}
+		if len(g.Drain) > 0 {
+			lines = append(lines, fmt.Sprintf("drain %s", strings.Join(g.Drain, ", ")))
+		}
+		if len(g.Terminate) > 0 {
+			lines = append(lines, fmt.Sprintf("terminate %s", strings.Join(g.Terminate, ", ")))
+		}
+		if g.Complete {
+			lines = append(lines, "complete rollout")
+		}
+		if len(lines) == 0 {
+			lines = append(lines, "no changes")
+		}
+		if _, err := fmt.Fprintf(w, "ASG %s:\n", name); err != nil {
+			return err
+		}
+		for _, l := range lines {
+			if _, err := fmt.Fprintf(w, "  - %s\n", l); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// writeJSON writes the plan as JSON
+func (d *dryRunRecorder) writeJSON(w io.Writer) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(d.plan)
+}
+
+// dryRunAsgSvc passes reads through to the real AutoScaling API, but only records changes. Every change is
+// overridden both with and without a context, as anything not overridden would reach the real API.
+type dryRunAsgSvc struct {
+	autoscalingiface.AutoScalingAPI
+	recorder *dryRunRecorder
+}
+
+func (d *dryRunAsgSvc) DescribeAutoScalingGroups(in *autoscaling.DescribeAutoScalingGroupsInput) (*autoscaling.DescribeAutoScalingGroupsOutput, error) {
+	return d.DescribeAutoScalingGroupsWithContext(aws.BackgroundContext(), in)
+}
+
+func (d *dryRunAsgSvc) DescribeAutoScalingGroupsWithContext(ctx aws.Context, in *autoscaling.DescribeAutoScalingGroupsInput, opts ...request.Option) (*autoscaling.DescribeAutoScalingGroupsOutput, error) {
+	out, err := d.AutoScalingAPI.DescribeAutoScalingGroupsWithContext(ctx, in, opts...)
+	if err == nil {
+		d.recorder.recordGroups(out.AutoScalingGroups)
+	}
+	return out, err
+}
+
+func (d *dryRunAsgSvc) SetDesiredCapacity(in *autoscaling.SetDesiredCapacityInput) (*autoscaling.SetDesiredCapacityOutput, error) {
+	return d.SetDesiredCapacityWithContext(aws.BackgroundContext(), in)
+}
+
+func (d *dryRunAsgSvc) SetDesiredCapacityWithContext(ctx aws.Context, in *autoscaling.SetDesiredCapacityInput, opts ...request.Option) (*autoscaling.SetDesiredCapacityOutput, error) {
+	d.recorder.mu.Lock()
+	defer d.recorder.mu.Unlock()
+	d.recorder.group(aws.StringValue(in.AutoScalingGroupName)).Desired = aws.Int64(aws.Int64Value(in.DesiredCapacity))
+	return &autoscaling.SetDesiredCapacityOutput{}, nil
+}
+
+func (d *dryRunAsgSvc) UpdateAutoScalingGroup(in *autoscaling.UpdateAutoScalingGroupInput) (*autoscaling.UpdateAutoScalingGroupOutput, error) {
+	return d.UpdateAutoScalingGroupWithContext(aws.BackgroundContext(), in)
+}
+
+func (d *dryRunAsgSvc) UpdateAutoScalingGroupWithContext(ctx aws.Context, in *autoscaling.UpdateAutoScalingGroupInput, opts ...request.Option) (*autoscaling.UpdateAutoScalingGroupOutput, error) {
+	d.recorder.mu.Lock()
+	defer d.recorder.mu.Unlock()
+	if in.MaxSize != nil {
+		d.recorder.group(aws.StringValue(in.AutoScalingGroupName)).MaxSize = aws.Int64(*in.MaxSize)
+	}
+	return &autoscaling.UpdateAutoScalingGroupOutput{}, nil
+}
+
+func (d *dryRunAsgSvc) TerminateInstanceInAutoScalingGroup(in *autoscaling.TerminateInstanceInAutoScalingGroupInput) (*autoscaling.TerminateInstanceInAutoScalingGroupOutput, error) {
+	return d.TerminateInstanceInAutoScalingGroupWithContext(aws.BackgroundContext(), in)
+}
+
+func (d *dryRunAsgSvc) TerminateInstanceInAutoScalingGroupWithContext(ctx aws.Context, in *autoscaling.TerminateInstanceInAutoScalingGroupInput, opts ...request.Option) (*autoscaling.TerminateInstanceInAutoScalingGroupOutput, error) {
+	d.recorder.mu.Lock()
+	defer d.recorder.mu.Unlock()
+	id := aws.StringValue(in.InstanceId)
+	g := d.recorder.groupForInstance(id)
+	g.Terminate = append(g.Terminate, id)
+	return &autoscaling.TerminateInstanceInAutoScalingGroupOutput{}, nil
+}
+
+func (d *dryRunAsgSvc) SuspendProcesses(in *autoscaling.ScalingProcessQuery) (*autoscaling.SuspendProcessesOutput, error) {
+	return d.SuspendProcessesWithContext(aws.BackgroundContext(), in)
+}
+
+func (d *dryRunAsgSvc) SuspendProcessesWithContext(ctx aws.Context, in *autoscaling.ScalingProcessQuery, opts ...request.Option) (*autoscaling.SuspendProcessesOutput, error) {
+	d.recorder.mu.Lock()
+	defer d.recorder.mu.Unlock()
+	g := d.recorder.group(aws.StringValue(in.AutoScalingGroupName))
+	g.Suspend = append(g.Suspend, aws.StringValueSlice(in.ScalingProcesses)...)
+	return &autoscaling.SuspendProcessesOutput{}, nil
+}
+
+func (d *dryRunAsgSvc) ResumeProcesses(in *autoscaling.ScalingProcessQuery) (*autoscaling.ResumeProcessesOutput, error) {
+	return d.ResumeProcessesWithContext(aws.BackgroundContext(), in)
+}
+
+func (d *dryRunAsgSvc) ResumeProcessesWithContext(ctx aws.Context, in *autoscaling.ScalingProcessQuery, opts ...request.Option) (*autoscaling.ResumeProcessesOutput, error) {
+	d.recorder.mu.Lock()
+	defer d.recorder.mu.Unlock()
+	g := d.recorder.group(aws.StringValue(in.AutoScalingGroupName))
+	g.Resume = append(g.Resume, aws.StringValueSlice(in.ScalingProcesses)...)
+	return &autoscaling.ResumeProcessesOutput{}, nil
+}
+
+func (d *dryRunAsgSvc) CreateOrUpdateTags(in *autoscaling.CreateOrUpdateTagsInput) (*autoscaling.CreateOrUpdateTagsOutput, error) {
+	return d.CreateOrUpdateTagsWithContext(aws.BackgroundContext(), in)
+}
+
+func (d *dryRunAsgSvc) CreateOrUpdateTagsWithContext(ctx aws.Context, in *autoscaling.CreateOrUpdateTagsInput, opts ...request.Option) (*autoscaling.CreateOrUpdateTagsOutput, error) {
+	return &autoscaling.CreateOrUpdateTagsOutput{}, nil
+}
+
+func (d *dryRunAsgSvc) DeleteTags(in *autoscaling.DeleteTagsInput) (*autoscaling.DeleteTagsOutput, error) {
+	return d.DeleteTagsWithContext(aws.BackgroundContext(), in)
+}
+
+func (d *dryRunAsgSvc) DeleteTagsWithContext(ctx aws.Context, in *autoscaling.DeleteTagsInput, opts ...request.Option) (*autoscaling.DeleteTagsOutput, error) {
+	return &autoscaling.DeleteTagsOutput{}, nil
+}
+
+// dryRunReadiness checks readiness with the real handler, but only records which nodes it would drain
+type dryRunReadiness struct {
+	readiness
+	recorder *dryRunRecorder
+}
+
+func (d *dryRunReadiness) prepareTermination(ctx context.Context, instances []instanceDescriptor, opts drainSettings) error {
+	d.recorder.mu.Lock()
+	defer d.recorder.mu.Unlock()
+	for _, i := range instances {
+		g := d.recorder.groupForInstance(i.id)
+		g.Drain = append(g.Drain, fmt.Sprintf("%s (%s)", i.id, i.hostname))
+	}
+	return nil
+}
+
+func (d *dryRunReadiness) cordon(hostnames []string, ids []string, taint bool) error {
+	if _, ok := d.readiness.(cordoner); !ok || !supports(d.readiness, capabilityCordon) {
+		return fmt.Errorf("readiness handler cannot cordon")
+	}
+	d.recorder.mu.Lock()
+	defer d.recorder.mu.Unlock()
+	for i, id := range ids {
+		g := d.recorder.groupForInstance(id)
+		g.Cordon = append(g.Cordon, fmt.Sprintf("%s (%s)", id, hostnames[i]))
+	}
+	return nil
+}
+
+// uncordon does nothing, as only the real handler knows which nodes it cordoned, and the plan
+// already shows the rollout completing
+func (d *dryRunReadiness) uncordon(hostnames []string, ids []string) error {
+	return nil
+}
+
+// protect and unprotect do nothing, as protecting nodes from scale down does not change the plan
+func (d *dryRunReadiness) protect(hostnames []string, ids []string) error {
+	return nil
+}
+
+func (d *dryRunReadiness) unprotect(hostnames []string, ids []string) error {
+	return nil
+}
+
+func (d *dryRunReadiness) getPodCounts(hostnames []string, ids []string) (map[string]int, error) {
+	counter, ok := d.readiness.(podCounter)
+	if !ok || !supports(d.readiness, capabilityCountPods) {
+		return nil, fmt.Errorf("readiness handler cannot count pods")
+	}
+	return counter.getPodCounts(hostnames, ids)
+}
+
+// dryRunStateStore keeps rollout state in memory, starting from what is in the real store, and
+// records what would have been saved
+type dryRunStateStore struct {
+	*memoryStateStore
+	recorder *dryRunRecorder
+}
+
+func newDryRunStateStore(states map[string]*rolloutState, recorder *dryRunRecorder) *dryRunStateStore {
+	store := newMemoryStateStore()
+	for name, state := range states {
+		_ = store.save(context.Background(), name, state)
+	}
+	return &dryRunStateStore{memoryStateStore: store, recorder: recorder}
+}
+
+func (d *dryRunStateStore) save(ctx context.Context, name string, state *rolloutState) error {
+	d.recorder.mu.Lock()
+	s := *state
+	d.recorder.group(name).State = &s
+	d.recorder.mu.Unlock()
+	return d.memoryStateStore.save(ctx, name, state)
+}
+
+func (d *dryRunStateStore) remove(ctx context.Context, name string) error {
+	d.recorder.mu.Lock()
+	g := d.recorder.group(name)
+	g.State = nil
+	g.Complete = true
+	d.recorder.mu.Unlock()
+	return d.memoryStateStore.remove(ctx, name)
+}
+
+// dryRun runs adjust once without changing anything, and writes the plan of what it would have
+// done in human-readable form to text, and as JSON to jsonOut
+func dryRun(ctx context.Context, asgList []string, ec2Svc ec2iface.EC2API, asgSvc autoscalingiface.AutoScalingAPI, readinessHandler readiness, states map[string]*rolloutState, config *rollerConfig, text, jsonOut io.Writer) error {
+	recorder := newDryRunRecorder()
+	var handler readiness
+	if readinessHandler != nil {
+		handler = &dryRunReadiness{readiness: readinessHandler, recorder: recorder}
+	}
+	store := newDryRunStateStore(states, recorder)
+	adjustErr := adjust(ctx, asgList, ec2Svc, &dryRunAsgSvc{AutoScalingAPI: asgSvc, recorder: recorder}, handler, states, store, config)
+	if err := recorder.writeText(text); err != nil {
+		return fmt.Errorf("Unable to write plan: %v", err)
+	}
+	if err := recorder.writeJSON(jsonOut); err != nil {
+		return fmt.Errorf("Unable to write plan: %v", err)
+	}
+	return adjustErr
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+)
+
+func TestDryRun(t *testing.T) {
+	config := &rollerConfig{defaults: asgSettings{strategy: strategySurge, maxSurge: intOrPercent{value: 1}, maxUnavailable: intOrPercent{value: 1}}}
+	asgSvc := &mockAsgSvc{groups: map[string]*autoscaling.Group{
+		// mid-rollout, with a new instance ready, so the next old one can go
+		"rolling": testGroup("rolling", 4, 5, []string{"1", "2", "3"}, []string{"4"}, nil),
+		// not started yet
+		"starting": testGroup("starting", 2, 5, []string{"5", "6"}, nil, nil),
+	}}
+	states := map[string]*rolloutState{
+		"rolling": {OriginalDesired: 3, StartTime: time.Now(), TargetVersion: "newconf"},
+	}
+	// the real handler must never be asked to drain
+	handler := &testReadyHandler{terminateError: fmt.Errorf("drained during a dry run")}
+
+	var text, jsonOut bytes.Buffer
+	if err := dryRun(context.Background(), []string{"rolling", "starting"}, &mockEc2Svc{autodescribe: true}, asgSvc, handler, states, config, &text, &jsonOut); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, name := range []string{"SetDesiredCapacity", "TerminateInstanceInAutoScalingGroup", "UpdateAutoScalingGroup", "CreateOrUpdateTags", "DeleteTags"} {
+		if calls := asgSvc.counter.filterByName(name); len(calls) != 0 {
+			t.Errorf("expected no calls to %s, got %d", name, len(calls))
+		}
+	}
+
+	var plan rolloutPlan
+	if err := json.Unmarshal(jsonOut.Bytes(), &plan); err != nil {
+		t.Fatalf("invalid JSON plan: %v\n%s", err, jsonOut.String())
+	}
+	rolling := plan.Groups["rolling"]
+	switch {
+	case rolling == nil:
+		t.Fatalf("missing plan for rolling")
+	case !testStringEq(rolling.Terminate, []string{"1"}):
+		t.Errorf("rolling: mismatched terminate, actual %v", rolling.Terminate)
+	case !testStringEq(rolling.Drain, []string{"1 (host1)"}):
+		t.Errorf("rolling: mismatched drain, actual %v", rolling.Drain)
+	case rolling.Desired == nil || *rolling.Desired != 4:
+		t.Errorf("rolling: mismatched desired, actual %v", rolling.Desired)
+	}
+	starting := plan.Groups["starting"]
+	switch {
+	case starting == nil:
+		t.Fatalf("missing plan for starting")
+	case starting.Desired == nil || *starting.Desired != 3:
+		t.Errorf("starting: mismatched desired, actual %v", starting.Desired)
+	case starting.State == nil || starting.State.OriginalDesired != 2:
+		t.Errorf("starting: expected state with original desired 2, actual %v", starting.State)
+	case len(starting.Terminate) != 0:
+		t.Errorf("starting: expected no terminations, actual %v", starting.Terminate)
+	}
+	for _, expected := range []string{"ASG rolling:", "terminate 1", "ASG starting:", "set desired from 2 to 3"} {
+		if !strings.Contains(text.String(), expected) {
+			t.Errorf("text plan missing %q:\n%s", expected, text.String())
+		}
+	}
+}
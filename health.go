@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
+)
+
+const (
+	defaultLivenessCheckDelays = 20              // Default number of check delays without finishing a loop after which we are not live
+	minMaxLoopAge              = time.Minute     // Shortest time the loop may go without finishing, however short the check delay
+	readyTimeout               = 5 * time.Second // How long the readiness check waits for AWS, so slow probes fail rather than pile up
+)
+
+// healthChecker is a readiness handler that can check its own connection, e.g. to Kubernetes
+type healthChecker interface {
+	checkHealth() error
+}
+
+// health tracks whether the roller is live, i.e. still getting through its loop, and ready, i.e. able to talk to AWS
+// and Kubernetes
+type health struct {
+	asgSvc           autoscalingiface.AutoScalingAPI
+	readinessHandler readiness
+	// maxLoopAge is how long the loop may go without finishing an iteration before we are not live
+	maxLoopAge time.Duration
+
+	lock     sync.Mutex
+	lastLoop time.Time
+}
+
+func newHealth(asgSvc autoscalingiface.AutoScalingAPI, readinessHandler readiness, maxLoopAge time.Duration) *health {
+	return &health{asgSvc: asgSvc, readinessHandler: readinessHandler, maxLoopAge: maxLoopAge, lastLoop: time.Now()}
+}
+
+// Returns how long the loop may go without finishing an iteration, as ROLLER_LIVENESS_CHECK_DELAYS times the check delay,
+// but never less than minMaxLoopAge, as an iteration takes some time even with no delay
+func getMaxLoopAge(checkDelay int) (time.Duration, error) {
+	delays := defaultLivenessCheckDelays
+	if delaysOverride, exist := os.LookupEnv("ROLLER_LIVENESS_CHECK_DELAYS"); exist {
+		var err error
+		delays, err = strconv.Atoi(delaysOverride)
+		if err != nil || delays < 1 {
+			return 0, fmt.Errorf("ROLLER_LIVENESS_CHECK_DELAYS is not a valid number: %v", delaysOverride)
+		}
+	}
+	maxLoopAge := time.Duration(delays*checkDelay) * time.Second
+	if maxLoopAge < minMaxLoopAge {
+		maxLoopAge = minMaxLoopAge
+	}
+	return maxLoopAge, nil
+}
+
+// loopDone records that the loop has finished an iteration
+func (h *health) loopDone() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.lastLoop = time.Now()
+}
+
+// setMaxLoopAge changes how long the loop may go without finishing an iteration, e.g. when the check delay changes
+func (h *health) setMaxLoopAge(maxLoopAge time.Duration) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.maxLoopAge = maxLoopAge
+}
+
+// live returns an error if the loop has not finished an iteration for too long, e.g. because a drain is stuck
+func (h *health) live() error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if age := time.Since(h.lastLoop); age > h.maxLoopAge {
+		return fmt.Errorf("Last finished checking ASGs %v ago, more than %v", age.Round(time.Second), h.maxLoopAge)
+	}
+	return nil
+}
+
+// ready returns an error if we cannot talk to AWS, or to Kubernetes if we use it
+func (h *health) ready(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, readyTimeout)
+	defer cancel()
+	_, err := h.asgSvc.DescribeAutoScalingGroupsWithContext(ctx, &autoscaling.DescribeAutoScalingGroupsInput{MaxRecords: aws.Int64(1)})
+	if err != nil {
+		return fmt.Errorf("Unable to describe ASGs: %v", err)
+	}
+	if c, ok := h.readinessHandler.(healthChecker); ok {
+		if err := c.checkHealth(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// healthHandler serves the result of a check, 200 if it passes, 503 with the error if not. The check stops
+// if the request goes away.
+func healthHandler(check func(ctx context.Context) error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := check(r.Context()); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// unhealthyReadyHandler is a readiness handler that cannot reach whatever it checks
+type unhealthyReadyHandler struct {
+	readiness
+}
+
+func (u *unhealthyReadyHandler) checkHealth() error {
+	return fmt.Errorf("unreachable")
+}
+
+func TestGetMaxLoopAge(t *testing.T) {
+	tests := []struct {
+		name        string
+		envValue    string
+		checkDelay  int
+		want        time.Duration
+		shouldError bool
+	}{
+		{"should return default", "", 30, 10 * time.Minute, false},
+		{"should return override", "4", 30, 2 * time.Minute, false},
+		{"should not go below the minimum", "4", 5, time.Minute, false},
+		{"should not go below the minimum without a delay", "", 0, time.Minute, false},
+		{"should error if override invalid", "fake", 30, 0, true},
+		{"should error if override zero", "0", 30, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Unsetenv("ROLLER_LIVENESS_CHECK_DELAYS")
+			if tt.envValue != "" {
+				os.Setenv("ROLLER_LIVENESS_CHECK_DELAYS", tt.envValue)
+				defer os.Unsetenv("ROLLER_LIVENESS_CHECK_DELAYS")
+			}
+			got, err := getMaxLoopAge(tt.checkDelay)
+			switch {
+			case err != nil && !tt.shouldError:
+				t.Errorf("unexpected error: %v", err)
+			case err == nil && tt.shouldError:
+				t.Errorf("expected error")
+			case err == nil && got != tt.want:
+				t.Errorf("mismatched max loop age, actual %v expected %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHealthz(t *testing.T) {
+	h := newHealth(nil, nil, time.Minute)
+	handler := newHTTPHandler(h)
+	tests := []struct {
+		lastLoop time.Time
+		code     int
+	}{
+		{time.Now(), 200},
+		{time.Now().Add(-30 * time.Second), 200},
+		{time.Now().Add(-2 * time.Minute), 503},
+	}
+	for i, tt := range tests {
+		h.lastLoop = tt.lastLoop
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", "/healthz", nil))
+		if rec.Code != tt.code {
+			t.Errorf("%d: mismatched status, actual %d expected %d", i, rec.Code, tt.code)
+		}
+	}
+	// finishing a loop makes us live again
+	h.loopDone()
+	if err := h.live(); err != nil {
+		t.Errorf("unexpected error after finishing a loop: %v", err)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	tests := []struct {
+		asgErr           error
+		readinessHandler readiness
+		code             int
+	}{
+		{nil, nil, 200},
+		{fmt.Errorf("no credentials"), nil, 503},
+		{nil, &kubernetesReadiness{clientset: fake.NewSimpleClientset()}, 200},
+		{nil, &unhealthyReadyHandler{}, 503},
+		{nil, &testReadyHandler{}, 200},
+	}
+	for i, tt := range tests {
+		h := newHealth(&mockAsgSvc{err: tt.asgErr}, tt.readinessHandler, time.Minute)
+		rec := httptest.NewRecorder()
+		newHTTPHandler(h).ServeHTTP(rec, httptest.NewRequest("GET", "/readyz", nil))
+		if rec.Code != tt.code {
+			t.Errorf("%d: mismatched status, actual %d expected %d: %s", i, rec.Code, tt.code, rec.Body.String())
+		}
+	}
+}
+
+func TestReadyzCancelled(t *testing.T) {
+	h := newHealth(&mockAsgSvc{}, nil, time.Minute)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	// a probe that has gone away does not wait for AWS
+	rec := httptest.NewRecorder()
+	newHTTPHandler(h).ServeHTTP(rec, httptest.NewRequest("GET", "/readyz", nil).WithContext(ctx))
+	if rec.Code != 503 {
+		t.Errorf("mismatched status, actual %d expected 503: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestGetHTTPAddress(t *testing.T) {
+	defer os.Unsetenv("ROLLER_HTTP_ADDRESS")
+	os.Unsetenv("ROLLER_HTTP_ADDRESS")
+	if address := getHTTPAddress(); address != defaultHTTPAddress {
+		t.Errorf("mismatched default address, actual %q expected %q", address, defaultHTTPAddress)
+	}
+	os.Setenv("ROLLER_HTTP_ADDRESS", "127.0.0.1:9090")
+	if address := getHTTPAddress(); address != "127.0.0.1:9090" {
+		t.Errorf("mismatched address, actual %q expected %q", address, "127.0.0.1:9090")
+	}
+	// set to empty, nothing is served
+	os.Setenv("ROLLER_HTTP_ADDRESS", "")
+	if address := getHTTPAddress(); address != "" {
+		t.Errorf("expected no address when disabled, actual %q", address)
+	}
+}
@@ -1,82 +1,471 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 
 	drain "github.com/openshift/kubernetes-drain"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/record"
+)
+
+const (
+	serviceAccountNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
 )
 
 type kubernetesReadiness struct {
-	clientset        *kubernetes.Clientset
+	clientset        kubernetes.Interface
 	ignoreDaemonSets bool
+	// reschedulePoll is how often to check if they are, defaulting to reschedulePollInterval
+	reschedulePoll time.Duration
+	// recorder, if set, records events for what we do to nodes, and to the roller pod
+	recorder record.EventRecorder
+	// pod is the pod the roller runs in, nil if not in the cluster
+	pod *corev1.ObjectReference
+
+	mu sync.Mutex
+	// cordonedByDrain are the names of nodes that were schedulable until the latest prepareTermination drained
+	// them, so rollbackTermination knows which to uncordon; only the latest, as a rollback follows straight after
+	cordonedByDrain map[string]bool
+}
+
+// taintMatcher matches taints by key, and optionally effect
+type taintMatcher struct {
+	key    string
+	effect corev1.TaintEffect
+}
+
+func (t taintMatcher) matches(taint corev1.Taint) bool {
+	return taint.Key == t.key && (t.effect == "" || taint.Effect == t.effect)
+}
+
+// parseTaintMatchers parses a list of key or key:Effect taints, separated by commas or spaces
+func parseTaintMatchers(s string) ([]taintMatcher, error) {
+	matchers := make([]taintMatcher, 0)
+	for _, t := range splitList(s) {
+		t = strings.TrimSpace(t)
+		if t == "" {
+			continue
+		}
+		parts := strings.SplitN(t, ":", 2)
+		m := taintMatcher{key: parts[0]}
+		if len(parts) == 2 {
+			m.effect = corev1.TaintEffect(parts[1])
+			switch m.effect {
+			case corev1.TaintEffectNoSchedule, corev1.TaintEffectPreferNoSchedule, corev1.TaintEffectNoExecute:
+			default:
+				return nil, fmt.Errorf("taint %s has unknown effect %s", t, parts[1])
+			}
+		}
+		if m.key == "" {
+			return nil, fmt.Errorf("taint %s has no key", t)
+		}
+		matchers = append(matchers, m)
+	}
+	return matchers, nil
+}
+
+// parseSkipPods parses a label selector of pods to leave on a node when draining it, e.g.
+// "app=critical,tier in (db)", where a pod matching any one of the requirements is skipped.
+// It returns the opposite selector, of the pods to drain, or nil to drain all of them.
+func parseSkipPods(s string) (labels.Selector, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	skip, err := labels.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	requirements, _ := skip.Requirements()
+	selector := labels.NewSelector()
+	for _, r := range requirements {
+		var op selection.Operator
+		switch r.Operator() {
+		case selection.Equals, selection.DoubleEquals:
+			op = selection.NotEquals
+		case selection.NotEquals:
+			op = selection.Equals
+		case selection.In:
+			op = selection.NotIn
+		case selection.NotIn:
+			op = selection.In
+		case selection.Exists:
+			op = selection.DoesNotExist
+		case selection.DoesNotExist:
+			op = selection.Exists
+		default:
+			return nil, fmt.Errorf("unsupported operator %s in %s", r.Operator(), r.String())
+		}
+		negated, err := labels.NewRequirement(r.Key(), op, r.Values().List())
+		if err != nil {
+			return nil, err
+		}
+		selector = selector.Add(*negated)
+	}
+	return selector, nil
+}
+
+// parseConditionTypes parses a list of node condition types, separated by commas or spaces
+func parseConditionTypes(s string) []corev1.NodeConditionType {
+	types := make([]corev1.NodeConditionType, 0)
+	for _, c := range splitList(s) {
+		if c = strings.TrimSpace(c); c != "" {
+			types = append(types, corev1.NodeConditionType(c))
+		}
+	}
+	return types
+}
+
+func (k *kubernetesReadiness) getReadiness(ctx context.Context, instances []instanceDescriptor, opts readinessSettings) ([]instanceReadiness, error) {
+	nodes, err := k.getNodes(splitInstances(instances))
+	if err != nil {
+		return nil, err
+	}
+	results := make([]instanceReadiness, 0, len(instances))
+	for _, i := range instances {
+		// an instance that has not registered as a node yet is certainly not ready
+		node, ok := nodes[i.id]
+		if !ok {
+			results = append(results, instanceReadiness{id: i.id, reason: "has not joined the kubernetes cluster yet"})
+			continue
+		}
+		r := instanceReadiness{id: i.id, ready: true}
+		if reason := nodeUnready(node, opts); reason != "" {
+			r = instanceReadiness{id: i.id, reason: fmt.Sprintf("kubernetes node %s: %s", node.Name, reason)}
+		}
+		results = append(results, r)
+	}
+	return results, nil
+}
+
+// checkHealth checks that we can reach the Kubernetes API server
+func (k *kubernetesReadiness) checkHealth() error {
+	if _, err := k.clientset.Discovery().ServerVersion(); err != nil {
+		return fmt.Errorf("Unable to reach kubernetes: %v", err)
+	}
+	return nil
+}
+
+// nodeUnready checks if a node is ready for usage, returning why not, or an empty string if it is
+func nodeUnready(node *corev1.Node, opts readinessSettings) string {
+	conditions := map[corev1.NodeConditionType]corev1.ConditionStatus{}
+	for _, c := range node.Status.Conditions {
+		conditions[c.Type] = c.Status
+	}
+	if status, ok := conditions[corev1.NodeReady]; !ok {
+		return "no Ready condition"
+	} else if status != corev1.ConditionTrue {
+		return fmt.Sprintf("Ready is %s", status)
+	}
+	for _, c := range opts.unhealthyConditions {
+		if conditions[c] == corev1.ConditionTrue {
+			return fmt.Sprintf("%s is %s", c, corev1.ConditionTrue)
+		}
+	}
+	for _, t := range node.Spec.Taints {
+		for _, m := range opts.blockingTaints {
+			if m.matches(t) {
+				return fmt.Sprintf("has taint %s:%s", t.Key, t.Effect)
+			}
+		}
+	}
+	return ""
+}
+func (k *kubernetesReadiness) prepareTermination(ctx context.Context, instances []instanceDescriptor, opts drainSettings) error {
+	// nodes drained before were either terminated, or left cordoned as the rollback was not needed, and the
+	// name of a terminated node may be reused, so forget them
+	k.mu.Lock()
+	k.cordonedByDrain = map[string]bool{}
+	k.mu.Unlock()
+	nodes, err := k.getNodes(splitInstances(instances))
+	if err != nil {
+		return err
+	}
+	for _, i := range instances {
+		id := i.id
+		// do not start draining another node once we are shutting down
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		node, ok := nodes[id]
+		if !ok {
+			// it never joined the cluster, or has already left, so there is nothing to drain
+			log.Printf("No kubernetes node found for instance %s, not draining", id)
+			continue
+		}
+		// remember what was running, so we can wait for it to come back elsewhere
+		var workloads map[types.UID]*workload
+		if opts.waitForReschedule {
+			if workloads, err = k.getWorkloads(node, opts.podSelector); err != nil {
+				return err
+			}
+		}
+		if !node.Spec.Unschedulable {
+			k.mu.Lock()
+			k.cordonedByDrain[node.Name] = true
+			k.mu.Unlock()
+		}
+		if err := k.drainNode(ctx, node, opts); err != nil {
+			return err
+		}
+		if len(workloads) > 0 {
+			if err := k.waitForReschedule(ctx, node, workloads, opts.rescheduleTimeout); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// drainNode cordons the node and evicts its pods, applying the timeout policy if it takes too long.
+// If ctx is cancelled first, it stops the drain and uncordons the node, unless it was already unschedulable.
+func (k *kubernetesReadiness) drainNode(ctx context.Context, node *corev1.Node, opts drainSettings) (err error) {
+	k.nodeEvent(node, eventNormal, reasonDrainStarted, "Draining node to replace its outdated instance")
+	defer func() {
+		if err == nil {
+			k.nodeEvent(node, eventNormal, reasonDrained, "Drained node")
+		} else {
+			k.nodeEvent(node, eventWarning, reasonDrainFailed, err.Error())
+		}
+	}()
+	start := time.Now()
+	// the drain library cannot be cancelled, so its requests fail once ctx is done instead. It also goes on
+	// evicting pods after giving up at its timeout, so it is stopped as soon as we return.
+	drainCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- drain.Drain(&drainClientset{Interface: k.clientset, ctx: drainCtx}, []*corev1.Node{node}, &drain.DrainOptions{
+			IgnoreDaemonsets:   k.ignoreDaemonSets,
+			GracePeriodSeconds: opts.gracePeriod,
+			Force:              opts.force,
+			DeleteLocalData:    opts.deleteEmptyDirData,
+			Timeout:            opts.timeout,
+			Selector:           opts.podSelector,
+		})
+	}()
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		// wait for the drain to stop, so it does not evict anything from the node once it is uncordoned
+		<-done
+		if !node.Spec.Unschedulable {
+			k.rollbackCordon(node)
+		}
+		return fmt.Errorf("Stopped draining kubernetes node %s: %v", node.Name, ctx.Err())
+	}
+	if err == nil {
+		return nil
+	}
+	// the drain library does not tell us why it failed, so anything that took the whole timeout timed out,
+	// e.g. waiting for a PodDisruptionBudget to allow an eviction
+	if opts.timeout == 0 || time.Since(start) < opts.timeout {
+		return fmt.Errorf("Unexpected error draining kubernetes node %s: %v", node.Name, err)
+	}
+	switch opts.timeoutPolicy {
+	case drainTimeoutSkip:
+		// leave the node as it was, rather than cordoned and being emptied
+		cancel()
+		if !node.Spec.Unschedulable {
+			k.rollbackCordon(node)
+		}
+		return &skipTerminationError{reason: fmt.Sprintf("draining kubernetes node %s did not complete within %v", node.Name, opts.timeout)}
+	case drainTimeoutForce:
+		log.Printf("Draining kubernetes node %s did not complete within %v, deleting its remaining pods", node.Name, opts.timeout)
+		return k.forceDeletePods(node, opts)
+	default:
+		return fmt.Errorf("Draining kubernetes node %s did not complete within %v: %v", node.Name, opts.timeout, err)
+	}
+}
+
+// rollbackTermination uncordons the nodes prepareTermination drained, unless they were already unschedulable.
+// The pods it evicted have gone elsewhere, but new ones may be scheduled on the nodes again.
+func (k *kubernetesReadiness) rollbackTermination(ctx context.Context, instances []instanceDescriptor) error {
+	nodes, err := k.getNodes(splitInstances(instances))
+	if err != nil {
+		return err
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for _, node := range nodes {
+		if k.cordonedByDrain[node.Name] {
+			k.rollbackCordon(node)
+			delete(k.cordonedByDrain, node.Name)
+		}
+	}
+	return nil
 }
 
-func (k *kubernetesReadiness) getUnreadyCount(hostnames []string, ids []string) (int, error) {
-	hostHash := map[string]bool{}
-	for _, h := range hostnames {
-		hostHash[h] = true
+// rollbackCordon makes a node we started draining schedulable again, so it is not left cordoned when
+// we stop part way. Failures are only logged, as we are already giving up on the drain.
+func (k *kubernetesReadiness) rollbackCordon(node *corev1.Node) {
+	current, err := k.clientset.CoreV1().Nodes().Get(node.Name, v1.GetOptions{})
+	if err != nil {
+		log.Printf("Unable to get kubernetes node %s to uncordon it: %v", node.Name, err)
+		return
+	}
+	if !current.Spec.Unschedulable {
+		return
 	}
+	updated := current.DeepCopy()
+	updated.Spec.Unschedulable = false
+	if _, err := k.clientset.CoreV1().Nodes().Update(updated); err != nil {
+		log.Printf("Unable to uncordon kubernetes node %s: %v", node.Name, err)
+		return
+	}
+	log.Printf("Uncordoned kubernetes node %s, which we had started to drain", node.Name)
+}
+
+// forceDeletePods deletes the pods a drain would have evicted from the node, without waiting for
+// them to shut down or checking PodDisruptionBudgets
+func (k *kubernetesReadiness) forceDeletePods(node *corev1.Node, opts drainSettings) error {
+	listOptions := v1.ListOptions{
+		FieldSelector: fields.OneTermEqualSelector("spec.nodeName", node.Name).String(),
+	}
+	if opts.podSelector != nil {
+		listOptions.LabelSelector = opts.podSelector.String()
+	}
+	pods, err := k.clientset.CoreV1().Pods(v1.NamespaceAll).List(listOptions)
+	if err != nil {
+		return fmt.Errorf("Unexpected error listing pods on kubernetes node %s: %v", node.Name, err)
+	}
+	var gracePeriod int64
+	for i := range pods.Items {
+		p := &pods.Items[i]
+		if p.Spec.NodeName != node.Name || p.DeletionTimestamp != nil || isDaemonSetPod(p) {
+			continue
+		}
+		if opts.podSelector != nil && !opts.podSelector.Matches(labels.Set(p.Labels)) {
+			continue
+		}
+		// static pods are managed by the kubelet, and cannot be deleted through the API
+		if _, ok := p.Annotations[corev1.MirrorPodAnnotationKey]; ok {
+			continue
+		}
+		err := k.clientset.CoreV1().Pods(p.Namespace).Delete(p.Name, &v1.DeleteOptions{GracePeriodSeconds: &gracePeriod})
+		if err != nil && !errors.IsNotFound(err) {
+			return fmt.Errorf("Unexpected error deleting pod %s/%s from kubernetes node %s: %v", p.Namespace, p.Name, node.Name, err)
+		}
+	}
+	return nil
+}
+
+// getNodes finds the kubernetes node for each instance, keyed by instance ID. Instances without
+// a node, e.g. because they have not joined the cluster yet, are not in the map.
+func (k *kubernetesReadiness) getNodes(hostnames []string, ids []string) (map[string]*corev1.Node, error) {
 	/*
-		in AWS, the `name` of the node *always* is the internal private DNS name
-		you can get a node by name by doing Nodes().Get(name)
-		In other words the `name` of the node is set independently and does not care what
-		the kubelet had for --hostname-override.
-		However, if you want multiple nodes, you need to use the `List()` interface.
-		This interface does not accept multiple hostnames. It lists everything, subject only to a filter
-		The filter, however, can filter only on labels, and not on the name.
-		We _should_ be able to just filter on kubernetes.io/hostname label, but this label *does*
-		respect --hostname-override, which we do not know if it is set or not. Oops.
-		This, for now, we are stuck doing multiple Get(), one for each hostname, or doing a List() of all nodes
+		The node's spec.providerID, set by the AWS cloud provider as aws:///<az>/<instance-id>, tells us
+		exactly which instance it is, regardless of what the node is called.
+		Clusters without the cloud provider may not set it, so then we fall back to the node's name, which
+		by default is the private DNS name. That breaks with --hostname-override or custom node names,
+		which is why it is only the fallback.
+		Neither can be used to filter a List(), so we list all of the nodes once, rather than Get() each.
 	*/
 	nodes, err := k.clientset.CoreV1().Nodes().List(v1.ListOptions{})
 	if err != nil {
-		return 0, fmt.Errorf("Unexpected error getting nodes for cluster: %v", err)
+		return nil, fmt.Errorf("Unexpected error getting nodes for cluster: %v", err)
 	}
-	unReadyCount := 0
-	for _, n := range nodes.Items {
-		// first make sure that this is one of the new nodes we care about
-		if _, ok := hostHash[n.ObjectMeta.Name]; !ok {
+	byInstance := map[string]*corev1.Node{}
+	byName := map[string]*corev1.Node{}
+	for i := range nodes.Items {
+		n := &nodes.Items[i]
+		if id := instanceIDFromProviderID(n.Spec.ProviderID); id != "" {
+			byInstance[id] = n
+		}
+		byName[n.Name] = n
+	}
+	ret := map[string]*corev1.Node{}
+	for i, id := range ids {
+		if n, ok := byInstance[id]; ok {
+			ret[id] = n
+			continue
+		}
+		if i >= len(hostnames) || hostnames[i] == "" {
 			continue
 		}
-		// next check its status
-		conditions := n.Status.Conditions
-		if conditions[len(conditions)-1].Type != corev1.NodeReady {
-			unReadyCount++
+		// a node with this name but the providerID of another instance is not ours
+		if n, ok := byName[hostnames[i]]; ok && instanceIDFromProviderID(n.Spec.ProviderID) == "" {
+			ret[id] = n
 		}
 	}
-	return unReadyCount, nil
+	return ret, nil
 }
-func (k *kubernetesReadiness) prepareTermination(hostnames []string, ids []string) error {
-	// get the node reference - first need the hostname
-	var (
-		node     *corev1.Node
-		hostname string
-		err      error
-	)
-	for _, h := range hostnames {
-		node, err = k.clientset.CoreV1().Nodes().Get(h, v1.GetOptions{})
-		if err != nil {
-			return fmt.Errorf("Unexpected error getting kubernetes node %s: %v", hostname, err)
+
+// instanceIDFromProviderID gets the EC2 instance ID from a node's providerID, e.g. i-0123456789abcdef0
+// from aws:///us-east-1a/i-0123456789abcdef0, or an empty string if it is not an AWS providerID
+func instanceIDFromProviderID(providerID string) string {
+	if !strings.HasPrefix(providerID, "aws://") {
+		return ""
+	}
+	id := providerID[strings.LastIndex(providerID, "/")+1:]
+	if !strings.HasPrefix(id, "i-") {
+		return ""
+	}
+	return id
+}
+
+// getPodCounts counts the pods that would be evicted from each node by a drain, i.e. ignoring
+// DaemonSet pods and pods that have already finished
+func (k *kubernetesReadiness) getPodCounts(hostnames []string, ids []string) (map[string]int, error) {
+	nodes, err := k.getNodes(hostnames, ids)
+	if err != nil {
+		return nil, err
+	}
+	counts := map[string]int{}
+	for _, id := range ids {
+		// an instance without a node has nothing running on it
+		node, ok := nodes[id]
+		if !ok {
+			counts[id] = 0
+			continue
 		}
-		// set options and drain nodes
-		err = drain.Drain(k.clientset, []*corev1.Node{node}, &drain.DrainOptions{
-			IgnoreDaemonsets:   k.ignoreDaemonSets,
-			GracePeriodSeconds: -1,
-			Force:              true,
+		pods, err := k.clientset.CoreV1().Pods(v1.NamespaceAll).List(v1.ListOptions{
+			FieldSelector: fields.OneTermEqualSelector("spec.nodeName", node.Name).String(),
 		})
 		if err != nil {
-			return fmt.Errorf("Unexpected error draining kubernetes node %s: %v", hostname, err)
+			return nil, fmt.Errorf("Unexpected error listing pods on kubernetes node %s: %v", node.Name, err)
+		}
+		count := 0
+		for _, p := range pods.Items {
+			if p.Spec.NodeName != node.Name {
+				continue
+			}
+			if p.Status.Phase == corev1.PodSucceeded || p.Status.Phase == corev1.PodFailed {
+				continue
+			}
+			if isDaemonSetPod(&p) {
+				continue
+			}
+			count++
 		}
+		counts[id] = count
 	}
-	return nil
+	return counts, nil
+}
+
+func isDaemonSetPod(pod *corev1.Pod) bool {
+	for _, o := range pod.OwnerReferences {
+		if o.Kind == "DaemonSet" {
+			return true
+		}
+	}
+	return false
 }
 
 func kubeGetClientset() (*kubernetes.Clientset, error) {
@@ -127,6 +516,20 @@ func homeDir() string {
 	return os.Getenv("USERPROFILE") // windows
 }
 
+// kubeGetNamespace returns the namespace the roller runs in, from ROLLER_NAMESPACE or the
+// service account when running as a pod, falling back to the default namespace
+func kubeGetNamespace() string {
+	if ns := os.Getenv("ROLLER_NAMESPACE"); ns != "" {
+		return ns
+	}
+	if data, err := ioutil.ReadFile(serviceAccountNamespaceFile); err == nil {
+		if ns := strings.TrimSpace(string(data)); ns != "" {
+			return ns
+		}
+	}
+	return v1.NamespaceDefault
+}
+
 func kubeGetReadinessHandler(ignoreDaemonSets bool) (readiness, error) {
 	clientset, err := kubeGetClientset()
 	if err != nil {
@@ -135,5 +538,10 @@ func kubeGetReadinessHandler(ignoreDaemonSets bool) (readiness, error) {
 	if clientset == nil {
 		return nil, nil
 	}
-	return &kubernetesReadiness{clientset: clientset, ignoreDaemonSets: ignoreDaemonSets}, nil
+	return &kubernetesReadiness{
+		clientset:        clientset,
+		ignoreDaemonSets: ignoreDaemonSets,
+		recorder:         kubeGetEventRecorder(clientset),
+		pod:              kubeGetRollerPod(clientset),
+	}, nil
 }
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"log"
+)
+
+const (
+	// annotationScaleDownDisabled stops cluster-autoscaler removing a node
+	annotationScaleDownDisabled = "cluster-autoscaler.kubernetes.io/scale-down-disabled"
+	// annotationProtected marks nodes that we protected from cluster-autoscaler, so that we only ever
+	// remove the protection from those
+	annotationProtected = "aws-asg-roller/scale-down-disabled"
+)
+
+// protector is implemented by readiness handlers that can stop an autoscaler removing instances
+type protector interface {
+	// protect stops the instances being scaled down
+	protect(hostnames []string, ids []string) error
+	// unprotect undoes protect, for those of the instances that it protected
+	unprotect(hostnames []string, ids []string) error
+}
+
+func (k *kubernetesReadiness) protect(hostnames []string, ids []string) error {
+	nodes, err := k.getNodes(hostnames, ids)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		node, ok := nodes[id]
+		// already protected, by us or by someone else
+		if !ok || node.Annotations[annotationScaleDownDisabled] != "" {
+			continue
+		}
+		updated := node.DeepCopy()
+		if updated.Annotations == nil {
+			updated.Annotations = map[string]string{}
+		}
+		updated.Annotations[annotationScaleDownDisabled] = "true"
+		updated.Annotations[annotationProtected] = "true"
+		if _, err := k.clientset.CoreV1().Nodes().Update(updated); err != nil {
+			return fmt.Errorf("Unexpected error protecting kubernetes node %s from scale down: %v", node.Name, err)
+		}
+		log.Printf("Disabled scale down of kubernetes node %s for new instance %s", node.Name, id)
+	}
+	return nil
+}
+
+func (k *kubernetesReadiness) unprotect(hostnames []string, ids []string) error {
+	nodes, err := k.getNodes(hostnames, ids)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		node, ok := nodes[id]
+		if !ok || node.Annotations[annotationProtected] == "" {
+			continue
+		}
+		updated := node.DeepCopy()
+		delete(updated.Annotations, annotationScaleDownDisabled)
+		delete(updated.Annotations, annotationProtected)
+		if _, err := k.clientset.CoreV1().Nodes().Update(updated); err != nil {
+			return fmt.Errorf("Unexpected error removing scale down protection from kubernetes node %s: %v", node.Name, err)
+		}
+		log.Printf("Enabled scale down of kubernetes node %s for instance %s", node.Name, id)
+	}
+	return nil
+}
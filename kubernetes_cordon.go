@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// annotationCordoned marks nodes that we cordoned, so that we only ever uncordon those,
+	// and can find them again after a restart
+	annotationCordoned = "aws-asg-roller/cordoned"
+	// taintOutdated is put on old nodes, if asked, so the scheduler avoids them even if they are uncordoned
+	taintOutdated = "aws-asg-roller/outdated"
+)
+
+// cordoner is implemented by readiness handlers that can stop new work being scheduled on instances
+type cordoner interface {
+	// cordon stops new work being scheduled on the instances, optionally adding a taint as well
+	cordon(hostnames []string, ids []string, taint bool) error
+	// uncordon undoes cordon, for those of the instances that it cordoned
+	uncordon(hostnames []string, ids []string) error
+}
+
+func (k *kubernetesReadiness) cordon(hostnames []string, ids []string, taint bool) error {
+	nodes, err := k.getNodes(hostnames, ids)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		node, ok := nodes[id]
+		// someone else cordoned it, so it is theirs to uncordon
+		if !ok || (node.Spec.Unschedulable && node.Annotations[annotationCordoned] == "") {
+			continue
+		}
+		updated := node.DeepCopy()
+		updated.Spec.Unschedulable = true
+		if updated.Annotations == nil {
+			updated.Annotations = map[string]string{}
+		}
+		updated.Annotations[annotationCordoned] = "true"
+		if taint && !hasTaint(updated, taintOutdated) {
+			updated.Spec.Taints = append(updated.Spec.Taints, corev1.Taint{Key: taintOutdated, Effect: corev1.TaintEffectPreferNoSchedule})
+		}
+		if _, err := k.clientset.CoreV1().Nodes().Update(updated); err != nil {
+			return fmt.Errorf("Unexpected error cordoning kubernetes node %s: %v", node.Name, err)
+		}
+		log.Printf("Cordoned kubernetes node %s for outdated instance %s", node.Name, id)
+		k.nodeEvent(node, eventNormal, reasonCordoned, "Cordoned node of outdated instance for the rollout of its ASG")
+	}
+	return nil
+}
+
+func (k *kubernetesReadiness) uncordon(hostnames []string, ids []string) error {
+	nodes, err := k.getNodes(hostnames, ids)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		node, ok := nodes[id]
+		if !ok || node.Annotations[annotationCordoned] == "" {
+			continue
+		}
+		updated := node.DeepCopy()
+		updated.Spec.Unschedulable = false
+		delete(updated.Annotations, annotationCordoned)
+		taints := make([]corev1.Taint, 0, len(updated.Spec.Taints))
+		for _, t := range updated.Spec.Taints {
+			if t.Key != taintOutdated {
+				taints = append(taints, t)
+			}
+		}
+		updated.Spec.Taints = taints
+		if _, err := k.clientset.CoreV1().Nodes().Update(updated); err != nil {
+			return fmt.Errorf("Unexpected error uncordoning kubernetes node %s: %v", node.Name, err)
+		}
+		log.Printf("Uncordoned kubernetes node %s for instance %s", node.Name, id)
+	}
+	return nil
+}
+
+func hasTaint(node *corev1.Node, key string) bool {
+	for _, t := range node.Spec.Taints {
+		if t.Key == key {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+
+	corev1 "k8s.io/api/core/v1"
+	policy "k8s.io/api/policy/v1beta1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	typedpolicyv1beta1 "k8s.io/client-go/kubernetes/typed/policy/v1beta1"
+)
+
+// drainClientset is the clientset the drain library works with. The library cannot be cancelled, so once ctx is
+// done, every request it makes for pods and evictions fails instead, which stops it evicting more pods or waiting
+// for those it has evicted.
+type drainClientset struct {
+	kubernetes.Interface
+	ctx context.Context
+}
+
+func (d *drainClientset) CoreV1() typedcorev1.CoreV1Interface {
+	return &drainCoreV1{CoreV1Interface: d.Interface.CoreV1(), ctx: d.ctx}
+}
+
+func (d *drainClientset) PolicyV1beta1() typedpolicyv1beta1.PolicyV1beta1Interface {
+	return &drainPolicyV1beta1{PolicyV1beta1Interface: d.Interface.PolicyV1beta1(), ctx: d.ctx}
+}
+
+type drainCoreV1 struct {
+	typedcorev1.CoreV1Interface
+	ctx context.Context
+}
+
+func (d *drainCoreV1) Pods(namespace string) typedcorev1.PodInterface {
+	return &drainPods{PodInterface: d.CoreV1Interface.Pods(namespace), ctx: d.ctx}
+}
+
+type drainPods struct {
+	typedcorev1.PodInterface
+	ctx context.Context
+}
+
+func (d *drainPods) Get(name string, options v1.GetOptions) (*corev1.Pod, error) {
+	if err := d.ctx.Err(); err != nil {
+		return nil, err
+	}
+	return d.PodInterface.Get(name, options)
+}
+
+func (d *drainPods) List(opts v1.ListOptions) (*corev1.PodList, error) {
+	if err := d.ctx.Err(); err != nil {
+		return nil, err
+	}
+	return d.PodInterface.List(opts)
+}
+
+func (d *drainPods) Delete(name string, options *v1.DeleteOptions) error {
+	if err := d.ctx.Err(); err != nil {
+		return err
+	}
+	return d.PodInterface.Delete(name, options)
+}
+
+type drainPolicyV1beta1 struct {
+	typedpolicyv1beta1.PolicyV1beta1Interface
+	ctx context.Context
+}
+
+func (d *drainPolicyV1beta1) Evictions(namespace string) typedpolicyv1beta1.EvictionInterface {
+	return &drainEvictions{EvictionInterface: d.PolicyV1beta1Interface.Evictions(namespace), ctx: d.ctx}
+}
+
+type drainEvictions struct {
+	typedpolicyv1beta1.EvictionInterface
+	ctx context.Context
+}
+
+func (d *drainEvictions) Evict(eviction *policy.Eviction) error {
+	if err := d.ctx.Err(); err != nil {
+		return err
+	}
+	return d.EvictionInterface.Evict(eviction)
+}
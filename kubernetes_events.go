@@ -0,0 +1,90 @@
+package main
+
+import (
+	"log"
+	"os"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+const (
+	eventComponent = "aws-asg-roller"
+
+	eventNormal  = corev1.EventTypeNormal
+	eventWarning = corev1.EventTypeWarning
+
+	reasonRolloutStarted  = "RolloutStarted"
+	reasonRolloutComplete = "RolloutComplete"
+	reasonCordoned        = "Cordoned"
+	reasonDrainStarted    = "DrainStarted"
+	reasonDrained         = "Drained"
+	reasonDrainFailed     = "DrainFailed"
+	reasonTerminating     = "Terminating"
+)
+
+// eventer is implemented by readiness handlers that can tell people watching the cluster what the roller is doing
+type eventer interface {
+	// rolloutEvent records something that happened to the rollout of an ASG as a whole
+	rolloutEvent(asg string, eventType, reason, message string)
+	// instanceEvent records something that happened to a single instance
+	instanceEvent(hostname string, id string, eventType, reason, message string)
+}
+
+func (k *kubernetesReadiness) rolloutEvent(asg string, eventType, reason, message string) {
+	// outside of the cluster, there is no pod to record it on
+	if k.recorder == nil || k.pod == nil {
+		return
+	}
+	k.recorder.Event(k.pod, eventType, reason, message)
+}
+
+func (k *kubernetesReadiness) instanceEvent(hostname string, id string, eventType, reason, message string) {
+	if k.recorder == nil {
+		return
+	}
+	nodes, err := k.getNodes([]string{hostname}, []string{id})
+	if err != nil {
+		log.Printf("Unable to find kubernetes node for instance %s to record event: %v", id, err)
+		return
+	}
+	if node, ok := nodes[id]; ok {
+		k.nodeEvent(node, eventType, reason, message)
+	}
+}
+
+func (k *kubernetesReadiness) nodeEvent(node *corev1.Node, eventType, reason, message string) {
+	if k.recorder == nil {
+		return
+	}
+	// the kubelet uses the node name as the UID of node events, which is where kubectl describe looks for them
+	ref := &corev1.ObjectReference{Kind: "Node", Name: node.Name, UID: types.UID(node.Name)}
+	k.recorder.Event(ref, eventType, reason, message)
+}
+
+// kubeGetEventRecorder returns a recorder that sends events to the cluster
+func kubeGetEventRecorder(clientset kubernetes.Interface) record.EventRecorder {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: clientset.CoreV1().Events(v1.NamespaceAll)})
+	return broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: eventComponent})
+}
+
+// kubeGetRollerPod finds the pod the roller is running in, which has the same name as our hostname,
+// or returns nil if we are not running in the cluster
+func kubeGetRollerPod(clientset kubernetes.Interface) *corev1.ObjectReference {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil
+	}
+	pod, err := clientset.CoreV1().Pods(kubeGetNamespace()).Get(hostname, v1.GetOptions{})
+	if err != nil {
+		log.Printf("Not recording rollout events, unable to find the roller pod %s: %v", hostname, err)
+		return nil
+	}
+	return &corev1.ObjectReference{Kind: "Pod", Namespace: pod.Namespace, Name: pod.Name, UID: pod.UID}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+// testEvents drains the events recorded so far
+func testEvents(recorder *record.FakeRecorder) []string {
+	events := make([]string, 0)
+	for {
+		select {
+		case e := <-recorder.Events:
+			events = append(events, e)
+		default:
+			return events
+		}
+	}
+}
+
+func TestNodeEvents(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		testNode("ours", "aws:///us-east-1a/i-1", corev1.ConditionTrue),
+		testNode("other", "aws:///us-east-1a/i-2", corev1.ConditionTrue),
+		testOwnedPod("orphan", "other", "", "", true),
+	)
+	recorder := record.NewFakeRecorder(10)
+	k := &kubernetesReadiness{clientset: clientset, ignoreDaemonSets: true, recorder: recorder}
+
+	if err := k.cordon([]string{""}, []string{"i-1"}, false); err != nil {
+		t.Fatalf("unexpected error cordoning: %v", err)
+	}
+	// without force, the pod without a controller fails the drain
+	if err := k.prepareTermination(context.Background(), testInstances([]string{"i-2"}), drainSettings{gracePeriod: -1}); err == nil {
+		t.Fatalf("expected error draining")
+	}
+	if err := k.prepareTermination(context.Background(), testInstances([]string{"i-1"}), drainSettings{gracePeriod: -1, force: true}); err != nil {
+		t.Fatalf("unexpected error draining: %v", err)
+	}
+	k.instanceEvent("", "i-1", eventNormal, reasonTerminating, "Terminating")
+	// no node, no event
+	k.instanceEvent("", "i-9", eventNormal, reasonTerminating, "Terminating")
+
+	expected := []string{
+		"Normal Cordoned",
+		"Normal DrainStarted",
+		"Warning DrainFailed",
+		"Normal DrainStarted",
+		"Normal Drained",
+		"Normal Terminating",
+	}
+	events := testEvents(recorder)
+	if len(events) != len(expected) {
+		t.Fatalf("mismatched events, actual %v", events)
+	}
+	for i, e := range expected {
+		if len(events[i]) < len(e) || events[i][:len(e)] != e {
+			t.Errorf("%d: mismatched event, actual %s expected %s", i, events[i], e)
+		}
+	}
+}
+
+func TestRolloutEvents(t *testing.T) {
+	recorder := record.NewFakeRecorder(10)
+	// not running in a pod
+	k := &kubernetesReadiness{clientset: fake.NewSimpleClientset(), recorder: recorder}
+	k.rolloutEvent("myasg", eventNormal, reasonRolloutStarted, "Started")
+	if events := testEvents(recorder); len(events) != 0 {
+		t.Errorf("expected no events without a pod, actual %v", events)
+	}
+	k.pod = &corev1.ObjectReference{Kind: "Pod", Namespace: v1.NamespaceDefault, Name: "roller"}
+	k.rolloutEvent("myasg", eventNormal, reasonRolloutStarted, "Started")
+	if events := testEvents(recorder); !testStringEq(events, []string{"Normal RolloutStarted Started"}) {
+		t.Errorf("mismatched events, actual %v", events)
+	}
+}
@@ -0,0 +1,472 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	ktesting "k8s.io/client-go/testing"
+)
+
+func testNode(name, providerID string, ready corev1.ConditionStatus) *corev1.Node {
+	return &corev1.Node{
+		ObjectMeta: v1.ObjectMeta{Name: name},
+		Spec:       corev1.NodeSpec{ProviderID: providerID},
+		Status: corev1.NodeStatus{
+			Conditions: []corev1.NodeCondition{
+				{Type: corev1.NodeReady, Status: ready},
+			},
+		},
+	}
+}
+
+func TestInstanceIDFromProviderID(t *testing.T) {
+	tests := []struct {
+		providerID string
+		id         string
+	}{
+		{"aws:///us-east-1a/i-0123456789abcdef0", "i-0123456789abcdef0"},
+		{"aws://us-east-1a/i-0123456789abcdef0", "i-0123456789abcdef0"},
+		{"aws:///us-east-1a/", ""},
+		{"gce://project/us-central1-a/instance", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if id := instanceIDFromProviderID(tt.providerID); id != tt.id {
+			t.Errorf("%s: mismatched ID, actual %s expected %s", tt.providerID, id, tt.id)
+		}
+	}
+}
+
+func TestGetNodes(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		// named after something else entirely, e.g. with --hostname-override
+		testNode("custom-name", "aws:///us-east-1a/i-1", corev1.ConditionTrue),
+		// named by its DNS name, without a providerID
+		testNode("ip-10-0-0-2.ec2.internal", "", corev1.ConditionTrue),
+		// named by the DNS name of i-3, but really another instance that reused the name
+		testNode("ip-10-0-0-3.ec2.internal", "aws:///us-east-1b/i-99", corev1.ConditionTrue),
+	)
+	k := &kubernetesReadiness{clientset: clientset}
+	hostnames := []string{"ip-10-0-0-1.ec2.internal", "ip-10-0-0-2.ec2.internal", "ip-10-0-0-3.ec2.internal", "ip-10-0-0-4.ec2.internal"}
+	ids := []string{"i-1", "i-2", "i-3", "i-4"}
+	nodes, err := k.getNodes(hostnames, ids)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := map[string]string{
+		"i-1": "custom-name",
+		"i-2": "ip-10-0-0-2.ec2.internal",
+	}
+	if len(nodes) != len(expected) {
+		t.Errorf("mismatched nodes, actual %v expected %v", nodes, expected)
+	}
+	for id, name := range expected {
+		if nodes[id] == nil || nodes[id].Name != name {
+			t.Errorf("%s: mismatched node, actual %v expected %s", id, nodes[id], name)
+		}
+	}
+}
+
+func TestPrepareTerminationByProviderID(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		testNode("custom-name", "aws:///us-east-1a/i-1", corev1.ConditionTrue),
+		testNode("ip-10-0-0-1.ec2.internal", "aws:///us-east-1a/i-2", corev1.ConditionTrue),
+	)
+	k := &kubernetesReadiness{clientset: clientset, ignoreDaemonSets: true}
+	if err := k.prepareTermination(context.Background(), testInstances([]string{"i-1", "i-9"}, "ip-10-0-0-1.ec2.internal", "ip-10-0-0-9.ec2.internal"), drainSettings{gracePeriod: -1, force: true}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	nodes, _ := clientset.CoreV1().Nodes().List(v1.ListOptions{})
+	cordoned := make([]string, 0)
+	for _, n := range nodes.Items {
+		if n.Spec.Unschedulable {
+			cordoned = append(cordoned, n.Name)
+		}
+	}
+	sort.Strings(cordoned)
+	if !testStringEq(cordoned, []string{"custom-name"}) {
+		t.Errorf("expected only the node for i-1 to be drained, actual %v", cordoned)
+	}
+}
+
+func TestGetReadiness(t *testing.T) {
+	withConditions := func(name string, conditions ...corev1.NodeCondition) *corev1.Node {
+		n := testNode(name, "aws:///us-east-1a/"+name, corev1.ConditionTrue)
+		n.Status.Conditions = conditions
+		return n
+	}
+	ready := corev1.NodeCondition{Type: corev1.NodeReady, Status: corev1.ConditionTrue}
+	notReady := corev1.NodeCondition{Type: corev1.NodeReady, Status: corev1.ConditionFalse}
+	unknown := corev1.NodeCondition{Type: corev1.NodeReady, Status: corev1.ConditionUnknown}
+	diskPressure := corev1.NodeCondition{Type: corev1.NodeDiskPressure, Status: corev1.ConditionTrue}
+	noDiskPressure := corev1.NodeCondition{Type: corev1.NodeDiskPressure, Status: corev1.ConditionFalse}
+	tainted := testNode("i-tainted", "aws:///us-east-1a/i-tainted", corev1.ConditionTrue)
+	tainted.Spec.Taints = []corev1.Taint{{Key: "node.cloudprovider.kubernetes.io/uninitialized", Value: "true", Effect: corev1.TaintEffectNoSchedule}}
+
+	clientset := fake.NewSimpleClientset(
+		withConditions("i-ready", ready),
+		withConditions("i-readyfirst", ready, noDiskPressure),
+		withConditions("i-readylast", noDiskPressure, ready),
+		withConditions("i-notready", notReady),
+		withConditions("i-notreadylast", noDiskPressure, notReady),
+		withConditions("i-unknown", unknown),
+		withConditions("i-noconditions"),
+		withConditions("i-diskpressure", ready, diskPressure),
+		tainted,
+	)
+	tests := []struct {
+		desc       string
+		ids        []string
+		conditions string
+		taints     string
+		unready    []string
+	}{
+		{"ready regardless of position", []string{"i-ready", "i-readyfirst", "i-readylast"}, "", "", []string{}},
+		{"not ready when last", []string{"i-notreadylast"}, "", "", []string{"i-notreadylast=kubernetes node i-notreadylast: Ready is False"}},
+		{"not ready or unknown", []string{"i-ready", "i-notready", "i-unknown"}, "", "", []string{"i-notready=kubernetes node i-notready: Ready is False", "i-unknown=kubernetes node i-unknown: Ready is Unknown"}},
+		{"no conditions", []string{"i-noconditions"}, "", "", []string{"i-noconditions=kubernetes node i-noconditions: no Ready condition"}},
+		{"not registered", []string{"i-ready", "i-missing"}, "", "", []string{"i-missing=has not joined the kubernetes cluster yet"}},
+		{"extra conditions ignored by default", []string{"i-diskpressure"}, "", "", []string{}},
+		{"extra conditions", []string{"i-diskpressure", "i-readyfirst"}, "NetworkUnavailable,DiskPressure", "", []string{"i-diskpressure=kubernetes node i-diskpressure: DiskPressure is True"}},
+		{"taints ignored by default", []string{"i-tainted"}, "", "", []string{}},
+		{"blocking taint", []string{"i-tainted", "i-ready"}, "", "node.cloudprovider.kubernetes.io/uninitialized", []string{"i-tainted=kubernetes node i-tainted: has taint node.cloudprovider.kubernetes.io/uninitialized:NoSchedule"}},
+		{"blocking taint with effect", []string{"i-tainted"}, "", "node.cloudprovider.kubernetes.io/uninitialized:NoSchedule", []string{"i-tainted=kubernetes node i-tainted: has taint node.cloudprovider.kubernetes.io/uninitialized:NoSchedule"}},
+		{"blocking taint with other effect", []string{"i-tainted"}, "", "node.cloudprovider.kubernetes.io/uninitialized:NoExecute", []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			taints, err := parseTaintMatchers(tt.taints)
+			if err != nil {
+				t.Fatalf("invalid taints: %v", err)
+			}
+			k := &kubernetesReadiness{clientset: clientset}
+			opts := readinessSettings{unhealthyConditions: parseConditionTypes(tt.conditions), blockingTaints: taints}
+			// none of the nodes are named after their DNS names
+			results, err := k.getReadiness(context.Background(), testInstances(tt.ids), opts)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(results) != len(tt.ids) {
+				t.Fatalf("expected a result for each of %v, actual %v", tt.ids, results)
+			}
+			unready := make([]string, 0)
+			for i, r := range results {
+				if r.id != tt.ids[i] {
+					t.Errorf("mismatched result order, actual %s expected %s", r.id, tt.ids[i])
+				}
+				if !r.ready {
+					unready = append(unready, fmt.Sprintf("%s=%s", r.id, r.reason))
+				}
+			}
+			if !testStringEq(unready, tt.unready) {
+				t.Errorf("mismatched unready instances, actual %v expected %v", unready, tt.unready)
+			}
+		})
+	}
+}
+
+func TestParseTaintMatchers(t *testing.T) {
+	tests := []struct {
+		input       string
+		count       int
+		shouldError bool
+	}{
+		{"", 0, false},
+		{"a, b:NoSchedule ,c:NoExecute", 3, false},
+		{"a:Sometimes", 0, true},
+		{":NoSchedule", 0, true},
+	}
+	for i, tt := range tests {
+		matchers, err := parseTaintMatchers(tt.input)
+		switch {
+		case err != nil && !tt.shouldError:
+			t.Errorf("%d: unexpected error: %v", i, err)
+		case err == nil && tt.shouldError:
+			t.Errorf("%d: expected error", i)
+		case err == nil && len(matchers) != tt.count:
+			t.Errorf("%d: mismatched count, actual %v expected %d", i, matchers, tt.count)
+		}
+	}
+}
+
+func TestParseSkipPods(t *testing.T) {
+	tests := []struct {
+		skip        string
+		drained     []map[string]string
+		skipped     []map[string]string
+		shouldError bool
+	}{
+		{"", []map[string]string{nil, {"app": "web"}}, nil, false},
+		{"app=critical", []map[string]string{nil, {"app": "web"}}, []map[string]string{{"app": "critical"}}, false},
+		{"app=critical,skip-drain", []map[string]string{{"app": "web"}}, []map[string]string{{"app": "critical"}, {"app": "web", "skip-drain": "yes"}}, false},
+		{"tier in (db,cache)", []map[string]string{nil, {"tier": "web"}}, []map[string]string{{"tier": "db"}, {"tier": "cache"}}, false},
+		{"tier notin (web)", []map[string]string{{"tier": "web"}}, []map[string]string{nil, {"tier": "db"}}, false},
+		{"!drainable", []map[string]string{{"drainable": "true"}}, []map[string]string{nil}, false},
+		{"replicas>1", nil, nil, true},
+		{"app in (", nil, nil, true},
+	}
+	for _, tt := range tests {
+		selector, err := parseSkipPods(tt.skip)
+		switch {
+		case err != nil && !tt.shouldError:
+			t.Errorf("%s: unexpected error: %v", tt.skip, err)
+			continue
+		case err == nil && tt.shouldError:
+			t.Errorf("%s: expected error", tt.skip)
+			continue
+		case err != nil:
+			continue
+		}
+		for _, l := range tt.drained {
+			if selector != nil && !selector.Matches(labels.Set(l)) {
+				t.Errorf("%s: expected pod with labels %v to be drained", tt.skip, l)
+			}
+		}
+		for _, l := range tt.skipped {
+			if selector == nil || selector.Matches(labels.Set(l)) {
+				t.Errorf("%s: expected pod with labels %v to be skipped", tt.skip, l)
+			}
+		}
+	}
+}
+
+func TestDrainNodeTimeout(t *testing.T) {
+	tests := []struct {
+		policy  string
+		force   bool
+		skip    bool
+		err     string
+		deletes int
+	}{
+		{drainTimeoutRetry, true, false, "did not complete", 1},
+		{drainTimeoutSkip, true, true, "", 1},
+		{drainTimeoutForce, true, false, "", 2},
+		// not forced, an unmanaged pod fails the drain at once, whatever the policy
+		{drainTimeoutForce, false, false, "Unexpected error draining", 0},
+	}
+	for _, tt := range tests {
+		orphan := testOwnedPod("orphan", "old", "", "", true)
+		orphan.Labels = map[string]string{"app": "orphan"}
+		clientset := fake.NewSimpleClientset(
+			&corev1.Node{ObjectMeta: v1.ObjectMeta{Name: "old"}},
+			testOwnedPod("web-1", "old", "ReplicaSet", "web", true),
+			orphan,
+		)
+		// pods never go away, like a drain held up by a PodDisruptionBudget
+		var (
+			mu      sync.Mutex
+			deletes int
+		)
+		clientset.PrependReactor("delete", "pods", func(action ktesting.Action) (bool, runtime.Object, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			if action.(ktesting.DeleteAction).GetName() == "web-1" {
+				deletes++
+			}
+			return true, nil, nil
+		})
+		k := &kubernetesReadiness{clientset: clientset, ignoreDaemonSets: true}
+		err := k.drainNode(context.Background(), &corev1.Node{ObjectMeta: v1.ObjectMeta{Name: "old"}}, drainSettings{
+			timeout:       time.Second,
+			timeoutPolicy: tt.policy,
+			gracePeriod:   -1,
+			force:         tt.force,
+		})
+		_, skipped := err.(*skipTerminationError)
+		mu.Lock()
+		switch {
+		case skipped != tt.skip:
+			t.Errorf("%s: mismatched skip, actual %v expected %v", tt.policy, skipped, tt.skip)
+		case !tt.skip && tt.err == "" && err != nil:
+			t.Errorf("%s: unexpected error: %v", tt.policy, err)
+		case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+			t.Errorf("%s: mismatched error, actual %v expected %s", tt.policy, err, tt.err)
+		case deletes != tt.deletes:
+			t.Errorf("%s: mismatched deletes of web-1, actual %d expected %d", tt.policy, deletes, tt.deletes)
+		}
+		mu.Unlock()
+		// a skipped node is left schedulable, as it was before
+		node, _ := clientset.CoreV1().Nodes().Get("old", v1.GetOptions{})
+		if node.Spec.Unschedulable == tt.skip {
+			t.Errorf("%s: mismatched unschedulable, actual %v expected %v", tt.policy, node.Spec.Unschedulable, !tt.skip)
+		}
+	}
+}
+
+func TestDrainNodeCancelled(t *testing.T) {
+	tests := []struct {
+		desc          string
+		unschedulable bool
+	}{
+		{"schedulable", false},
+		{"already cordoned", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			node := &corev1.Node{ObjectMeta: v1.ObjectMeta{Name: "old"}, Spec: corev1.NodeSpec{Unschedulable: tt.unschedulable}}
+			clientset := fake.NewSimpleClientset(node, testOwnedPod("web-1", "old", "ReplicaSet", "web", true))
+			// pods never go away, so the drain waits until we stop it
+			clientset.PrependReactor("delete", "pods", func(action ktesting.Action) (bool, runtime.Object, error) {
+				return true, nil, nil
+			})
+			k := &kubernetesReadiness{clientset: clientset, ignoreDaemonSets: true}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go func() {
+				// only stop once the drain has cordoned the node
+				for {
+					n, _ := clientset.CoreV1().Nodes().Get("old", v1.GetOptions{})
+					if n.Spec.Unschedulable {
+						cancel()
+						return
+					}
+					time.Sleep(10 * time.Millisecond)
+				}
+			}()
+			err := k.drainNode(ctx, node, drainSettings{timeout: 5 * time.Second, timeoutPolicy: drainTimeoutRetry, gracePeriod: -1})
+			if err == nil || !strings.Contains(err.Error(), "Stopped draining") {
+				t.Errorf("mismatched error, actual %v", err)
+			}
+			// the drain has stopped, so it no longer polls for the pod it evicted
+			actions := len(clientset.Actions())
+			time.Sleep(1500 * time.Millisecond)
+			if after := clientset.Actions(); len(after) != actions {
+				t.Errorf("expected no more requests once stopped, actual %v", after[actions:])
+			}
+			got, _ := clientset.CoreV1().Nodes().Get("old", v1.GetOptions{})
+			if got.Spec.Unschedulable != tt.unschedulable {
+				t.Errorf("mismatched unschedulable after stopping, actual %v expected %v", got.Spec.Unschedulable, tt.unschedulable)
+			}
+		})
+	}
+
+	// once cancelled, no more nodes are drained
+	clientset := fake.NewSimpleClientset(testNode("old", "aws:///us-east-1a/i-1", corev1.ConditionTrue))
+	k := &kubernetesReadiness{clientset: clientset, ignoreDaemonSets: true}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := k.prepareTermination(ctx, testInstances([]string{"i-1"}), drainSettings{gracePeriod: -1}); err != context.Canceled {
+		t.Errorf("mismatched error, actual %v expected %v", err, context.Canceled)
+	}
+	if got, _ := clientset.CoreV1().Nodes().Get("old", v1.GetOptions{}); got.Spec.Unschedulable {
+		t.Errorf("expected node not to be drained")
+	}
+}
+
+func TestRollbackTermination(t *testing.T) {
+	theirs := testNode("theirs", "aws:///us-east-1a/i-2", corev1.ConditionTrue)
+	theirs.Spec.Unschedulable = true
+	clientset := fake.NewSimpleClientset(
+		testNode("ours", "aws:///us-east-1a/i-1", corev1.ConditionTrue),
+		theirs,
+	)
+	k := &kubernetesReadiness{clientset: clientset, ignoreDaemonSets: true}
+	instances := testInstances([]string{"i-1", "i-2"})
+	if err := k.prepareTermination(context.Background(), instances, drainSettings{gracePeriod: -1, force: true}); err != nil {
+		t.Fatalf("unexpected error draining: %v", err)
+	}
+	if err := k.rollbackTermination(context.Background(), instances); err != nil {
+		t.Fatalf("unexpected error rolling back: %v", err)
+	}
+	if ours, _ := clientset.CoreV1().Nodes().Get("ours", v1.GetOptions{}); ours.Spec.Unschedulable {
+		t.Errorf("expected drained node to be uncordoned")
+	}
+	if got, _ := clientset.CoreV1().Nodes().Get("theirs", v1.GetOptions{}); !got.Spec.Unschedulable {
+		t.Errorf("expected node that was already cordoned to stay cordoned")
+	}
+
+	// only the nodes drained by the latest call are remembered, so a terminated node's name can be reused
+	if err := k.prepareTermination(context.Background(), instances[:1], drainSettings{gracePeriod: -1, force: true}); err != nil {
+		t.Fatalf("unexpected error draining: %v", err)
+	}
+	if err := k.prepareTermination(context.Background(), instances[1:], drainSettings{gracePeriod: -1, force: true}); err != nil {
+		t.Fatalf("unexpected error draining: %v", err)
+	}
+	if len(k.cordonedByDrain) != 0 {
+		t.Errorf("expected no nodes to be remembered after draining one that was already cordoned, actual %v", k.cordonedByDrain)
+	}
+	if err := k.rollbackTermination(context.Background(), instances[:1]); err != nil {
+		t.Fatalf("unexpected error rolling back: %v", err)
+	}
+	if ours, _ := clientset.CoreV1().Nodes().Get("ours", v1.GetOptions{}); !ours.Spec.Unschedulable {
+		t.Errorf("expected node drained by an earlier call to stay cordoned")
+	}
+}
+
+func TestCordon(t *testing.T) {
+	theirs := testNode("theirs", "aws:///us-east-1a/i-2", corev1.ConditionTrue)
+	theirs.Spec.Unschedulable = true
+	clientset := fake.NewSimpleClientset(
+		testNode("ours", "aws:///us-east-1a/i-1", corev1.ConditionTrue),
+		theirs,
+	)
+	k := &kubernetesReadiness{clientset: clientset}
+	ids := []string{"i-1", "i-2", "i-9"}
+	if err := k.cordon([]string{"", "", ""}, ids, true); err != nil {
+		t.Fatalf("unexpected error cordoning: %v", err)
+	}
+	ours, _ := clientset.CoreV1().Nodes().Get("ours", v1.GetOptions{})
+	if !ours.Spec.Unschedulable || ours.Annotations[annotationCordoned] == "" || !hasTaint(ours, taintOutdated) {
+		t.Errorf("expected node to be cordoned, annotated and tainted, actual %+v", ours)
+	}
+	got, _ := clientset.CoreV1().Nodes().Get("theirs", v1.GetOptions{})
+	if got.Annotations[annotationCordoned] != "" || hasTaint(got, taintOutdated) {
+		t.Errorf("expected node cordoned by someone else to be left alone, actual %+v", got)
+	}
+
+	if err := k.uncordon([]string{"", "", ""}, ids); err != nil {
+		t.Fatalf("unexpected error uncordoning: %v", err)
+	}
+	ours, _ = clientset.CoreV1().Nodes().Get("ours", v1.GetOptions{})
+	if ours.Spec.Unschedulable || ours.Annotations[annotationCordoned] != "" || hasTaint(ours, taintOutdated) {
+		t.Errorf("expected node to be uncordoned, actual %+v", ours)
+	}
+	got, _ = clientset.CoreV1().Nodes().Get("theirs", v1.GetOptions{})
+	if !got.Spec.Unschedulable {
+		t.Errorf("expected node cordoned by someone else to stay cordoned")
+	}
+}
+
+func TestProtect(t *testing.T) {
+	theirs := testNode("theirs", "aws:///us-east-1a/i-2", corev1.ConditionTrue)
+	theirs.Annotations = map[string]string{annotationScaleDownDisabled: "true"}
+	clientset := fake.NewSimpleClientset(
+		testNode("ours", "aws:///us-east-1a/i-1", corev1.ConditionTrue),
+		theirs,
+	)
+	k := &kubernetesReadiness{clientset: clientset}
+	ids := []string{"i-1", "i-2", "i-9"}
+	if err := k.protect([]string{"", "", ""}, ids); err != nil {
+		t.Fatalf("unexpected error protecting: %v", err)
+	}
+	ours, _ := clientset.CoreV1().Nodes().Get("ours", v1.GetOptions{})
+	if ours.Annotations[annotationScaleDownDisabled] != "true" || ours.Annotations[annotationProtected] == "" {
+		t.Errorf("expected node to be protected, actual %v", ours.Annotations)
+	}
+	got, _ := clientset.CoreV1().Nodes().Get("theirs", v1.GetOptions{})
+	if got.Annotations[annotationProtected] != "" {
+		t.Errorf("expected node protected by someone else to be left alone, actual %v", got.Annotations)
+	}
+
+	if err := k.unprotect([]string{"", "", ""}, ids); err != nil {
+		t.Fatalf("unexpected error unprotecting: %v", err)
+	}
+	ours, _ = clientset.CoreV1().Nodes().Get("ours", v1.GetOptions{})
+	if ours.Annotations[annotationScaleDownDisabled] != "" || ours.Annotations[annotationProtected] != "" {
+		t.Errorf("expected node protection to be removed, actual %v", ours.Annotations)
+	}
+	got, _ = clientset.CoreV1().Nodes().Get("theirs", v1.GetOptions{})
+	if got.Annotations[annotationScaleDownDisabled] != "true" {
+		t.Errorf("expected node protected by someone else to stay protected, actual %v", got.Annotations)
+	}
+}
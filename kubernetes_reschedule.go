@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	defaultRescheduleTimeout = 300 // Default time to wait for pods to be rescheduled after a drain, in seconds
+	reschedulePollInterval   = 5 * time.Second
+)
+
+// workload is the controller of some pods on a node we are draining, e.g. a ReplicaSet or StatefulSet,
+// whose pods we wait to be running elsewhere before terminating the node
+type workload struct {
+	namespace string
+	kind      string
+	name      string
+	uid       types.UID
+	// ready is how many of its pods were ready before the drain, on any node
+	ready int
+}
+
+func (w *workload) String() string {
+	return fmt.Sprintf("%s %s/%s", w.kind, w.namespace, w.name)
+}
+
+// getWorkloads finds the controllers of the pods that draining the node will evict, i.e. those
+// matching podSelector if it is not nil, and how many of their pods are ready right now
+func (k *kubernetesReadiness) getWorkloads(node *corev1.Node, podSelector labels.Selector) (map[types.UID]*workload, error) {
+	pods, err := k.clientset.CoreV1().Pods(v1.NamespaceAll).List(v1.ListOptions{
+		FieldSelector: fields.OneTermEqualSelector("spec.nodeName", node.Name).String(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Unexpected error listing pods on kubernetes node %s: %v", node.Name, err)
+	}
+	workloads := map[types.UID]*workload{}
+	for i := range pods.Items {
+		p := &pods.Items[i]
+		if p.Spec.NodeName != node.Name || p.Status.Phase == corev1.PodSucceeded || p.Status.Phase == corev1.PodFailed || isDaemonSetPod(p) {
+			continue
+		}
+		// pods we leave on the node are not coming back either
+		if podSelector != nil && !podSelector.Matches(labels.Set(p.Labels)) {
+			continue
+		}
+		// pods without a controller are not coming back
+		owner := v1.GetControllerOf(p)
+		if owner == nil {
+			continue
+		}
+		workloads[owner.UID] = &workload{namespace: p.Namespace, kind: owner.Kind, name: owner.Name, uid: owner.UID}
+	}
+	for _, w := range workloads {
+		if w.ready, err = k.countReadyPods(w, ""); err != nil {
+			return nil, err
+		}
+	}
+	return workloads, nil
+}
+
+// countReadyPods counts the ready pods of a workload, other than those on excludeNode or being deleted
+func (k *kubernetesReadiness) countReadyPods(w *workload, excludeNode string) (int, error) {
+	pods, err := k.clientset.CoreV1().Pods(w.namespace).List(v1.ListOptions{})
+	if err != nil {
+		return 0, fmt.Errorf("Unexpected error listing pods in namespace %s: %v", w.namespace, err)
+	}
+	ready := 0
+	for i := range pods.Items {
+		p := &pods.Items[i]
+		owner := v1.GetControllerOf(p)
+		if owner == nil || owner.UID != w.uid {
+			continue
+		}
+		if p.DeletionTimestamp != nil || (excludeNode != "" && p.Spec.NodeName == excludeNode) {
+			continue
+		}
+		if isPodReady(p) {
+			ready++
+		}
+	}
+	return ready, nil
+}
+
+// waitForReschedule waits until every workload has at least as many ready pods as it did before
+// the node was drained, not counting any left on the node, or until the timeout or ctx is cancelled
+func (k *kubernetesReadiness) waitForReschedule(ctx context.Context, node *corev1.Node, workloads map[types.UID]*workload, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	poll := k.reschedulePoll
+	if poll == 0 {
+		poll = reschedulePollInterval
+	}
+	pending := make([]*workload, 0, len(workloads))
+	for _, w := range workloads {
+		pending = append(pending, w)
+	}
+	for {
+		waiting := make([]*workload, 0)
+		for _, w := range pending {
+			ready, err := k.countReadyPods(w, node.Name)
+			if err != nil {
+				return err
+			}
+			if ready < w.ready {
+				waiting = append(waiting, w)
+			}
+		}
+		if len(waiting) == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("Timed out after %v waiting for pods evicted from kubernetes node %s to be rescheduled, still waiting for %v", timeout, node.Name, waiting)
+		}
+		log.Printf("Waiting for pods evicted from kubernetes node %s to be rescheduled: %v", node.Name, waiting)
+		pending = waiting
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("Stopped waiting for pods evicted from kubernetes node %s to be rescheduled: %v", node.Name, ctx.Err())
+		case <-time.After(poll):
+		}
+	}
+}
+
+func isPodReady(pod *corev1.Pod) bool {
+	if pod.Status.Phase != corev1.PodRunning {
+		return false
+	}
+	for _, c := range pod.Status.Conditions {
+		if c.Type == corev1.PodReady {
+			return c.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
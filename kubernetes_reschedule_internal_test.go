@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func testOwnedPod(name, node, ownerKind, ownerName string, ready bool) *corev1.Pod {
+	p := &corev1.Pod{
+		ObjectMeta: v1.ObjectMeta{Name: name, Namespace: "default"},
+		Spec:       corev1.PodSpec{NodeName: node},
+		Status:     corev1.PodStatus{Phase: corev1.PodPending},
+	}
+	if ownerKind != "" {
+		controller := true
+		p.OwnerReferences = []v1.OwnerReference{{Kind: ownerKind, Name: ownerName, UID: types.UID(ownerName), Controller: &controller}}
+	}
+	if ready {
+		p.Status.Phase = corev1.PodRunning
+		p.Status.Conditions = []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionTrue}}
+	}
+	return p
+}
+
+func TestGetWorkloads(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		testOwnedPod("web-1", "old", "ReplicaSet", "web", true),
+		testOwnedPod("web-2", "other", "ReplicaSet", "web", true),
+		testOwnedPod("web-3", "other", "ReplicaSet", "web", false),
+		testOwnedPod("db-0", "old", "StatefulSet", "db", true),
+		testOwnedPod("orphan", "old", "", "", true),
+		testOwnedPod("logs-1", "old", "DaemonSet", "logs", true),
+		testOwnedPod("api-1", "other", "ReplicaSet", "api", true),
+	)
+	k := &kubernetesReadiness{clientset: clientset}
+	workloads, err := k.getWorkloads(&corev1.Node{ObjectMeta: v1.ObjectMeta{Name: "old"}}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := map[types.UID]int{"web": 2, "db": 1}
+	if len(workloads) != len(expected) {
+		t.Errorf("mismatched workloads, actual %v", workloads)
+	}
+	for uid, ready := range expected {
+		if workloads[uid] == nil || workloads[uid].ready != ready {
+			t.Errorf("%s: mismatched workload, actual %v expected %d ready", uid, workloads[uid], ready)
+		}
+	}
+}
+
+func TestWaitForReschedule(t *testing.T) {
+	node := &corev1.Node{ObjectMeta: v1.ObjectMeta{Name: "old"}}
+	workloads := map[types.UID]*workload{
+		"web": {namespace: "default", kind: "ReplicaSet", name: "web", uid: "web", ready: 2},
+		"db":  {namespace: "default", kind: "StatefulSet", name: "db", uid: "db", ready: 1},
+	}
+
+	t.Run("rescheduled", func(t *testing.T) {
+		// the drain evicted web-1 and db-0, and their replacements are starting
+		clientset := fake.NewSimpleClientset(
+			testOwnedPod("web-2", "other", "ReplicaSet", "web", true),
+			testOwnedPod("web-3", "other", "ReplicaSet", "web", false),
+		)
+		k := &kubernetesReadiness{clientset: clientset, reschedulePoll: 10 * time.Millisecond}
+		go func() {
+			time.Sleep(30 * time.Millisecond)
+			_, _ = clientset.CoreV1().Pods("default").Update(testOwnedPod("web-3", "other", "ReplicaSet", "web", true))
+			_, _ = clientset.CoreV1().Pods("default").Create(testOwnedPod("db-0", "other", "StatefulSet", "db", true))
+		}()
+		if err := k.waitForReschedule(context.Background(), node, workloads, 5*time.Second); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		// pods still on the old node, or on their way out, do not count
+		deleting := testOwnedPod("web-3", "other", "ReplicaSet", "web", true)
+		now := v1.Now()
+		deleting.DeletionTimestamp = &now
+		clientset := fake.NewSimpleClientset(
+			testOwnedPod("web-1", "old", "ReplicaSet", "web", true),
+			testOwnedPod("web-2", "other", "ReplicaSet", "web", true),
+			deleting,
+			testOwnedPod("db-0", "other", "StatefulSet", "db", true),
+		)
+		k := &kubernetesReadiness{clientset: clientset, reschedulePoll: 10 * time.Millisecond}
+		err := k.waitForReschedule(context.Background(), node, workloads, 50*time.Millisecond)
+		if err == nil || !strings.Contains(err.Error(), "ReplicaSet default/web") || strings.Contains(err.Error(), "db") {
+			t.Errorf("expected to time out waiting for web only, got %v", err)
+		}
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		clientset := fake.NewSimpleClientset(testOwnedPod("web-2", "other", "ReplicaSet", "web", true))
+		k := &kubernetesReadiness{clientset: clientset, reschedulePoll: 10 * time.Millisecond}
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			time.Sleep(30 * time.Millisecond)
+			cancel()
+		}()
+		start := time.Now()
+		err := k.waitForReschedule(ctx, node, workloads, 5*time.Second)
+		if err == nil || !strings.Contains(err.Error(), "Stopped waiting") {
+			t.Errorf("expected to stop waiting, got %v", err)
+		}
+		if time.Since(start) > time.Second {
+			t.Errorf("took %v to stop waiting", time.Since(start))
+		}
+	})
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	coordinationv1beta1 "k8s.io/api/coordination/v1beta1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	coordinationclient "k8s.io/client-go/kubernetes/typed/coordination/v1beta1"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+const (
+	leaderElectionKubernetes  = "kubernetes"
+	leaderElectionDynamoDB    = "dynamodb"
+	defaultLeaderElectionName = "aws-asg-roller"
+
+	leaderLeaseDuration = 15 * time.Second
+	leaderRenewDeadline = 10 * time.Second
+	leaderRetryPeriod   = 2 * time.Second
+)
+
+// leaderElection runs leader election in the background, so the main loop can check if it is
+// the leader before making any changes
+type leaderElection struct {
+	config leaderelection.LeaderElectionConfig
+	mu     sync.Mutex
+	// leadingCtx is done as soon as we stop leading, nil if we are not the leader
+	leadingCtx context.Context
+}
+
+func newLeaderElection(lock resourcelock.Interface, leaseDuration, renewDeadline, retryPeriod time.Duration) *leaderElection {
+	l := &leaderElection{}
+	l.config = leaderelection.LeaderElectionConfig{
+		Lock:          lock,
+		LeaseDuration: leaseDuration,
+		RenewDeadline: renewDeadline,
+		RetryPeriod:   retryPeriod,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				log.Printf("Became leader as %s", lock.Identity())
+				l.mu.Lock()
+				defer l.mu.Unlock()
+				l.leadingCtx = ctx
+			},
+			OnStoppedLeading: func() {
+				l.mu.Lock()
+				defer l.mu.Unlock()
+				if l.leadingCtx != nil {
+					log.Printf("Lost leadership as %s", lock.Identity())
+				}
+				l.leadingCtx = nil
+			},
+			OnNewLeader: func(identity string) {
+				log.Printf("Current leader is %s", identity)
+			},
+		},
+	}
+	return l
+}
+
+// run participates in leader election until ctx is done. If we lose leadership, we go back to
+// being a candidate.
+func (l *leaderElection) run(ctx context.Context) error {
+	elector, err := leaderelection.NewLeaderElector(l.config)
+	if err != nil {
+		return fmt.Errorf("Invalid leader election configuration: %v", err)
+	}
+	for ctx.Err() == nil {
+		elector.Run(ctx)
+	}
+	return nil
+}
+
+// leading returns a context that is done as soon as we stop leading, so that anything we do as the
+// leader stops before another replica takes over; nil if we are not the leader
+func (l *leaderElection) leading() context.Context {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.leadingCtx == nil || l.leadingCtx.Err() != nil {
+		return nil
+	}
+	return l.leadingCtx
+}
+
+func (l *leaderElection) isLeader() bool {
+	return l.leading() != nil
+}
+
+// getLeaderElection returns the leader election selected by ROLLER_LEADER_ELECTION, or nil if disabled
+func getLeaderElection(readinessHandler readiness) (*leaderElection, error) {
+	electionType := os.Getenv("ROLLER_LEADER_ELECTION")
+	if electionType == "" {
+		return nil, nil
+	}
+	identity := os.Getenv("ROLLER_LEADER_ELECTION_ID")
+	if identity == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("Unable to get hostname for leader election identity: %v", err)
+		}
+		identity = hostname
+	}
+	name := os.Getenv("ROLLER_LEADER_ELECTION_NAME")
+	if name == "" {
+		name = defaultLeaderElectionName
+	}
+	var lock resourcelock.Interface
+	switch electionType {
+	case leaderElectionKubernetes:
+		kube, ok := readinessHandler.(*kubernetesReadiness)
+		if !ok || kube == nil {
+			return nil, fmt.Errorf("ROLLER_LEADER_ELECTION %s requires a kubernetes connection", leaderElectionKubernetes)
+		}
+		lock = &leaseLock{
+			client:    kube.clientset.CoordinationV1beta1(),
+			namespace: kubeGetNamespace(),
+			name:      name,
+			identity:  identity,
+		}
+	case leaderElectionDynamoDB:
+		table := os.Getenv("ROLLER_LEADER_ELECTION_TABLE")
+		if table == "" {
+			return nil, fmt.Errorf("ROLLER_LEADER_ELECTION %s requires ROLLER_LEADER_ELECTION_TABLE", leaderElectionDynamoDB)
+		}
+		dynamoSvc, err := awsGetDynamoDBService()
+		if err != nil {
+			return nil, fmt.Errorf("Unable to create DynamoDB client: %v", err)
+		}
+		lock = &conditionalLock{
+			store:    &dynamoConditionalStore{svc: dynamoSvc, table: table},
+			name:     name,
+			identity: identity,
+		}
+	default:
+		return nil, fmt.Errorf("ROLLER_LEADER_ELECTION has unknown value %s, must be one of: %s, %s", electionType, leaderElectionKubernetes, leaderElectionDynamoDB)
+	}
+	return newLeaderElection(lock, leaderLeaseDuration, leaderRenewDeadline, leaderRetryPeriod), nil
+}
+
+// leaseLock is a leader election lock on a Kubernetes coordination.k8s.io Lease
+type leaseLock struct {
+	client    coordinationclient.LeasesGetter
+	namespace string
+	name      string
+	identity  string
+	lease     *coordinationv1beta1.Lease
+}
+
+func (l *leaseLock) Get() (*resourcelock.LeaderElectionRecord, error) {
+	var err error
+	l.lease, err = l.client.Leases(l.namespace).Get(l.name, v1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return leaseSpecToRecord(&l.lease.Spec), nil
+}
+
+func (l *leaseLock) Create(ler resourcelock.LeaderElectionRecord) error {
+	var err error
+	l.lease, err = l.client.Leases(l.namespace).Create(&coordinationv1beta1.Lease{
+		ObjectMeta: v1.ObjectMeta{
+			Name:      l.name,
+			Namespace: l.namespace,
+		},
+		Spec: recordToLeaseSpec(&ler),
+	})
+	return err
+}
+
+func (l *leaseLock) Update(ler resourcelock.LeaderElectionRecord) error {
+	if l.lease == nil {
+		return fmt.Errorf("lease not initialized, call Get or Create first")
+	}
+	// the lease carries the resourceVersion we last read, so this fails if anyone else updated it
+	l.lease.Spec = recordToLeaseSpec(&ler)
+	lease, err := l.client.Leases(l.namespace).Update(l.lease)
+	if err != nil {
+		return err
+	}
+	l.lease = lease
+	return nil
+}
+
+func (l *leaseLock) RecordEvent(s string) {
+	log.Printf("Leader election %s: %s %s", l.Describe(), l.identity, s)
+}
+
+func (l *leaseLock) Identity() string {
+	return l.identity
+}
+
+func (l *leaseLock) Describe() string {
+	return fmt.Sprintf("%s/%s", l.namespace, l.name)
+}
+
+func leaseSpecToRecord(spec *coordinationv1beta1.LeaseSpec) *resourcelock.LeaderElectionRecord {
+	var r resourcelock.LeaderElectionRecord
+	if spec.HolderIdentity != nil {
+		r.HolderIdentity = *spec.HolderIdentity
+	}
+	if spec.LeaseDurationSeconds != nil {
+		r.LeaseDurationSeconds = int(*spec.LeaseDurationSeconds)
+	}
+	if spec.LeaseTransitions != nil {
+		r.LeaderTransitions = int(*spec.LeaseTransitions)
+	}
+	if spec.AcquireTime != nil {
+		r.AcquireTime = v1.Time{Time: spec.AcquireTime.Time}
+	}
+	if spec.RenewTime != nil {
+		r.RenewTime = v1.Time{Time: spec.RenewTime.Time}
+	}
+	return &r
+}
+
+func recordToLeaseSpec(ler *resourcelock.LeaderElectionRecord) coordinationv1beta1.LeaseSpec {
+	holder := ler.HolderIdentity
+	leaseDuration := int32(ler.LeaseDurationSeconds)
+	transitions := int32(ler.LeaderTransitions)
+	return coordinationv1beta1.LeaseSpec{
+		HolderIdentity:       &holder,
+		LeaseDurationSeconds: &leaseDuration,
+		AcquireTime:          &v1.MicroTime{Time: ler.AcquireTime.Time},
+		RenewTime:            &v1.MicroTime{Time: ler.RenewTime.Time},
+		LeaseTransitions:     &transitions,
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+const (
+	dynamoKeyAttribute     = "LockName"
+	dynamoRecordAttribute  = "Record"
+	dynamoVersionAttribute = "Version"
+)
+
+// conditionalStore is a key-value store that supports conditional writes, e.g. DynamoDB
+type conditionalStore interface {
+	// get returns the value and version stored for key. A version of 0 means there is no value.
+	get(key string) ([]byte, int64, error)
+	// put stores value for key with version+1, but only if the stored version is still version.
+	// A version of 0 means the key must not exist yet. If the condition fails, returns a conditionFailedError.
+	put(key string, value []byte, version int64) error
+}
+
+// conditionFailedError is returned by a conditionalStore when a conditional write lost a race
+type conditionFailedError struct {
+	key string
+}
+
+func (c conditionFailedError) Error() string {
+	return fmt.Sprintf("conditional write of %s failed, it was modified by someone else", c.key)
+}
+
+// conditionalLock is a leader election lock on top of a conditionalStore
+type conditionalLock struct {
+	store    conditionalStore
+	name     string
+	identity string
+	// version is the version we last read or wrote
+	version int64
+}
+
+func (c *conditionalLock) Get() (*resourcelock.LeaderElectionRecord, error) {
+	value, version, err := c.store.get(c.name)
+	if err != nil {
+		return nil, err
+	}
+	if version == 0 {
+		// leader election expects a kubernetes not found error to know it should create the lock
+		return nil, errors.NewNotFound(schema.GroupResource{Resource: "locks"}, c.name)
+	}
+	var record resourcelock.LeaderElectionRecord
+	if err := json.Unmarshal(value, &record); err != nil {
+		return nil, fmt.Errorf("invalid leader election record for %s: %v", c.name, err)
+	}
+	c.version = version
+	return &record, nil
+}
+
+func (c *conditionalLock) Create(ler resourcelock.LeaderElectionRecord) error {
+	return c.write(ler, 0)
+}
+
+func (c *conditionalLock) Update(ler resourcelock.LeaderElectionRecord) error {
+	if c.version == 0 {
+		return fmt.Errorf("lock not initialized, call Get or Create first")
+	}
+	return c.write(ler, c.version)
+}
+
+func (c *conditionalLock) write(ler resourcelock.LeaderElectionRecord, version int64) error {
+	value, err := json.Marshal(ler)
+	if err != nil {
+		return err
+	}
+	if err := c.store.put(c.name, value, version); err != nil {
+		return err
+	}
+	c.version = version + 1
+	return nil
+}
+
+func (c *conditionalLock) RecordEvent(s string) {
+	log.Printf("Leader election %s: %s %s", c.Describe(), c.identity, s)
+}
+
+func (c *conditionalLock) Identity() string {
+	return c.identity
+}
+
+func (c *conditionalLock) Describe() string {
+	return c.name
+}
+
+// dynamoConditionalStore is a conditionalStore on a DynamoDB table, whose partition key is a string named LockName
+type dynamoConditionalStore struct {
+	svc   dynamodbiface.DynamoDBAPI
+	table string
+}
+
+func (d *dynamoConditionalStore) get(key string) ([]byte, int64, error) {
+	result, err := d.svc.GetItem(&dynamodb.GetItemInput{
+		TableName:      aws.String(d.table),
+		ConsistentRead: aws.Bool(true),
+		Key: map[string]*dynamodb.AttributeValue{
+			dynamoKeyAttribute: {S: aws.String(key)},
+		},
+	})
+	if err != nil {
+		return nil, 0, fmt.Errorf("Unable to get %s from DynamoDB table %s: %v", key, d.table, err)
+	}
+	if len(result.Item) == 0 {
+		return nil, 0, nil
+	}
+	record, ok := result.Item[dynamoRecordAttribute]
+	if !ok || record.S == nil {
+		return nil, 0, fmt.Errorf("Item %s in DynamoDB table %s has no %s", key, d.table, dynamoRecordAttribute)
+	}
+	version, ok := result.Item[dynamoVersionAttribute]
+	if !ok || version.N == nil {
+		return nil, 0, fmt.Errorf("Item %s in DynamoDB table %s has no %s", key, d.table, dynamoVersionAttribute)
+	}
+	v, err := strconv.ParseInt(*version.N, 10, 64)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Item %s in DynamoDB table %s has invalid %s: %v", key, d.table, dynamoVersionAttribute, err)
+	}
+	return []byte(*record.S), v, nil
+}
+
+func (d *dynamoConditionalStore) put(key string, value []byte, version int64) error {
+	input := &dynamodb.PutItemInput{
+		TableName: aws.String(d.table),
+		Item: map[string]*dynamodb.AttributeValue{
+			dynamoKeyAttribute:     {S: aws.String(key)},
+			dynamoRecordAttribute:  {S: aws.String(string(value))},
+			dynamoVersionAttribute: {N: aws.String(strconv.FormatInt(version+1, 10))},
+		},
+	}
+	if version == 0 {
+		input.ConditionExpression = aws.String("attribute_not_exists(#key)")
+		input.ExpressionAttributeNames = map[string]*string{"#key": aws.String(dynamoKeyAttribute)}
+	} else {
+		input.ConditionExpression = aws.String("#version = :version")
+		input.ExpressionAttributeNames = map[string]*string{"#version": aws.String(dynamoVersionAttribute)}
+		input.ExpressionAttributeValues = map[string]*dynamodb.AttributeValue{
+			":version": {N: aws.String(strconv.FormatInt(version, 10))},
+		}
+	}
+	_, err := d.svc.PutItem(input)
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+			return conditionFailedError{key: key}
+		}
+		return fmt.Errorf("Unable to put %s to DynamoDB table %s: %v", key, d.table, err)
+	}
+	return nil
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+// blockingReadyHandler is a readiness handler that prepares instances for termination until it is stopped
+type blockingReadyHandler struct {
+	testReadyHandler
+	preparing chan struct{}
+}
+
+func (b *blockingReadyHandler) prepareTermination(ctx context.Context, instances []instanceDescriptor, opts drainSettings) error {
+	close(b.preparing)
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+// mockDynamoSvc is a local fake of a DynamoDB table, understanding just the conditions we use
+type mockDynamoSvc struct {
+	dynamodbiface.DynamoDBAPI
+	sync.Mutex
+	items map[string]map[string]*dynamodb.AttributeValue
+	// err, if set, fails every write, e.g. to lose the lock
+	err error
+}
+
+func (m *mockDynamoSvc) GetItem(in *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	m.Lock()
+	defer m.Unlock()
+	return &dynamodb.GetItemOutput{Item: m.items[*in.Key[dynamoKeyAttribute].S]}, nil
+}
+func (m *mockDynamoSvc) PutItem(in *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	m.Lock()
+	defer m.Unlock()
+	if m.err != nil {
+		return nil, m.err
+	}
+	if m.items == nil {
+		m.items = map[string]map[string]*dynamodb.AttributeValue{}
+	}
+	key := *in.Item[dynamoKeyAttribute].S
+	existing, exists := m.items[key]
+	failed := awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "", nil)
+	switch aws.StringValue(in.ConditionExpression) {
+	case "attribute_not_exists(#key)":
+		if exists {
+			return nil, failed
+		}
+	case "#version = :version":
+		if !exists || *existing[dynamoVersionAttribute].N != *in.ExpressionAttributeValues[":version"].N {
+			return nil, failed
+		}
+	}
+	m.items[key] = in.Item
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func TestConditionalLock(t *testing.T) {
+	svc := &mockDynamoSvc{}
+	first := &conditionalLock{store: &dynamoConditionalStore{svc: svc, table: "locks"}, name: "roller", identity: "first"}
+	second := &conditionalLock{store: &dynamoConditionalStore{svc: svc, table: "locks"}, name: "roller", identity: "second"}
+
+	if _, err := first.Get(); !errors.IsNotFound(err) {
+		t.Fatalf("expected not found error for missing lock, got %v", err)
+	}
+	if err := first.Create(resourcelock.LeaderElectionRecord{HolderIdentity: "first"}); err != nil {
+		t.Fatalf("unexpected error creating lock: %v", err)
+	}
+	if err := second.Create(resourcelock.LeaderElectionRecord{HolderIdentity: "second"}); err == nil {
+		t.Fatalf("expected error creating lock that already exists")
+	}
+	record, err := second.Get()
+	if err != nil {
+		t.Fatalf("unexpected error getting lock: %v", err)
+	}
+	if record.HolderIdentity != "first" {
+		t.Errorf("mismatched holder, actual %s expected first", record.HolderIdentity)
+	}
+	// both saw the same version; only one update can win
+	if err := first.Update(resourcelock.LeaderElectionRecord{HolderIdentity: "first", LeaderTransitions: 1}); err != nil {
+		t.Fatalf("unexpected error updating lock: %v", err)
+	}
+	err = second.Update(resourcelock.LeaderElectionRecord{HolderIdentity: "second"})
+	if _, ok := err.(conditionFailedError); !ok {
+		t.Errorf("expected condition failed error for stale update, got %v", err)
+	}
+	// the winner can keep renewing
+	if err := first.Update(resourcelock.LeaderElectionRecord{HolderIdentity: "first", LeaderTransitions: 1}); err != nil {
+		t.Errorf("unexpected error renewing lock: %v", err)
+	}
+}
+
+func TestLeaseLock(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	lock := &leaseLock{client: clientset.CoordinationV1beta1(), namespace: "kube-system", name: "roller", identity: "first"}
+	if _, err := lock.Get(); !errors.IsNotFound(err) {
+		t.Fatalf("expected not found error for missing lease, got %v", err)
+	}
+	now := v1.NewTime(time.Now().Truncate(time.Second))
+	if err := lock.Create(resourcelock.LeaderElectionRecord{HolderIdentity: "first", LeaseDurationSeconds: 15, RenewTime: now}); err != nil {
+		t.Fatalf("unexpected error creating lease: %v", err)
+	}
+	if err := lock.Update(resourcelock.LeaderElectionRecord{HolderIdentity: "first", LeaseDurationSeconds: 15, RenewTime: now, LeaderTransitions: 2}); err != nil {
+		t.Fatalf("unexpected error updating lease: %v", err)
+	}
+	record, err := lock.Get()
+	switch {
+	case err != nil:
+		t.Fatalf("unexpected error getting lease: %v", err)
+	case record.HolderIdentity != "first" || record.LeaseDurationSeconds != 15 || record.LeaderTransitions != 2 || !record.RenewTime.Equal(&now):
+		t.Errorf("mismatched record %v", record)
+	}
+}
+
+func TestLeaderElection(t *testing.T) {
+	svc := &mockDynamoSvc{}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	elections := make([]*leaderElection, 0)
+	for _, id := range []string{"first", "second", "third"} {
+		lock := &conditionalLock{store: &dynamoConditionalStore{svc: svc, table: "locks"}, name: "roller", identity: id}
+		election := newLeaderElection(lock, 1*time.Second, 500*time.Millisecond, 100*time.Millisecond)
+		elections = append(elections, election)
+		go func() {
+			_ = election.run(ctx)
+		}()
+	}
+	// wait for someone to become leader, and make sure it is only one
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		leaders := 0
+		for _, e := range elections {
+			if e.isLeader() {
+				leaders++
+			}
+		}
+		if leaders > 1 {
+			t.Fatalf("had %d leaders at once", leaders)
+		}
+		if leaders == 1 {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Errorf("no leader elected")
+}
+
+func TestLeaderElectionLost(t *testing.T) {
+	svc := &mockDynamoSvc{}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	lock := &conditionalLock{store: &dynamoConditionalStore{svc: svc, table: "locks"}, name: "roller", identity: "first"}
+	election := newLeaderElection(lock, 1*time.Second, 500*time.Millisecond, 100*time.Millisecond)
+	go func() {
+		_ = election.run(ctx)
+	}()
+	var leadingCtx context.Context
+	deadline := time.Now().Add(5 * time.Second)
+	for leadingCtx == nil && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+		leadingCtx = election.leading()
+	}
+	if leadingCtx == nil {
+		t.Fatalf("did not become leader")
+	}
+
+	// mid-rollout, with a new instance ready, so the next old one is drained while we lose the lock
+	config := &rollerConfig{defaults: asgSettings{strategy: strategySurge, maxSurge: intOrPercent{value: 1}, maxUnavailable: intOrPercent{value: 1}}}
+	store := newMemoryStateStore()
+	_ = store.save(context.Background(), "myasg", &rolloutState{OriginalDesired: 3, StartTime: time.Now(), TargetVersion: "newconf"})
+	states, _ := store.load(context.Background(), []string{"myasg"})
+	asgSvc := &mockAsgSvc{groups: map[string]*autoscaling.Group{
+		"myasg": testGroup("myasg", 4, 5, []string{"1", "2", "3"}, []string{"4"}, nil),
+	}}
+	handler := &blockingReadyHandler{preparing: make(chan struct{})}
+	go func() {
+		<-handler.preparing
+		svc.Lock()
+		svc.err = awserr.New(dynamodb.ErrCodeProvisionedThroughputExceededException, "", nil)
+		svc.Unlock()
+	}()
+	done := make(chan error)
+	go func() {
+		done <- adjust(leadingCtx, []string{"myasg"}, &mockEc2Svc{autodescribe: true}, asgSvc, handler, states, store, config)
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Errorf("expected error when leadership was lost while draining")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("adjust did not stop after losing leadership")
+	}
+	if calls := asgSvc.counter.filterByName("TerminateInstanceInAutoScalingGroup"); len(calls) != 0 {
+		t.Errorf("expected no instance to be terminated after losing leadership, got %d", len(calls))
+	}
+	if election.isLeader() {
+		t.Errorf("expected to no longer be the leader")
+	}
+}
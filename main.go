@@ -1,31 +1,58 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"log"
 	"os"
 	"strconv"
-	"strings"
 	"time"
+
+	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
 )
 
 const (
 	asgCheckDelay = 30 // Default delay between checks of ASG status in seconds
+	maxErrors     = 5  // Default number of consecutive errors before giving up in run-until-complete mode
+
+	exitTimeout   = 2 // Exit code when run-until-complete mode times out
+	exitMaxErrors = 3 // Exit code when run-until-complete mode has too many consecutive errors
+	exitNoASGs    = 5 // Exit code when run-until-complete mode finds no ASGs to manage
+	exitShutdown  = 6 // Exit code when run-until-complete mode is shut down before the rollout is complete
 )
 
 func main() {
-	asgList := strings.Split(os.Getenv("ROLLER_ASG"), ",")
-	if len(asgList) == 0 {
-		log.Fatal("Must supply at least one ASG in ROLLER_ASG environment variable")
+	once := flag.Bool("once", false, "roll until every ASG is up to date, then exit; same as ROLLER_RUN_UNTIL_COMPLETE=true")
+	configPath := flag.String("config", "", "path to a YAML or JSON config file; same as ROLLER_CONFIG_FILE")
+	flag.Parse()
+
+	// the config file, if any, takes precedence over the environment
+	path := getConfigFilePath(*configPath)
+	file, err := loadConfigFile(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// which ASGs to manage, listed or found by their tags
+	discovery, err := getAsgDiscovery(file)
+	if err != nil {
+		log.Fatal(err)
 	}
 
 	// get config env
-	ignoreDaemonSets := os.Getenv("ROLLER_IGNORE_DAEMONSETS") != "false"
+	ignoreDaemonSets := getIgnoreDaemonSets(file)
 	// get a kube connection
-	readinessHandler, err := kubeGetReadinessHandler(ignoreDaemonSets)
+	kube, err := kubeGetReadinessHandler(ignoreDaemonSets)
 	if err != nil {
 		log.Fatalf("Error getting kubernetes readiness handler when required: %v", err)
 	}
+	// which checks to run on new instances, and how to prepare old ones, in order
+	readinessHandler, err := getReadinessHandler(kube)
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
 
 	// get the AWS sessions
 	ec2Svc, asgSvc, err := awsGetServices()
@@ -33,28 +60,235 @@ func main() {
 		log.Fatalf("Unable to create an AWS session: %v", err)
 	}
 
-	// to keep track of original target sizes during rolling updates
-	originalDesired := map[string]int64{}
+	// to keep track of original target sizes during rolling updates, persisted so that
+	// a restart in the middle of a rollout can continue where it left off
+	store, err := getStateStore(asgSvc, kube)
+	if err != nil {
+		log.Fatalf("Unable to get state store: %v", err)
+	}
+	// on SIGTERM, stop waiting on whatever we are doing, and exit before we are killed
+	grace, err := getShutdownGracePeriod()
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	ctx := shutdownContext(grace)
+
+	asgList, err := discovery.names(ctx, asgSvc)
+	if err != nil {
+		log.Fatalf("Unable to discover ASGs: %v", err)
+	}
+	log.Printf("Managing ASGs %v", asgList)
+	states, err := store.load(ctx, asgList)
+	if err != nil {
+		log.Fatalf("Unable to load rollout state: %v", err)
+	}
+	for asg, state := range states {
+		log.Printf("Resuming rollout of ASG %s to %s started at %v, original desired %d", asg, state.TargetVersion, state.StartTime, state.OriginalDesired)
+	}
 
-	checkDelay, err := getDelay()
+	// per-ASG settings for how to roll
+	config, err := getRollerConfig(file)
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+
+	checkDelay, err := getDelay(file)
 	if err != nil {
 		log.Fatalf("Unable to get delay: %s", err.Error())
 	}
+	maxLoopAge, err := getMaxLoopAge(checkDelay)
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+
+	// when running until complete, when to give up
+	until, err := getUntilComplete(*once)
+	if err != nil {
+		log.Fatalf("Unable to get run until complete settings: %v", err)
+	}
+
+	// in a dry run, work out what we would do once, and report it without changing anything
+	if os.Getenv("ROLLER_DRY_RUN") == "true" {
+		log.Printf("Dry run, no changes will be made")
+		if err := dryRun(ctx, asgList, ec2Svc, asgSvc, readinessHandler, states, config, os.Stderr, os.Stdout); err != nil {
+			log.Fatalf("Error planning adjustment of AutoScaling Groups: %v", err)
+		}
+		return
+	}
+
+	// metrics and health checks, including while standing by as a replica that is not the leader
+	health := newHealth(asgSvc, readinessHandler, maxLoopAge)
+	if address := getHTTPAddress(); address != "" {
+		serveHTTP(address, health)
+	}
+
+	// pick up changes to the config file without restarting, which would interrupt any rollouts
+	var reloader *configReloader
+	if path != "" {
+		reloader = newConfigReloader(path, configPollInterval)
+	}
+
+	// if we are running multiple replicas, only the leader may adjust
+	election, err := getLeaderElection(kube)
+	if err != nil {
+		log.Fatalf("Unable to set up leader election: %v", err)
+	}
+	if election != nil {
+		go func() {
+			if err := election.run(ctx); err != nil {
+				log.Fatalf("Leader election failed: %v", err)
+			}
+		}()
+	}
+	leading := election == nil
+	// what we do as the leader stops when we shut down, or as soon as we stop leading
+	adjustCtx := ctx
 
-	// infinite loop
-	for {
-		err = adjust(asgList, ec2Svc, asgSvc, readinessHandler, originalDesired)
+	// loop forever, or until complete or shut down
+	for ctx.Err() == nil {
+		// getting back here means we finished the last iteration, however it went
+		health.loopDone()
+		// swap in a changed config between adjustments, never in the middle of one
+		if reloader != nil && reloader.requested() {
+			reloaded, err := reloadConfig(path)
+			if err != nil {
+				log.Printf("Keeping the current config, as the new one is invalid: %v", err)
+			} else {
+				changes := diffConfigFiles(file, reloaded.file)
+				if len(changes) == 0 {
+					log.Printf("Reloaded config file %s, nothing changed", path)
+				}
+				for _, change := range changes {
+					log.Printf("Config changed: %s", change)
+				}
+				for asg := range states {
+					if !reloaded.discovery.manages(asg) {
+						log.Printf("ASG %s is no longer listed, its rollout is left as it is unless it is discovered by its tags", asg)
+					}
+				}
+				file, discovery, config, checkDelay = reloaded.file, reloaded.discovery, reloaded.config, reloaded.checkDelay
+				health.setMaxLoopAge(reloaded.maxLoopAge)
+				if k, ok := kube.(*kubernetesReadiness); ok {
+					k.ignoreDaemonSets = reloaded.ignoreDaemonSets
+				}
+			}
+		}
+		if until != nil && until.timedOut() {
+			log.Printf("Timed out waiting for rollout of %v to complete", asgList)
+			os.Exit(exitTimeout)
+		}
+		// ASGs may have been created or tagged since we last looked
+		var current []string
+		current, err = discovery.names(ctx, asgSvc)
+		if err == nil {
+			if added := addedNames(asgList, current); len(added) > 0 {
+				log.Printf("Discovered ASGs %v", added)
+				var addedStates map[string]*rolloutState
+				if addedStates, err = store.load(ctx, added); err == nil {
+					for name, state := range addedStates {
+						states[name] = state
+					}
+				}
+			}
+		}
+		if err != nil {
+			log.Printf("Unable to discover ASGs: %v", err)
+			if until != nil {
+				if exit, code := until.check(ctx, err, asgList, ec2Svc, asgSvc, states); exit {
+					os.Exit(code)
+				}
+			}
+			sleep(ctx, checkDelay)
+			continue
+		}
+		asgList = current
+		if election != nil {
+			leadingCtx := election.leading()
+			switch {
+			case leadingCtx == nil:
+				if leading {
+					log.Printf("No longer the leader, standing by")
+				}
+				leading = false
+				// the leader may finish the rollout for us
+				if until != nil {
+					var loaded map[string]*rolloutState
+					if loaded, err = store.load(ctx, asgList); err == nil {
+						states = loaded
+					} else {
+						log.Printf("Unable to load rollout state: %v", err)
+					}
+					if exit, code := until.check(ctx, err, asgList, ec2Svc, asgSvc, states); exit {
+						os.Exit(code)
+					}
+				}
+				log.Printf("Not the leader, sleeping %d seconds\n", checkDelay)
+				sleep(ctx, checkDelay)
+				continue
+			case !leading:
+				// the previous leader may have made progress, so get the latest state
+				loaded, err := store.load(ctx, asgList)
+				if err != nil {
+					log.Printf("Unable to reload rollout state after becoming leader: %v", err)
+					sleep(ctx, checkDelay)
+					continue
+				}
+				states = loaded
+				leading = true
+			}
+			// the leading context is derived from ctx, so is also done when we shut down
+			adjustCtx = leadingCtx
+		}
+		runCtx, cancel := adjustCtx, context.CancelFunc(func() {})
+		if until != nil {
+			runCtx, cancel = until.withDeadline(adjustCtx)
+		}
+		err = adjust(runCtx, asgList, ec2Svc, asgSvc, readinessHandler, states, store, config)
+		cancel()
+		if ctx.Err() != nil {
+			// the state of each rollout is saved before every step, so the next run picks up where we stopped
+			log.Printf("Stopped adjusting AutoScaling Groups to shut down: %v", err)
+			break
+		}
+		if until != nil && until.timedOut() {
+			log.Printf("Timed out waiting for rollout of %v to complete: %v", asgList, err)
+			os.Exit(exitTimeout)
+		}
+		if adjustCtx.Err() != nil {
+			// the new leader picks up from the saved state
+			log.Printf("Stopped adjusting AutoScaling Groups, as we are no longer the leader: %v", err)
+			continue
+		}
 		if err != nil {
 			log.Printf("Error adjusting AutoScaling Groups: %v", err)
 		}
+		if until != nil {
+			if exit, code := until.check(ctx, err, asgList, ec2Svc, asgSvc, states); exit {
+				os.Exit(code)
+			}
+		}
 		// delay with each loop
 		log.Printf("Sleeping %d seconds\n", checkDelay)
-		time.Sleep(time.Duration(checkDelay) * time.Second)
+		sleep(ctx, checkDelay)
+	}
+	log.Printf("Shut down")
+	os.Exit(shutdownExitCode(until))
+}
+
+// shutdownExitCode returns the code to exit with when shut down. Run-until-complete mode exits as soon as the
+// rollout is complete, so if it is shut down first, the rollout did not complete.
+func shutdownExitCode(until *untilComplete) int {
+	if until == nil {
+		return 0
 	}
+	return exitShutdown
 }
 
-// Returns delay value to use in loop. Uses default if not defined.
-func getDelay() (int, error) {
+// Returns delay value to use in loop, from the config file or ROLLER_CHECK_DELAY. Uses default if not defined.
+func getDelay(file *configFile) (int, error) {
+	if file != nil && file.CheckDelay != nil {
+		return *file.CheckDelay, nil
+	}
 	delayOverride, exist := os.LookupEnv("ROLLER_CHECK_DELAY")
 	if exist {
 		delay, err := strconv.Atoi(delayOverride)
@@ -66,3 +300,81 @@ func getDelay() (int, error) {
 
 	return asgCheckDelay, nil
 }
+
+// untilComplete tracks when to give up in run-until-complete mode
+type untilComplete struct {
+	// deadline is when to time out, zero for never
+	deadline time.Time
+	// maxErrors is how many consecutive errors to allow, 0 for unlimited
+	maxErrors int
+	// errors is how many consecutive errors we have had
+	errors int
+}
+
+// Returns run-until-complete settings if enabled by the --once flag or ROLLER_RUN_UNTIL_COMPLETE, nil otherwise
+func getUntilComplete(once bool) (*untilComplete, error) {
+	if !once && os.Getenv("ROLLER_RUN_UNTIL_COMPLETE") != "true" {
+		return nil, nil
+	}
+	u := &untilComplete{maxErrors: maxErrors}
+	if timeoutOverride, exist := os.LookupEnv("ROLLER_RUN_TIMEOUT"); exist {
+		timeout, err := strconv.Atoi(timeoutOverride)
+		if err != nil || timeout < 0 {
+			return nil, fmt.Errorf("ROLLER_RUN_TIMEOUT is not a valid number of seconds: %v", timeoutOverride)
+		}
+		if timeout > 0 {
+			u.deadline = time.Now().Add(time.Duration(timeout) * time.Second)
+		}
+	}
+	if maxErrorsOverride, exist := os.LookupEnv("ROLLER_MAX_ERRORS"); exist {
+		max, err := strconv.Atoi(maxErrorsOverride)
+		if err != nil || max < 0 {
+			return nil, fmt.Errorf("ROLLER_MAX_ERRORS is not a valid number: %v", maxErrorsOverride)
+		}
+		u.maxErrors = max
+	}
+	return u, nil
+}
+
+func (u *untilComplete) timedOut() bool {
+	return !u.deadline.IsZero() && time.Now().After(u.deadline)
+}
+
+// withDeadline returns a context that is also done at the deadline, if there is one, so that an adjustment
+// that is stuck, e.g. on a drain blocked by a PodDisruptionBudget, does not outlast it
+func (u *untilComplete) withDeadline(ctx context.Context) (context.Context, context.CancelFunc) {
+	if u.deadline.IsZero() {
+		return context.WithCancel(ctx)
+	}
+	return context.WithDeadline(ctx, u.deadline)
+}
+
+// check takes the result of the latest attempt to adjust, and checks if every ASG is fully rolled.
+// Returns whether to exit, and with what code.
+func (u *untilComplete) check(ctx context.Context, adjustErr error, asgList []string, ec2Svc ec2iface.EC2API, asgSvc autoscalingiface.AutoScalingAPI, states map[string]*rolloutState) (bool, int) {
+	// having nothing to roll, e.g. because of a typo in the tags to discover ASGs by, is not a success
+	if adjustErr == nil && len(asgList) == 0 {
+		log.Printf("No ASGs to manage, so nothing was rolled")
+		return true, exitNoASGs
+	}
+	err := adjustErr
+	if err == nil {
+		var complete bool
+		complete, err = rolloutComplete(ctx, asgList, ec2Svc, asgSvc, states)
+		if err == nil {
+			u.errors = 0
+			if complete {
+				log.Printf("Rollout of %v is complete", asgList)
+				return true, 0
+			}
+			return false, 0
+		}
+		log.Printf("Unable to check if rollout is complete: %v", err)
+	}
+	u.errors++
+	if u.maxErrors > 0 && u.errors >= u.maxErrors {
+		log.Printf("Giving up after %d consecutive errors, last: %v", u.errors, err)
+		return true, exitMaxErrors
+	}
+	return false, 0
+}
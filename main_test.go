@@ -1,8 +1,13 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"os"
 	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/autoscaling"
 )
 
 func TestGetDelay(t *testing.T) {
@@ -24,7 +29,7 @@ func TestGetDelay(t *testing.T) {
 				os.Setenv("ROLLER_CHECK_DELAY", tt.envValue)
 			}
 
-			got, err := getDelay()
+			got, err := getDelay(nil)
 			if err != nil {
 				if !tt.shouldError {
 					t.Errorf("getDelay() returned error: %s", err.Error())
@@ -39,3 +44,132 @@ func TestGetDelay(t *testing.T) {
 		})
 	}
 }
+
+func TestGetUntilComplete(t *testing.T) {
+	tests := []struct {
+		name          string
+		once          bool
+		env           map[string]string
+		enabled       bool
+		wantDeadline  bool
+		wantMaxErrors int
+		shouldError   bool
+	}{
+		{"should be disabled by default", false, nil, false, false, 0, false},
+		{"should be enabled by flag", true, nil, true, false, 5, false},
+		{"should be enabled by env", false, map[string]string{"ROLLER_RUN_UNTIL_COMPLETE": "true"}, true, false, 5, false},
+		{"should set timeout", true, map[string]string{"ROLLER_RUN_TIMEOUT": "600"}, true, true, 5, false},
+		{"should set max errors", true, map[string]string{"ROLLER_MAX_ERRORS": "0"}, true, false, 0, false},
+		{"should error if timeout invalid", true, map[string]string{"ROLLER_RUN_TIMEOUT": "1h"}, false, false, 0, true},
+		{"should error if max errors invalid", true, map[string]string{"ROLLER_MAX_ERRORS": "-1"}, false, false, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, k := range []string{"ROLLER_RUN_UNTIL_COMPLETE", "ROLLER_RUN_TIMEOUT", "ROLLER_MAX_ERRORS"} {
+				os.Unsetenv(k)
+			}
+			for k, v := range tt.env {
+				os.Setenv(k, v)
+				defer os.Unsetenv(k)
+			}
+
+			got, err := getUntilComplete(tt.once)
+			switch {
+			case err != nil && !tt.shouldError:
+				t.Errorf("getUntilComplete() returned error: %v", err)
+			case err == nil && tt.shouldError:
+				t.Error("getUntilComplete() should have returned error")
+			case err != nil:
+			case (got != nil) != tt.enabled:
+				t.Errorf("getUntilComplete() = %v, want enabled %v", got, tt.enabled)
+			case got == nil:
+			case got.deadline.IsZero() == tt.wantDeadline:
+				t.Errorf("getUntilComplete() deadline = %v, want deadline %v", got.deadline, tt.wantDeadline)
+			case got.maxErrors != tt.wantMaxErrors:
+				t.Errorf("getUntilComplete() maxErrors = %d, want %d", got.maxErrors, tt.wantMaxErrors)
+			}
+		})
+	}
+}
+
+func TestUntilCompleteCheck(t *testing.T) {
+	ec2Svc := &mockEc2Svc{autodescribe: true}
+	done := &mockAsgSvc{groups: map[string]*autoscaling.Group{
+		"myasg": testGroup("myasg", 2, 5, nil, []string{"1", "2"}, nil),
+	}}
+	rolling := &mockAsgSvc{groups: map[string]*autoscaling.Group{
+		"myasg": testGroup("myasg", 3, 5, []string{"1"}, []string{"2", "3"}, nil),
+	}}
+	inProgress := map[string]*rolloutState{"myasg": {OriginalDesired: 2}}
+	adjustErr := fmt.Errorf("adjust failed")
+
+	tests := []struct {
+		name     string
+		asgSvc   *mockAsgSvc
+		states   map[string]*rolloutState
+		errs     []error
+		wantExit bool
+		wantCode int
+	}{
+		{"should exit when complete", done, nil, []error{nil}, true, 0},
+		{"should continue with old instances", rolling, nil, []error{nil}, false, 0},
+		{"should continue until desired restored", done, inProgress, []error{nil}, false, 0},
+		{"should continue after an error", done, nil, []error{adjustErr}, false, 0},
+		{"should give up after max errors", rolling, nil, []error{adjustErr, adjustErr, adjustErr}, true, exitMaxErrors},
+		{"should only count consecutive errors", rolling, nil, []error{adjustErr, adjustErr, nil, adjustErr, adjustErr}, false, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := &untilComplete{maxErrors: 3}
+			var (
+				exit bool
+				code int
+			)
+			for _, err := range tt.errs {
+				exit, code = u.check(context.Background(), err, []string{"myasg"}, ec2Svc, tt.asgSvc, tt.states)
+			}
+			if exit != tt.wantExit || code != tt.wantCode {
+				t.Errorf("check() = %v, %d, want %v, %d", exit, code, tt.wantExit, tt.wantCode)
+			}
+		})
+	}
+	// nothing to manage is not a success
+	u := &untilComplete{maxErrors: 3}
+	if exit, code := u.check(context.Background(), nil, nil, ec2Svc, done, nil); !exit || code != exitNoASGs {
+		t.Errorf("check() with no ASGs = %v, %d, want true, %d", exit, code, exitNoASGs)
+	}
+	if _, err := rolloutComplete(context.Background(), nil, ec2Svc, done, nil); err == nil {
+		t.Errorf("expected error checking if rollout of no ASGs is complete")
+	}
+}
+
+func TestShutdownExitCode(t *testing.T) {
+	if code := shutdownExitCode(nil); code != 0 {
+		t.Errorf("shutdownExitCode() running forever = %d, want 0", code)
+	}
+	// shut down before the rollout was complete, which would have exited already
+	if code := shutdownExitCode(&untilComplete{maxErrors: 3}); code != exitShutdown {
+		t.Errorf("shutdownExitCode() running until complete = %d, want %d", code, exitShutdown)
+	}
+}
+
+func TestUntilCompleteWithDeadline(t *testing.T) {
+	// without a timeout, only the parent stops it
+	u := &untilComplete{}
+	ctx, cancel := u.withDeadline(context.Background())
+	if _, ok := ctx.Deadline(); ok || ctx.Err() != nil {
+		t.Errorf("expected no deadline without a timeout")
+	}
+	cancel()
+
+	// a timeout that has passed stops whatever is in progress
+	u = &untilComplete{deadline: time.Now().Add(-time.Second)}
+	ctx, cancel = u.withDeadline(context.Background())
+	defer cancel()
+	if ctx.Err() != context.DeadlineExceeded {
+		t.Errorf("mismatched error after the deadline, actual %v expected %v", ctx.Err(), context.DeadlineExceeded)
+	}
+	if !u.timedOut() {
+		t.Errorf("expected to have timed out")
+	}
+}
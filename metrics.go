@@ -0,0 +1,198 @@
+package main
+
+import (
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const metricsNamespace = "aws_asg_roller"
+
+// results of preparing an old node for termination, for the drains counter
+const (
+	drainSucceeded = "succeeded"
+	drainSkipped   = "skipped"
+	drainFailed    = "failed"
+)
+
+var (
+	metricOldInstances = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "old_instances",
+		Help:      "Number of instances of the ASG with an outdated launch configuration or template.",
+	}, []string{"asg"})
+	metricNewInstances = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "new_instances",
+		Help:      "Number of instances of the ASG with the current launch configuration or template.",
+	}, []string{"asg"})
+	metricDesired = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "desired",
+		Help:      "Desired capacity of the ASG.",
+	}, []string{"asg"})
+	metricOriginalDesired = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "original_desired",
+		Help:      "Desired capacity of the ASG before its rollout started, 0 if not rolling.",
+	}, []string{"asg"})
+	metricRolloutInProgress = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "rollout_in_progress",
+		Help:      "1 if the ASG is being rolled, 0 otherwise.",
+	}, []string{"asg"})
+	metricTerminations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "terminations_total",
+		Help:      "Number of old instances terminated.",
+	}, []string{"asg"})
+	metricDrains = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "drains_total",
+		Help:      "Number of old nodes prepared for termination, by whether it succeeded, failed or was skipped for now.",
+	}, []string{"asg", "result"})
+	metricAwsErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "aws_api_errors_total",
+		Help:      "Number of errors from AWS API calls, by operation and AWS error code.",
+	}, []string{"operation", "code"})
+	metricDrainDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "drain_duration_seconds",
+		Help:      "Time taken to prepare an old node for termination, including waiting for its pods to be rescheduled.",
+		Buckets:   prometheus.ExponentialBuckets(5, 2, 10),
+	}, []string{"asg"})
+	metricTimeToReady = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "node_time_to_ready_seconds",
+		Help:      "Time from the launch of a new instance until it was found ready.",
+		Buckets:   prometheus.ExponentialBuckets(15, 2, 10),
+	}, []string{"asg"})
+)
+
+// metricsStart is when we started, as we cannot tell how long instances launched before then took to be ready
+var metricsStart = time.Now()
+
+// readyObserved holds the IDs of new instances whose time to ready we have already recorded
+var readyObserved = map[string]bool{}
+
+// metricsGroups holds the names of the ASGs we have set per-ASG gauges for
+var metricsGroups = map[string]bool{}
+
+// groupGauges are the gauges with a value for each ASG, which are removed once it is no longer managed
+var groupGauges = []*prometheus.GaugeVec{
+	metricOldInstances,
+	metricNewInstances,
+	metricDesired,
+	metricOriginalDesired,
+	metricRolloutInProgress,
+}
+
+func init() {
+	prometheus.MustRegister(
+		metricOldInstances,
+		metricNewInstances,
+		metricDesired,
+		metricOriginalDesired,
+		metricRolloutInProgress,
+		metricTerminations,
+		metricDrains,
+		metricAwsErrors,
+		metricDrainDuration,
+		metricTimeToReady,
+	)
+}
+
+// recordAwsError counts an error returned by an AWS API operation, by its AWS error code
+func recordAwsError(operation string, err error) {
+	code := "NonAWSError"
+	if aerr, ok := err.(awserr.Error); ok {
+		code = aerr.Code()
+	}
+	metricAwsErrors.WithLabelValues(operation, code).Inc()
+}
+
+// recordGroupMetrics sets the per-ASG gauges
+func recordGroupMetrics(asg *autoscaling.Group, oldInstances, newInstances []*autoscaling.Instance, state *rolloutState) {
+	name := aws.StringValue(asg.AutoScalingGroupName)
+	metricOldInstances.WithLabelValues(name).Set(float64(len(oldInstances)))
+	metricNewInstances.WithLabelValues(name).Set(float64(len(newInstances)))
+	metricDesired.WithLabelValues(name).Set(float64(aws.Int64Value(asg.DesiredCapacity)))
+	recordRolloutMetrics(name, state)
+}
+
+// recordRolloutMetrics sets the gauges for the rollout of an ASG, which is not in progress if state is nil
+func recordRolloutMetrics(asg string, state *rolloutState) {
+	var originalDesired, inProgress float64
+	if state != nil {
+		originalDesired = float64(state.OriginalDesired)
+		inProgress = 1
+	}
+	metricOriginalDesired.WithLabelValues(asg).Set(originalDesired)
+	metricRolloutInProgress.WithLabelValues(asg).Set(inProgress)
+	metricsGroups[asg] = true
+}
+
+// pruneMetrics forgets everything about ASGs other than those we now manage, and instances no longer
+// in any of them, however they went
+func pruneMetrics(asgs []*autoscaling.Group) {
+	managed := map[string]bool{}
+	instances := map[string]bool{}
+	for _, asg := range asgs {
+		managed[aws.StringValue(asg.AutoScalingGroupName)] = true
+		for _, i := range asg.Instances {
+			instances[aws.StringValue(i.InstanceId)] = true
+		}
+	}
+	for name := range metricsGroups {
+		if managed[name] {
+			continue
+		}
+		for _, g := range groupGauges {
+			g.DeleteLabelValues(name)
+		}
+		delete(metricsGroups, name)
+	}
+	for id := range readyObserved {
+		if !instances[id] {
+			delete(readyObserved, id)
+		}
+	}
+}
+
+// recordDrain counts preparing an old node for termination, and how long it took
+func recordDrain(asg string, start time.Time, err error) {
+	result := drainSucceeded
+	switch err.(type) {
+	case nil:
+	case *skipTerminationError:
+		result = drainSkipped
+	default:
+		result = drainFailed
+	}
+	metricDrains.WithLabelValues(asg, result).Inc()
+	metricDrainDuration.WithLabelValues(asg).Observe(time.Since(start).Seconds())
+}
+
+// recordNodesReady records the time to ready of new instances the first time we find them ready,
+// other than those launched before we started
+func recordNodesReady(asg string, ids []string, instanceMap map[string]*instanceInfo) {
+	now := time.Now()
+	for _, id := range ids {
+		info, ok := instanceMap[id]
+		if !ok || readyObserved[id] || info.launchTime.Before(metricsStart) {
+			continue
+		}
+		readyObserved[id] = true
+		metricTimeToReady.WithLabelValues(asg).Observe(now.Sub(info.launchTime).Seconds())
+	}
+}
+
+// recordTermination counts terminating an old instance, which will not be ready again
+func recordTermination(asg, id string) {
+	metricTerminations.WithLabelValues(asg).Inc()
+	delete(readyObserved, id)
+}
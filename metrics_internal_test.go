@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// testScrape gets the metrics as served over HTTP
+func testScrape(t *testing.T) string {
+	rec := httptest.NewRecorder()
+	newHTTPHandler(newHealth(nil, nil, time.Minute)).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if rec.Code != 200 {
+		t.Fatalf("unexpected status %d getting metrics", rec.Code)
+	}
+	body, err := ioutil.ReadAll(rec.Body)
+	if err != nil {
+		t.Fatalf("unexpected error reading metrics: %v", err)
+	}
+	return string(body)
+}
+
+func TestRecordAwsError(t *testing.T) {
+	tests := []struct {
+		operation string
+		err       error
+		code      string
+	}{
+		{"TestOperationA", awserr.New(autoscaling.ErrCodeResourceContentionFault, "busy", nil), autoscaling.ErrCodeResourceContentionFault},
+		{"TestOperationA", awserr.New(autoscaling.ErrCodeResourceContentionFault, "busy", nil), autoscaling.ErrCodeResourceContentionFault},
+		{"TestOperationB", fmt.Errorf("connection refused"), "NonAWSError"},
+	}
+	for _, tt := range tests {
+		recordAwsError(tt.operation, tt.err)
+	}
+	if count := testutil.ToFloat64(metricAwsErrors.WithLabelValues("TestOperationA", autoscaling.ErrCodeResourceContentionFault)); count != 2 {
+		t.Errorf("mismatched AWS error count for contention, actual %v expected 2", count)
+	}
+	if count := testutil.ToFloat64(metricAwsErrors.WithLabelValues("TestOperationB", "NonAWSError")); count != 1 {
+		t.Errorf("mismatched AWS error count for non-AWS error, actual %v expected 1", count)
+	}
+
+	// errors from the AWS wrappers are counted
+	svc := &mockAsgSvc{err: awserr.New(autoscaling.ErrCodeScalingActivityInProgressFault, "in progress", nil)}
+	before := testutil.ToFloat64(metricAwsErrors.WithLabelValues("SetDesiredCapacity", autoscaling.ErrCodeScalingActivityInProgressFault))
+	if err := setAsgDesired(context.Background(), svc, &autoscaling.Group{AutoScalingGroupName: aws.String("myasg")}, 2); err == nil {
+		t.Fatalf("expected error setting desired")
+	}
+	if count := testutil.ToFloat64(metricAwsErrors.WithLabelValues("SetDesiredCapacity", autoscaling.ErrCodeScalingActivityInProgressFault)); count != before+1 {
+		t.Errorf("mismatched SetDesiredCapacity error count, actual %v expected %v", count, before+1)
+	}
+	before = testutil.ToFloat64(metricAwsErrors.WithLabelValues("UpdateAutoScalingGroup", autoscaling.ErrCodeScalingActivityInProgressFault))
+	if err := setAsgMaxSize(context.Background(), svc, &autoscaling.Group{AutoScalingGroupName: aws.String("myasg")}, 5); err == nil {
+		t.Fatalf("expected error setting max size")
+	}
+	if count := testutil.ToFloat64(metricAwsErrors.WithLabelValues("UpdateAutoScalingGroup", autoscaling.ErrCodeScalingActivityInProgressFault)); count != before+1 {
+		t.Errorf("mismatched UpdateAutoScalingGroup error count, actual %v expected %v", count, before+1)
+	}
+}
+
+func TestRecordGroupMetrics(t *testing.T) {
+	asg := &autoscaling.Group{AutoScalingGroupName: aws.String("metrics-group"), DesiredCapacity: aws.Int64(4)}
+	old := []*autoscaling.Instance{{InstanceId: aws.String("1")}}
+	newI := []*autoscaling.Instance{{InstanceId: aws.String("2")}, {InstanceId: aws.String("3")}}
+	recordGroupMetrics(asg, old, newI, &rolloutState{OriginalDesired: 3})
+	scraped := testScrape(t)
+	for _, line := range []string{
+		`aws_asg_roller_old_instances{asg="metrics-group"} 1`,
+		`aws_asg_roller_new_instances{asg="metrics-group"} 2`,
+		`aws_asg_roller_desired{asg="metrics-group"} 4`,
+		`aws_asg_roller_original_desired{asg="metrics-group"} 3`,
+		`aws_asg_roller_rollout_in_progress{asg="metrics-group"} 1`,
+	} {
+		if !strings.Contains(scraped, line) {
+			t.Errorf("missing %s in metrics", line)
+		}
+	}
+
+	recordRolloutMetrics("metrics-group", nil)
+	if v := testutil.ToFloat64(metricRolloutInProgress.WithLabelValues("metrics-group")); v != 0 {
+		t.Errorf("mismatched rollout in progress after finishing, actual %v expected 0", v)
+	}
+	if v := testutil.ToFloat64(metricOriginalDesired.WithLabelValues("metrics-group")); v != 0 {
+		t.Errorf("mismatched original desired after finishing, actual %v expected 0", v)
+	}
+}
+
+func TestRecordDrain(t *testing.T) {
+	start := time.Now()
+	recordDrain("metrics-drain", start, nil)
+	recordDrain("metrics-drain", start, nil)
+	recordDrain("metrics-drain", start, &skipTerminationError{reason: "timed out"})
+	recordDrain("metrics-drain", start, fmt.Errorf("eviction failed"))
+	tests := []struct {
+		result string
+		count  float64
+	}{
+		{drainSucceeded, 2},
+		{drainSkipped, 1},
+		{drainFailed, 1},
+	}
+	for _, tt := range tests {
+		if count := testutil.ToFloat64(metricDrains.WithLabelValues("metrics-drain", tt.result)); count != tt.count {
+			t.Errorf("%s: mismatched drain count, actual %v expected %v", tt.result, count, tt.count)
+		}
+	}
+	if line := `aws_asg_roller_drain_duration_seconds_count{asg="metrics-drain"} 4`; !strings.Contains(testScrape(t), line) {
+		t.Errorf("missing %s in metrics", line)
+	}
+}
+
+func TestRecordNodesReady(t *testing.T) {
+	instanceMap := map[string]*instanceInfo{
+		"before": {id: "before", launchTime: metricsStart.Add(-time.Hour)},
+		"after":  {id: "after", launchTime: metricsStart},
+	}
+	ids := []string{"before", "after", "missing"}
+	// each instance is only recorded the first time it is ready
+	recordNodesReady("metrics-ready", ids, instanceMap)
+	recordNodesReady("metrics-ready", ids, instanceMap)
+	if line := `aws_asg_roller_node_time_to_ready_seconds_count{asg="metrics-ready"} 1`; !strings.Contains(testScrape(t), line) {
+		t.Errorf("missing %s in metrics", line)
+	}
+	if !readyObserved["after"] || readyObserved["before"] {
+		t.Errorf("mismatched observed instances %v", readyObserved)
+	}
+
+	recordTermination("metrics-ready", "after")
+	if readyObserved["after"] {
+		t.Errorf("terminated instance still observed")
+	}
+	if count := testutil.ToFloat64(metricTerminations.WithLabelValues("metrics-ready")); count != 1 {
+		t.Errorf("mismatched terminations, actual %v expected 1", count)
+	}
+}
+
+func TestPruneMetrics(t *testing.T) {
+	kept := &autoscaling.Group{AutoScalingGroupName: aws.String("metrics-kept"), DesiredCapacity: aws.Int64(2), Instances: []*autoscaling.Instance{{InstanceId: aws.String("running")}}}
+	gone := &autoscaling.Group{AutoScalingGroupName: aws.String("metrics-gone"), DesiredCapacity: aws.Int64(2)}
+	recordGroupMetrics(kept, nil, kept.Instances, nil)
+	recordGroupMetrics(gone, nil, nil, &rolloutState{OriginalDesired: 2})
+	readyObserved["running"] = true
+	readyObserved["vanished"] = true
+
+	pruneMetrics([]*autoscaling.Group{kept})
+	scraped := testScrape(t)
+	if line := `aws_asg_roller_desired{asg="metrics-kept"} 2`; !strings.Contains(scraped, line) {
+		t.Errorf("missing %s in metrics", line)
+	}
+	if strings.Contains(scraped, `asg="metrics-gone"`) {
+		t.Errorf("expected no metrics for an ASG no longer managed")
+	}
+	if !readyObserved["running"] || readyObserved["vanished"] {
+		t.Errorf("mismatched observed instances %v", readyObserved)
+	}
+
+	pruneMetrics(nil)
+	if strings.Contains(testScrape(t), `asg="metrics-kept"`) {
+		t.Errorf("expected no metrics when no ASGs are managed")
+	}
+}
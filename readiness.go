@@ -1,6 +1,120 @@
 package main
 
+import (
+	"context"
+	"fmt"
+)
+
+// readiness checks whether new instances are ready for usage, and prepares old ones for termination.
+// Cancelling ctx stops any waiting, e.g. for a drain to finish.
 type readiness interface {
+	// getReadiness returns whether each instance is ready for usage, and if not, why not
+	getReadiness(ctx context.Context, instances []instanceDescriptor, opts readinessSettings) ([]instanceReadiness, error)
+	prepareTermination(ctx context.Context, instances []instanceDescriptor, opts drainSettings) error
+}
+
+// instanceDescriptor describes an instance to a readiness handler, so it can find whatever runs on it
+type instanceDescriptor struct {
+	id               string
+	hostname         string
+	privateIP        string
+	availabilityZone string
+	tags             map[string]string
+}
+
+// instanceReadiness is whether a single instance is ready for usage, with the reason if it is not
+type instanceReadiness struct {
+	id     string
+	ready  bool
+	reason string
+}
+
+// splitInstances returns the hostname and ID of each instance, in the same order
+func splitInstances(instances []instanceDescriptor) (hostnames []string, ids []string) {
+	hostnames = make([]string, 0, len(instances))
+	ids = make([]string, 0, len(instances))
+	for _, i := range instances {
+		hostnames = append(hostnames, i.hostname)
+		ids = append(ids, i.id)
+	}
+	return hostnames, ids
+}
+
+// legacyReadiness is a readiness handler with the original interface, from before handlers were given a
+// context and instance descriptors, which only counts the unready instances
+type legacyReadiness interface {
 	getUnreadyCount(hostnames []string, ids []string) (int, error)
 	prepareTermination(hostnames []string, ids []string) error
 }
+
+// legacyReadinessAdapter lets a legacyReadiness be used as a readiness handler. As a count does not say
+// which instances are unready, if any are, every instance is reported as unready. A legacy handler cannot
+// be cancelled, so it is not called at all once ctx is done, and knows nothing of the settings.
+type legacyReadinessAdapter struct {
+	legacy legacyReadiness
+}
+
+func newLegacyReadinessAdapter(legacy legacyReadiness) readiness {
+	return &legacyReadinessAdapter{legacy: legacy}
+}
+
+func (l *legacyReadinessAdapter) getReadiness(ctx context.Context, instances []instanceDescriptor, opts readinessSettings) ([]instanceReadiness, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	hostnames, ids := splitInstances(instances)
+	count, err := l.legacy.getUnreadyCount(hostnames, ids)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]instanceReadiness, 0, len(instances))
+	for _, id := range ids {
+		r := instanceReadiness{id: id, ready: count == 0}
+		if !r.ready {
+			r.reason = fmt.Sprintf("%d of %d instances are not ready", count, len(ids))
+		}
+		results = append(results, r)
+	}
+	return results, nil
+}
+
+func (l *legacyReadinessAdapter) prepareTermination(ctx context.Context, instances []instanceDescriptor, opts drainSettings) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	hostnames, ids := splitInstances(instances)
+	return l.legacy.prepareTermination(hostnames, ids)
+}
+
+// the capabilities a readiness handler may have besides checking readiness and preparing termination, each
+// with its own interface
+const (
+	capabilityCordon    = "cordon"     // cordoner
+	capabilityProtect   = "protect"    // protector
+	capabilityCountPods = "count pods" // podCounter
+	capabilityEvents    = "events"     // eventer
+)
+
+// capabilityChecker is implemented by readiness handlers that have the methods of a capability's interface,
+// but may not be able to do it, e.g. a compositeReadiness where none of the handlers it combines can
+type capabilityChecker interface {
+	supports(capability string) bool
+}
+
+// supports returns whether a readiness handler that implements the interface of a capability can actually do it
+func supports(handler readiness, capability string) bool {
+	if c, ok := handler.(capabilityChecker); ok {
+		return c.supports(capability)
+	}
+	return true
+}
+
+// skipTerminationError is returned by prepareTermination when an instance could not be prepared,
+// and should be left for now rather than terminated, without failing the whole adjustment
+type skipTerminationError struct {
+	reason string
+}
+
+func (e *skipTerminationError) Error() string {
+	return e.reason
+}
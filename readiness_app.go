@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const appRequestTimeout = 30 * time.Second // How long to wait for the application to answer a single request
+
+// appReadiness asks the application running on each instance, over HTTP, whether it is ready, and to prepare
+// for termination. Each URL may include {id}, {hostname}, {ip} and {az}, which are replaced for each instance.
+type appReadiness struct {
+	client *http.Client
+	// readyURL is checked with a GET, and the instance is ready if it returns 2xx; empty to treat every instance as ready
+	readyURL string
+	// prepareURL is sent a POST before the instance is terminated, which must return 2xx; empty to do nothing
+	prepareURL string
+	// rollbackURL is sent a POST if a later readiness handler fails to prepare the instance; empty to do nothing
+	rollbackURL string
+}
+
+// getAppReadiness returns the application readiness handler configured by ROLLER_APP_READY_URL,
+// ROLLER_APP_PREPARE_URL and ROLLER_APP_ROLLBACK_URL, nil if none of them are set
+func getAppReadiness() *appReadiness {
+	a := &appReadiness{
+		client:      &http.Client{Timeout: appRequestTimeout},
+		readyURL:    os.Getenv("ROLLER_APP_READY_URL"),
+		prepareURL:  os.Getenv("ROLLER_APP_PREPARE_URL"),
+		rollbackURL: os.Getenv("ROLLER_APP_ROLLBACK_URL"),
+	}
+	if a.readyURL == "" && a.prepareURL == "" && a.rollbackURL == "" {
+		return nil
+	}
+	return a
+}
+
+// instanceURL fills in the details of the instance in a URL
+func instanceURL(url string, i instanceDescriptor) string {
+	return strings.NewReplacer(
+		"{id}", i.id,
+		"{hostname}", i.hostname,
+		"{ip}", i.privateIP,
+		"{az}", i.availabilityZone,
+	).Replace(url)
+}
+
+// call makes a request to the application, returning an error unless it answers with 2xx
+func (a *appReadiness) call(ctx context.Context, method, url string) error {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return fmt.Errorf("Invalid URL %s: %v", url, err)
+	}
+	res, err := a.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("%s %s failed: %v", method, url, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		body, _ := ioutil.ReadAll(io.LimitReader(res.Body, 256))
+		return fmt.Errorf("%s %s returned %s: %s", method, url, res.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+func (a *appReadiness) getReadiness(ctx context.Context, instances []instanceDescriptor, opts readinessSettings) ([]instanceReadiness, error) {
+	results := make([]instanceReadiness, 0, len(instances))
+	for _, i := range instances {
+		r := instanceReadiness{id: i.id, ready: true}
+		if a.readyURL != "" {
+			// an instance that does not answer yet is not ready, rather than an error
+			if err := a.call(ctx, http.MethodGet, instanceURL(a.readyURL, i)); err != nil {
+				if ctx.Err() != nil {
+					return nil, ctx.Err()
+				}
+				r = instanceReadiness{id: i.id, reason: fmt.Sprintf("application: %v", err)}
+			}
+		}
+		results = append(results, r)
+	}
+	return results, nil
+}
+
+func (a *appReadiness) prepareTermination(ctx context.Context, instances []instanceDescriptor, opts drainSettings) error {
+	if a.prepareURL == "" {
+		return nil
+	}
+	for _, i := range instances {
+		if err := a.call(ctx, http.MethodPost, instanceURL(a.prepareURL, i)); err != nil {
+			return fmt.Errorf("Unable to prepare application on instance %s for termination: %v", i.id, err)
+		}
+	}
+	return nil
+}
+
+func (a *appReadiness) rollbackTermination(ctx context.Context, instances []instanceDescriptor) error {
+	if a.rollbackURL == "" {
+		return nil
+	}
+	for _, i := range instances {
+		if err := a.call(ctx, http.MethodPost, instanceURL(a.rollbackURL, i)); err != nil {
+			return fmt.Errorf("Unable to roll back preparing application on instance %s for termination: %v", i.id, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestAppReadiness(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		requests []string
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, r.Method+" "+r.URL.RequestURI())
+		mu.Unlock()
+		if r.URL.Query().Get("ip") == "10.0.0.2" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = w.Write([]byte("warming up\n"))
+			return
+		}
+	}))
+	defer server.Close()
+
+	a := &appReadiness{
+		client:      server.Client(),
+		readyURL:    server.URL + "/ready?ip={ip}&az={az}",
+		prepareURL:  server.URL + "/prepare/{id}?host={hostname}",
+		rollbackURL: server.URL + "/rollback/{id}",
+	}
+	instances := []instanceDescriptor{
+		{id: "i-1", hostname: "ip-1", privateIP: "10.0.0.1", availabilityZone: "us-east-1a"},
+		{id: "i-2", hostname: "ip-2", privateIP: "10.0.0.2", availabilityZone: "us-east-1b"},
+	}
+	results, err := a.getReadiness(context.Background(), instances, readinessSettings{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(results) != 2 || !results[0].ready || results[1].ready || !strings.Contains(results[1].reason, "503 Service Unavailable: warming up") {
+		t.Errorf("mismatched results %+v", results)
+	}
+	if err := a.prepareTermination(context.Background(), instances[:1], drainSettings{}); err != nil {
+		t.Errorf("unexpected error preparing: %v", err)
+	}
+	if err := a.prepareTermination(context.Background(), instances[1:], drainSettings{}); err != nil {
+		t.Errorf("unexpected error preparing: %v", err)
+	}
+	if err := a.rollbackTermination(context.Background(), instances[:1]); err != nil {
+		t.Errorf("unexpected error rolling back: %v", err)
+	}
+	expected := []string{
+		"GET /ready?ip=10.0.0.1&az=us-east-1a",
+		"GET /ready?ip=10.0.0.2&az=us-east-1b",
+		"POST /prepare/i-1?host=ip-1",
+		"POST /prepare/i-2?host=ip-2",
+		"POST /rollback/i-1",
+	}
+	if !testStringEq(requests, expected) {
+		t.Errorf("mismatched requests, actual %v expected %v", requests, expected)
+	}
+
+	// a failure to prepare fails the termination
+	a.prepareURL = server.URL + "/prepare?ip={ip}"
+	if err := a.prepareTermination(context.Background(), instances[1:], drainSettings{}); err == nil || !strings.Contains(err.Error(), "instance i-2") {
+		t.Errorf("mismatched error preparing, actual %v", err)
+	}
+
+	// without URLs, every instance is ready, and there is nothing to do
+	a = &appReadiness{client: server.Client()}
+	before := len(requests)
+	results, err = a.getReadiness(context.Background(), instances, readinessSettings{})
+	if err != nil || len(results) != 2 || !results[0].ready || !results[1].ready {
+		t.Errorf("expected every instance to be ready, actual %+v, %v", results, err)
+	}
+	if err := a.prepareTermination(context.Background(), instances, drainSettings{}); err != nil {
+		t.Errorf("unexpected error preparing: %v", err)
+	}
+	if len(requests) != before {
+		t.Errorf("expected no requests without URLs, actual %v", requests[before:])
+	}
+}
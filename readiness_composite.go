@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+const (
+	readinessKubernetes = "kubernetes"
+	readinessApp        = "app"
+)
+
+// rollbacker is implemented by readiness handlers that can undo prepareTermination, for when a
+// later handler fails to prepare the same instances
+type rollbacker interface {
+	rollbackTermination(ctx context.Context, instances []instanceDescriptor) error
+}
+
+// readinessStep is a single named readiness handler in a compositeReadiness
+type readinessStep struct {
+	name    string
+	handler readiness
+}
+
+// compositeReadiness runs several readiness handlers in order. An instance is only ready if every
+// handler says it is, and is only prepared for termination once every handler has prepared it.
+// The other things a handler may be able to do, e.g. cordon, are passed on to every handler that can.
+type compositeReadiness struct {
+	steps []readinessStep
+}
+
+// getReadinessHandler returns the readiness handlers named in ROLLER_READINESS_HANDLERS, in order, combined if
+// there is more than one. kube is the kubernetes handler, nil if there is no kubernetes connection. By default,
+// uses the kubernetes handler if there is one, then the application handler if it is configured.
+func getReadinessHandler(kube readiness) (readiness, error) {
+	app := getAppReadiness()
+	names := splitList(os.Getenv("ROLLER_READINESS_HANDLERS"))
+	if len(names) == 0 {
+		if kube != nil {
+			names = append(names, readinessKubernetes)
+		}
+		if app != nil {
+			names = append(names, readinessApp)
+		}
+	}
+	steps := make([]readinessStep, 0, len(names))
+	seen := map[string]bool{}
+	for _, name := range names {
+		if seen[name] {
+			return nil, fmt.Errorf("ROLLER_READINESS_HANDLERS lists %s more than once", name)
+		}
+		seen[name] = true
+		var handler readiness
+		switch name {
+		case readinessKubernetes:
+			if kube == nil {
+				return nil, fmt.Errorf("ROLLER_READINESS_HANDLERS includes %s, but there is no kubernetes connection", name)
+			}
+			handler = kube
+		case readinessApp:
+			if app == nil {
+				return nil, fmt.Errorf("ROLLER_READINESS_HANDLERS includes %s, but none of ROLLER_APP_READY_URL, ROLLER_APP_PREPARE_URL or ROLLER_APP_ROLLBACK_URL is set", name)
+			}
+			handler = app
+		default:
+			return nil, fmt.Errorf("unknown readiness handler %s in ROLLER_READINESS_HANDLERS", name)
+		}
+		steps = append(steps, readinessStep{name: name, handler: handler})
+	}
+	switch len(steps) {
+	case 0:
+		return nil, nil
+	case 1:
+		return steps[0].handler, nil
+	default:
+		return &compositeReadiness{steps: steps}, nil
+	}
+}
+
+func (c *compositeReadiness) getReadiness(ctx context.Context, instances []instanceDescriptor, opts readinessSettings) ([]instanceReadiness, error) {
+	_, ids := splitInstances(instances)
+	reasons := map[string][]string{}
+	for _, step := range c.steps {
+		results, err := step.handler.getReadiness(ctx, instances, opts)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", step.name, err)
+		}
+		for _, r := range unreadyInstances(ids, results) {
+			reasons[r.id] = append(reasons[r.id], r.reason)
+		}
+	}
+	results := make([]instanceReadiness, 0, len(instances))
+	for _, i := range instances {
+		r := instanceReadiness{id: i.id, ready: len(reasons[i.id]) == 0}
+		if !r.ready {
+			r.reason = strings.Join(reasons[i.id], "; ")
+		}
+		results = append(results, r)
+	}
+	return results, nil
+}
+
+// prepareTermination prepares the instances with each handler in turn. If one fails, including asking to
+// skip the instances for now, those before it are rolled back, latest first, and its error is returned.
+func (c *compositeReadiness) prepareTermination(ctx context.Context, instances []instanceDescriptor, opts drainSettings) error {
+	for i, step := range c.steps {
+		if err := step.handler.prepareTermination(ctx, instances, opts); err != nil {
+			c.rollback(c.steps[:i], instances)
+			return err
+		}
+	}
+	return nil
+}
+
+// rollback undoes prepareTermination for each of the steps that can, latest first. It does not take the
+// context of the adjustment, as it should still be undone if we are shutting down.
+func (c *compositeReadiness) rollback(steps []readinessStep, instances []instanceDescriptor) {
+	_, ids := splitInstances(instances)
+	for i := len(steps) - 1; i >= 0; i-- {
+		r, ok := steps[i].handler.(rollbacker)
+		if !ok {
+			continue
+		}
+		if err := r.rollbackTermination(context.Background(), instances); err != nil {
+			log.Printf("Unable to roll back %s readiness handler preparing %v for termination: %v", steps[i].name, ids, err)
+		}
+	}
+}
+
+// supports returns whether any of the handlers can do what the capability describes. The composite has the
+// methods of every capability, so callers check this before relying on one.
+func (c *compositeReadiness) supports(capability string) bool {
+	for _, step := range c.steps {
+		var ok bool
+		switch capability {
+		case capabilityCordon:
+			_, ok = step.handler.(cordoner)
+		case capabilityProtect:
+			_, ok = step.handler.(protector)
+		case capabilityCountPods:
+			_, ok = step.handler.(podCounter)
+		case capabilityEvents:
+			_, ok = step.handler.(eventer)
+		}
+		if ok && supports(step.handler, capability) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *compositeReadiness) checkHealth() error {
+	for _, step := range c.steps {
+		if h, ok := step.handler.(healthChecker); ok {
+			if err := h.checkHealth(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (c *compositeReadiness) cordon(hostnames []string, ids []string, taint bool) error {
+	cordoned := false
+	for _, step := range c.steps {
+		if h, ok := step.handler.(cordoner); ok {
+			if err := h.cordon(hostnames, ids, taint); err != nil {
+				return err
+			}
+			cordoned = true
+		}
+	}
+	if !cordoned {
+		return fmt.Errorf("none of the readiness handlers can cordon")
+	}
+	return nil
+}
+
+func (c *compositeReadiness) uncordon(hostnames []string, ids []string) error {
+	for _, step := range c.steps {
+		if h, ok := step.handler.(cordoner); ok {
+			if err := h.uncordon(hostnames, ids); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (c *compositeReadiness) protect(hostnames []string, ids []string) error {
+	protected := false
+	for _, step := range c.steps {
+		if h, ok := step.handler.(protector); ok {
+			if err := h.protect(hostnames, ids); err != nil {
+				return err
+			}
+			protected = true
+		}
+	}
+	if !protected {
+		return fmt.Errorf("none of the readiness handlers can protect nodes from scale down")
+	}
+	return nil
+}
+
+func (c *compositeReadiness) unprotect(hostnames []string, ids []string) error {
+	for _, step := range c.steps {
+		if h, ok := step.handler.(protector); ok {
+			if err := h.unprotect(hostnames, ids); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// getPodCounts counts with the first handler that can
+func (c *compositeReadiness) getPodCounts(hostnames []string, ids []string) (map[string]int, error) {
+	for _, step := range c.steps {
+		if h, ok := step.handler.(podCounter); ok {
+			return h.getPodCounts(hostnames, ids)
+		}
+	}
+	return nil, fmt.Errorf("none of the readiness handlers can count pods")
+}
+
+func (c *compositeReadiness) rolloutEvent(asg string, eventType, reason, message string) {
+	for _, step := range c.steps {
+		if h, ok := step.handler.(eventer); ok {
+			h.rolloutEvent(asg, eventType, reason, message)
+		}
+	}
+}
+
+func (c *compositeReadiness) instanceEvent(hostname string, id string, eventType, reason, message string) {
+	for _, step := range c.steps {
+		if h, ok := step.handler.(eventer); ok {
+			h.instanceEvent(hostname, id, eventType, reason, message)
+		}
+	}
+}
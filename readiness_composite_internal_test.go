@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+// stepReadyHandler is one of several readiness handlers, recording what it is asked to do in a shared log
+type stepReadyHandler struct {
+	name        string
+	log         *[]string
+	unready     map[string]string
+	unreadyErr  error
+	prepareErr  error
+	rollbackErr error
+}
+
+func (s *stepReadyHandler) getReadiness(ctx context.Context, instances []instanceDescriptor, opts readinessSettings) ([]instanceReadiness, error) {
+	if s.unreadyErr != nil {
+		return nil, s.unreadyErr
+	}
+	results := make([]instanceReadiness, 0, len(instances))
+	for _, i := range instances {
+		reason, unready := s.unready[i.id]
+		results = append(results, instanceReadiness{id: i.id, ready: !unready, reason: reason})
+	}
+	return results, nil
+}
+func (s *stepReadyHandler) prepareTermination(ctx context.Context, instances []instanceDescriptor, opts drainSettings) error {
+	*s.log = append(*s.log, "prepare "+s.name)
+	return s.prepareErr
+}
+func (s *stepReadyHandler) rollbackTermination(ctx context.Context, instances []instanceDescriptor) error {
+	*s.log = append(*s.log, "rollback "+s.name)
+	return s.rollbackErr
+}
+
+// cordoningStepReadyHandler can also cordon
+type cordoningStepReadyHandler struct {
+	stepReadyHandler
+}
+
+func (c *cordoningStepReadyHandler) cordon(hostnames []string, ids []string, taint bool) error {
+	*c.log = append(*c.log, "cordon "+c.name)
+	return nil
+}
+func (c *cordoningStepReadyHandler) uncordon(hostnames []string, ids []string) error {
+	*c.log = append(*c.log, "uncordon "+c.name)
+	return nil
+}
+
+func TestGetReadinessHandler(t *testing.T) {
+	kube := &kubernetesReadiness{}
+	tests := []struct {
+		desc     string
+		handlers string
+		appURL   string
+		kube     readiness
+		want     []string
+		err      string
+	}{
+		{"nothing", "", "", nil, nil, ""},
+		{"kubernetes by default", "", "", kube, []string{readinessKubernetes}, ""},
+		{"app by default", "", "http://{ip}/ready", nil, []string{readinessApp}, ""},
+		{"kubernetes then app by default", "", "http://{ip}/ready", kube, []string{readinessKubernetes, readinessApp}, ""},
+		{"in order given", "app,kubernetes", "http://{ip}/ready", kube, []string{readinessApp, readinessKubernetes}, ""},
+		{"only those given", "kubernetes", "http://{ip}/ready", kube, []string{readinessKubernetes}, ""},
+		{"kubernetes without connection", "kubernetes", "", nil, nil, "no kubernetes connection"},
+		{"app without URLs", "kubernetes app", "", kube, nil, "ROLLER_APP_READY_URL"},
+		{"duplicate", "kubernetes,kubernetes", "", kube, nil, "more than once"},
+		{"unknown", "kubernetes,elb", "", kube, nil, "unknown readiness handler elb"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			os.Setenv("ROLLER_READINESS_HANDLERS", tt.handlers)
+			os.Setenv("ROLLER_APP_READY_URL", tt.appURL)
+			defer os.Unsetenv("ROLLER_READINESS_HANDLERS")
+			defer os.Unsetenv("ROLLER_APP_READY_URL")
+			handler, err := getReadinessHandler(tt.kube)
+			switch {
+			case err != nil && tt.err == "":
+				t.Fatalf("unexpected error: %v", err)
+			case err == nil && tt.err != "":
+				t.Fatalf("expected error containing %q", tt.err)
+			case err != nil && !strings.Contains(err.Error(), tt.err):
+				t.Fatalf("mismatched error, actual %v expected to contain %q", err, tt.err)
+			case err != nil:
+				return
+			}
+			names := make([]string, 0)
+			switch h := handler.(type) {
+			case nil:
+				names = nil
+			case *compositeReadiness:
+				for _, step := range h.steps {
+					names = append(names, step.name)
+				}
+			case *kubernetesReadiness:
+				names = append(names, readinessKubernetes)
+			case *appReadiness:
+				names = append(names, readinessApp)
+			}
+			if !testStringEq(names, tt.want) {
+				t.Errorf("mismatched handlers, actual %v expected %v", names, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompositeGetReadiness(t *testing.T) {
+	var calls []string
+	c := &compositeReadiness{steps: []readinessStep{
+		{"first", &stepReadyHandler{name: "first", log: &calls, unready: map[string]string{"i-2": "booting"}}},
+		{"second", &stepReadyHandler{name: "second", log: &calls, unready: map[string]string{"i-2": "warming up", "i-3": "no traffic"}}},
+	}}
+	results, err := c.getReadiness(context.Background(), testInstances([]string{"i-1", "i-2", "i-3"}), readinessSettings{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	actual := make([]string, 0)
+	for _, r := range results {
+		actual = append(actual, fmt.Sprintf("%s=%v %s", r.id, r.ready, r.reason))
+	}
+	// only ready if every handler says so, with the reasons of each that does not
+	expected := []string{"i-1=true ", "i-2=false booting; warming up", "i-3=false no traffic"}
+	if !testStringEq(actual, expected) {
+		t.Errorf("mismatched results, actual %v expected %v", actual, expected)
+	}
+
+	c.steps[1].handler.(*stepReadyHandler).unreadyErr = fmt.Errorf("unreachable")
+	if _, err := c.getReadiness(context.Background(), testInstances([]string{"i-1"}), readinessSettings{}); err == nil || !strings.Contains(err.Error(), "second: unreachable") {
+		t.Errorf("mismatched error, actual %v", err)
+	}
+}
+
+func TestCompositePrepareTermination(t *testing.T) {
+	skip := &skipTerminationError{reason: "busy"}
+	tests := []struct {
+		desc   string
+		errs   []error
+		err    error
+		calls  []string
+		noRoll bool
+	}{
+		{"all succeed", []error{nil, nil, nil}, nil, []string{"prepare first", "prepare second", "prepare third"}, false},
+		{"last fails", []error{nil, nil, fmt.Errorf("failed")}, fmt.Errorf("failed"), []string{"prepare first", "prepare second", "prepare third", "rollback second", "rollback first"}, false},
+		{"middle skips", []error{nil, skip, nil}, skip, []string{"prepare first", "prepare second", "rollback first"}, false},
+		{"first fails", []error{fmt.Errorf("failed"), nil, nil}, fmt.Errorf("failed"), []string{"prepare first"}, false},
+		// a failing rollback is only logged
+		{"rollback fails", []error{nil, fmt.Errorf("failed"), nil}, fmt.Errorf("failed"), []string{"prepare first", "prepare second", "rollback first"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			var calls []string
+			c := &compositeReadiness{}
+			for i, name := range []string{"first", "second", "third"} {
+				h := &stepReadyHandler{name: name, log: &calls, prepareErr: tt.errs[i]}
+				if tt.noRoll {
+					h.rollbackErr = fmt.Errorf("unable to roll back")
+				}
+				c.steps = append(c.steps, readinessStep{name: name, handler: h})
+			}
+			err := c.prepareTermination(context.Background(), testInstances([]string{"i-1"}), drainSettings{})
+			if fmt.Sprint(err) != fmt.Sprint(tt.err) {
+				t.Errorf("mismatched error, actual %v expected %v", err, tt.err)
+			}
+			if _, ok := tt.err.(*skipTerminationError); ok && err != tt.err {
+				t.Errorf("expected the skip to be passed on, actual %v", err)
+			}
+			if !testStringEq(calls, tt.calls) {
+				t.Errorf("mismatched calls, actual %v expected %v", calls, tt.calls)
+			}
+		})
+	}
+}
+
+func TestCompositeCapabilities(t *testing.T) {
+	var calls []string
+	c := &compositeReadiness{steps: []readinessStep{
+		{"first", &cordoningStepReadyHandler{stepReadyHandler{name: "first", log: &calls}}},
+		{"second", &stepReadyHandler{name: "second", log: &calls}},
+		{"third", &cordoningStepReadyHandler{stepReadyHandler{name: "third", log: &calls}}},
+	}}
+	if err := c.cordon([]string{"host1"}, []string{"i-1"}, false); err != nil {
+		t.Errorf("unexpected error cordoning: %v", err)
+	}
+	if err := c.uncordon([]string{"host1"}, []string{"i-1"}); err != nil {
+		t.Errorf("unexpected error uncordoning: %v", err)
+	}
+	if expected := []string{"cordon first", "cordon third", "uncordon first", "uncordon third"}; !testStringEq(calls, expected) {
+		t.Errorf("mismatched calls, actual %v expected %v", calls, expected)
+	}
+
+	if !supports(c, capabilityCordon) || supports(c, capabilityProtect) || supports(c, capabilityCountPods) || supports(c, capabilityEvents) {
+		t.Errorf("expected to only support cordoning, as the first and third handlers can")
+	}
+
+	// none of them can
+	c = &compositeReadiness{steps: []readinessStep{{"only", &stepReadyHandler{name: "only", log: &calls}}}}
+	for _, capability := range []string{capabilityCordon, capabilityProtect, capabilityCountPods, capabilityEvents} {
+		if supports(c, capability) {
+			t.Errorf("expected not to support %s, as none of the handlers can", capability)
+		}
+	}
+	// so callers carry on without, as they would without a kubernetes connection
+	asg := testGroup("myasg", 2, 5, []string{"1"}, nil, nil)
+	cordonOldNodes("myasg", asg.Instances, nil, c, false)
+	protectNewNodes("myasg", asg.Instances, nil, c)
+	if err := uncordonNodes(asg, nil, c); err != nil {
+		t.Errorf("unexpected error uncordoning without a handler that can: %v", err)
+	}
+	if err := unprotectNodes(asg, nil, c); err != nil {
+		t.Errorf("unexpected error unprotecting without a handler that can: %v", err)
+	}
+	if _, err := newTerminationOrder(orderFewestPods, nil, c); err == nil || !strings.Contains(err.Error(), "requires a kubernetes connection") {
+		t.Errorf("mismatched error getting termination order, actual %v", err)
+	}
+	if err := c.cordon([]string{"host1"}, []string{"i-1"}, false); err == nil {
+		t.Errorf("expected error cordoning without a handler that can")
+	}
+	if err := c.protect([]string{"host1"}, []string{"i-1"}); err == nil {
+		t.Errorf("expected error protecting without a handler that can")
+	}
+	if _, err := c.getPodCounts([]string{"host1"}, []string{"i-1"}); err == nil {
+		t.Errorf("expected error counting pods without a handler that can")
+	}
+	if err := c.checkHealth(); err != nil {
+		t.Errorf("unexpected error checking health: %v", err)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+// legacyReadyHandler is a readiness handler with the original signature, from before contexts and instance descriptors
+type legacyReadyHandler struct {
+	unreadyCount int
+	unreadyError error
+	checked      []string
+	prepared     []string
+}
+
+func (l *legacyReadyHandler) getUnreadyCount(hostnames []string, ids []string) (int, error) {
+	for i, id := range ids {
+		l.checked = append(l.checked, fmt.Sprintf("%s=%s", id, hostnames[i]))
+	}
+	return l.unreadyCount, l.unreadyError
+}
+func (l *legacyReadyHandler) prepareTermination(hostnames []string, ids []string) error {
+	for i, id := range ids {
+		l.prepared = append(l.prepared, fmt.Sprintf("%s=%s", id, hostnames[i]))
+	}
+	return nil
+}
+
+func TestLegacyReadinessAdapter(t *testing.T) {
+	tests := []struct {
+		desc         string
+		unreadyCount int
+		unreadyError error
+		unready      []string
+		shouldError  bool
+	}{
+		{"all ready", 0, nil, []string{}, false},
+		{"some unready", 1, nil, []string{"i-1=1 of 2 instances are not ready", "i-2=1 of 2 instances are not ready"}, false},
+		{"error", 0, fmt.Errorf("unreachable"), nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			legacy := &legacyReadyHandler{unreadyCount: tt.unreadyCount, unreadyError: tt.unreadyError}
+			handler := newLegacyReadinessAdapter(legacy)
+			instances := testInstances([]string{"i-1", "i-2"}, "host1", "host2")
+			results, err := handler.getReadiness(context.Background(), instances, readinessSettings{})
+			switch {
+			case err != nil && !tt.shouldError:
+				t.Fatalf("unexpected error: %v", err)
+			case err == nil && tt.shouldError:
+				t.Fatalf("expected error")
+			case err != nil:
+				return
+			}
+			if !testStringEq(legacy.checked, []string{"i-1=host1", "i-2=host2"}) {
+				t.Errorf("mismatched instances checked, actual %v", legacy.checked)
+			}
+			unready := make([]string, 0)
+			for _, r := range unreadyInstances([]string{"i-1", "i-2"}, results) {
+				unready = append(unready, fmt.Sprintf("%s=%s", r.id, r.reason))
+			}
+			if !testStringEq(unready, tt.unready) {
+				t.Errorf("mismatched unready instances, actual %v expected %v", unready, tt.unready)
+			}
+			if err := handler.prepareTermination(context.Background(), instances[:1], drainSettings{}); err != nil {
+				t.Errorf("unexpected error preparing termination: %v", err)
+			}
+			if !testStringEq(legacy.prepared, []string{"i-1=host1"}) {
+				t.Errorf("mismatched instances prepared, actual %v", legacy.prepared)
+			}
+		})
+	}
+}
+
+func TestLegacyReadinessAdapterCancelled(t *testing.T) {
+	legacy := &legacyReadyHandler{}
+	handler := newLegacyReadinessAdapter(legacy)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	instances := testInstances([]string{"i-1"}, "host1")
+	// the legacy handler cannot be cancelled, so it is not called at all
+	if _, err := handler.getReadiness(ctx, instances, readinessSettings{}); err != context.Canceled {
+		t.Errorf("mismatched error checking readiness, actual %v expected %v", err, context.Canceled)
+	}
+	if err := handler.prepareTermination(ctx, instances, drainSettings{}); err != context.Canceled {
+		t.Errorf("mismatched error preparing termination, actual %v expected %v", err, context.Canceled)
+	}
+	if len(legacy.checked) != 0 || len(legacy.prepared) != 0 {
+		t.Errorf("expected the legacy handler not to be called, actual checked %v prepared %v", legacy.checked, legacy.prepared)
+	}
+}
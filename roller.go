@@ -1,7 +1,11 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"log"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/autoscaling"
@@ -15,26 +19,40 @@ const (
 )
 
 // adjust runs a single adjustment in the loop to update an ASG in a rolling fashion to latest launch config
-func adjust(asgList []string, ec2Svc ec2iface.EC2API, asgSvc autoscalingiface.AutoScalingAPI, readinessHandler readiness, originalDesired map[string]int64) error {
+// states holds the in-progress rollout state for each ASG, and is updated in place; every change is persisted to store.
+// Cancelling ctx stops waiting for drains and AWS calls; as state is saved before each change, the next adjust
+// picks up where this one stopped.
+func adjust(ctx context.Context, asgList []string, ec2Svc ec2iface.EC2API, asgSvc autoscalingiface.AutoScalingAPI, readinessHandler readiness, states map[string]*rolloutState, store stateStore, config *rollerConfig) error {
+	// describing no ASGs by name would describe all of them
+	if len(asgList) == 0 {
+		pruneMetrics(nil)
+		return nil
+	}
 	// get information on all of the groups
-	asgs, err := awsDescribeGroups(asgSvc, asgList)
+	asgs, err := awsDescribeGroups(ctx, asgSvc, asgList)
 	if err != nil {
 		return fmt.Errorf("Unexpected error describing ASGs, skipping: %v", err)
 	}
+	pruneMetrics(asgs)
 	asgMap := map[string]*autoscaling.Group{}
+	oldMap := map[string][]*autoscaling.Instance{}
+	newMap := map[string][]*autoscaling.Instance{}
 	// get information on all of the ec2 instances
 	instances := make([]*autoscaling.Instance, 0)
 	for _, asg := range asgs {
-		oldI, newI, err := groupInstances(asg, ec2Svc)
+		oldI, newI, err := groupInstances(ctx, asg, ec2Svc)
 		if err != nil {
 			return fmt.Errorf("unable to group instances into new and old: %v", err)
 		}
-		// if there are no outdated instances skip updating
-		if len(oldI) == 0 {
+		recordGroupMetrics(asg, oldI, newI, states[*asg.AutoScalingGroupName])
+		// if there are no outdated instances and no rollout to finish, skip updating
+		if len(oldI) == 0 && states[*asg.AutoScalingGroupName] == nil {
 			continue
 		}
 
 		asgMap[*asg.AutoScalingGroupName] = asg
+		oldMap[*asg.AutoScalingGroupName] = oldI
+		newMap[*asg.AutoScalingGroupName] = newI
 		instances = append(instances, oldI...)
 		instances = append(instances, newI...)
 	}
@@ -43,97 +61,359 @@ func adjust(asgList []string, ec2Svc ec2iface.EC2API, asgSvc autoscalingiface.Au
 		return nil
 	}
 	ids := mapInstancesIds(instances)
-	hostnames, err := awsGetHostnames(ec2Svc, ids)
+	instanceMap, err := awsGetInstanceInfo(ctx, ec2Svc, ids)
 	if err != nil {
-		return fmt.Errorf("Unable to get aws hostnames for ids %v: %v", ids, err)
-	}
-	hostnameMap := map[string]string{}
-	for i, id := range ids {
-		hostnameMap[id] = hostnames[i]
+		return fmt.Errorf("Unable to describe instances %v: %v", ids, err)
 	}
 	newDesired := map[string]int64{}
-	newTerminate := map[string]string{}
+	newTerminate := map[string][]string{}
 	newOriginalDesired := map[string]int64{}
-	errors := map[*string]error{}
+	settingsMap := map[string]asgSettings{}
+	// problems with a single ASG do not stop us adjusting the others, but are reported at the end
+	asgErrors := make([]string, 0)
 
 	// keep keyed references to the ASGs
 	for _, asg := range asgMap {
-		newDesiredA, newOriginalA, terminateID, err := calculateAdjustment(asg, ec2Svc, hostnameMap, readinessHandler, originalDesired[*asg.AutoScalingGroupName])
+		var originalDesired int64
+		if state, ok := states[*asg.AutoScalingGroupName]; ok {
+			originalDesired = state.OriginalDesired
+		}
+		settings, err := config.settingsFor(asg)
+		if err != nil {
+			asgErrors = append(asgErrors, fmt.Sprintf("skipping ASG %s: %v", *asg.AutoScalingGroupName, err))
+			continue
+		}
+		settingsMap[*asg.AutoScalingGroupName] = settings
+		if state := states[*asg.AutoScalingGroupName]; state != nil && settings.reconcileDesired {
+			originalDesired = reconcileOriginalDesired(asg, state)
+		}
+		newDesiredA, newOriginalA, terminateIDs, err := calculateAdjustment(ctx, asg, ec2Svc, instanceMap, readinessHandler, originalDesired, settings)
 		newDesired[*asg.AutoScalingGroupName] = newDesiredA
 		newOriginalDesired[*asg.AutoScalingGroupName] = newOriginalA
-		if terminateID != "" {
-			newTerminate[*asg.AutoScalingGroupName] = terminateID
+		if len(terminateIDs) > 0 {
+			newTerminate[*asg.AutoScalingGroupName] = terminateIDs
+		}
+		if err != nil {
+			asgErrors = append(asgErrors, fmt.Sprintf("error calculating adjustment for ASG %s: %v", *asg.AutoScalingGroupName, err))
 		}
-		errors[asg.AutoScalingGroupName] = err
 	}
-	// adjust original desired
+	// make the changes, one ASG at a time. The rollout state is persisted before we change anything
+	// in the ASG when starting, and only removed once we have restored it when finishing, so that
+	// a restart at any point can pick up where we left off
 	for asg, desired := range newOriginalDesired {
-		originalDesired[asg] = desired
-	}
-	// adjust current desired
-	for asg, desired := range newDesired {
-		err = setAsgDesired(asgSvc, asgMap[asg], desired)
+		group := asgMap[asg]
+		state := states[asg]
+		switch {
+		case desired != 0 && state == nil:
+			// rollout starting
+			target, err := targetVersion(ctx, group, ec2Svc)
+			if err != nil {
+				return fmt.Errorf("Error getting target version for ASG %s: %v", asg, err)
+			}
+			state = &rolloutState{
+				OriginalDesired: desired,
+				StartTime:       time.Now(),
+				TargetVersion:   target,
+				// anything already suspended is not ours to resume
+				SuspendedProcesses: notSuspended(group, settingsMap[asg].suspendProcesses),
+			}
+			if settingsMap[asg].reconcileDesired {
+				state.LastDesired = aws.Int64Value(group.DesiredCapacity)
+			}
+			if exceedsMaxSize(group, newDesired[asg]) {
+				state.OriginalMaxSize = aws.Int64Value(group.MaxSize)
+			}
+			if err := store.save(ctx, asg, state); err != nil {
+				return fmt.Errorf("Error saving rollout state for ASG %s: %v", asg, err)
+			}
+			states[asg] = state
+			recordRolloutEvent(readinessHandler, asg, eventNormal, reasonRolloutStarted, fmt.Sprintf("Started rolling ASG %s to %s, original desired %d", asg, target, desired))
+			if settings := settingsMap[asg]; settings.cordonOldNodes {
+				cordonOldNodes(asg, oldMap[asg], instanceMap, readinessHandler, settings.cordonTaint)
+			}
+		case desired != 0:
+			updated := *state
+			updated.OriginalDesired = desired
+			if !updated.equal(state) {
+				if err := store.save(ctx, asg, &updated); err != nil {
+					return fmt.Errorf("Error saving rollout state for ASG %s: %v", asg, err)
+				}
+				states[asg] = &updated
+				state = &updated
+			}
+		}
+		recordRolloutMetrics(asg, states[asg])
+		if desired != 0 {
+			// suspend scaling processes at the start, or if we failed to last time
+			if missing := notSuspended(group, state.SuspendedProcesses); len(missing) > 0 {
+				log.Printf("Suspending processes %v of ASG %s", missing, asg)
+				if err := awsSuspendProcesses(ctx, asgSvc, asg, missing); err != nil {
+					return err
+				}
+			}
+			if settingsMap[asg].protectNewNodes {
+				protectNewNodes(asg, newMap[asg], instanceMap, readinessHandler)
+			}
+		}
+		// make room to surge if we need to; calculateAdjustment only asks for more than MaxSize if allowed
+		if exceedsMaxSize(group, newDesired[asg]) {
+			log.Printf("Raising MaxSize of ASG %s from %d to %d to make room to surge", asg, aws.Int64Value(group.MaxSize), newDesired[asg])
+			if err := setAsgMaxSize(ctx, asgSvc, group, newDesired[asg]); err != nil {
+				return fmt.Errorf("Error setting max size to %d for ASG %s: %v", newDesired[asg], asg, err)
+			}
+		}
+		// adjust current desired
+		err = setAsgDesired(ctx, asgSvc, group, newDesired[asg])
 		if err != nil {
-			return fmt.Errorf("Error setting desired to %d for ASG %s: %v", desired, asg, err)
+			return fmt.Errorf("Error setting desired to %d for ASG %s: %v", newDesired[asg], asg, err)
+		}
+		// remember what we set it to, so we can tell if anything else changes it
+		if desired != 0 && settingsMap[asg].reconcileDesired && state.LastDesired != newDesired[asg] {
+			updated := *state
+			updated.LastDesired = newDesired[asg]
+			if err := store.save(ctx, asg, &updated); err != nil {
+				return fmt.Errorf("Error saving rollout state for ASG %s: %v", asg, err)
+			}
+			states[asg] = &updated
+		}
+		if desired == 0 && state != nil {
+			// rollout complete, or aborted by going back to the old launch configuration or template,
+			// in which case any old nodes we cordoned are still there
+			if settingsMap[asg].cordonOldNodes {
+				if err := uncordonNodes(group, instanceMap, readinessHandler); err != nil {
+					return fmt.Errorf("Error uncordoning nodes of ASG %s: %v", asg, err)
+				}
+			}
+			if settingsMap[asg].protectNewNodes {
+				if err := unprotectNodes(group, instanceMap, readinessHandler); err != nil {
+					return fmt.Errorf("Error removing scale down protection from nodes of ASG %s: %v", asg, err)
+				}
+			}
+			if len(state.SuspendedProcesses) > 0 {
+				log.Printf("Resuming processes %v of ASG %s", state.SuspendedProcesses, asg)
+				if err := awsResumeProcesses(ctx, asgSvc, asg, state.SuspendedProcesses); err != nil {
+					return err
+				}
+			}
+			if state.OriginalMaxSize > 0 && state.OriginalMaxSize != aws.Int64Value(group.MaxSize) {
+				log.Printf("Restoring MaxSize of ASG %s to %d", asg, state.OriginalMaxSize)
+				if err := setAsgMaxSize(ctx, asgSvc, group, state.OriginalMaxSize); err != nil {
+					return fmt.Errorf("Error restoring max size to %d for ASG %s: %v", state.OriginalMaxSize, asg, err)
+				}
+			}
+			if err := store.remove(ctx, asg); err != nil {
+				return fmt.Errorf("Error removing rollout state for ASG %s: %v", asg, err)
+			}
+			delete(states, asg)
+			recordRolloutMetrics(asg, nil)
+			recordRolloutEvent(readinessHandler, asg, eventNormal, reasonRolloutComplete, fmt.Sprintf("Finished rolling ASG %s", asg))
 		}
 	}
 	// terminate nodes
-	for asg, id := range newTerminate {
-		// all new config instances are ready, terminate an old one
-		err = awsTerminateNode(asgSvc, id)
-		if err != nil {
-			return fmt.Errorf("Error terminating node %s in ASG %s: %v", id, asg, err)
+	for asg, ids := range newTerminate {
+		// all new config instances are ready, terminate old ones
+		for _, id := range ids {
+			err = awsTerminateNode(ctx, asgSvc, id)
+			if err != nil {
+				return fmt.Errorf("Error terminating node %s in ASG %s: %v", id, asg, err)
+			}
+			recordTermination(asg, id)
+			if e, ok := readinessHandler.(eventer); ok && supports(readinessHandler, capabilityEvents) {
+				e.instanceEvent(instanceHostnames([]string{id}, instanceMap)[0], id, eventNormal, reasonTerminating, fmt.Sprintf("Terminating outdated instance %s of ASG %s", id, asg))
+			}
 		}
 	}
+	if len(asgErrors) > 0 {
+		return fmt.Errorf("Unable to adjust all ASGs: %s", strings.Join(asgErrors, "; "))
+	}
 	return nil
 }
 
-// calculateAdjustment calculates the new settings for the desired number, and which node (if any) to terminate
+// cordonOldNodes cordons the old instances of an ASG at the start of its rollout, if the readiness
+// handler can. Since it only saves pods being moved more than once, failing to is not an error.
+func cordonOldNodes(asg string, oldInstances []*autoscaling.Instance, instanceMap map[string]*instanceInfo, readinessHandler readiness, taint bool) {
+	c, ok := readinessHandler.(cordoner)
+	if !ok || !supports(readinessHandler, capabilityCordon) {
+		log.Printf("Unable to cordon old nodes of ASG %s without a kubernetes connection", asg)
+		return
+	}
+	ids := mapInstancesIds(oldInstances)
+	if err := c.cordon(instanceHostnames(ids, instanceMap), ids, taint); err != nil {
+		log.Printf("Unable to cordon old nodes of ASG %s, continuing without: %v", asg, err)
+	}
+}
+
+// uncordonNodes uncordons any instances in the ASG that cordonOldNodes cordoned
+func uncordonNodes(asg *autoscaling.Group, instanceMap map[string]*instanceInfo, readinessHandler readiness) error {
+	c, ok := readinessHandler.(cordoner)
+	if !ok || !supports(readinessHandler, capabilityCordon) {
+		return nil
+	}
+	ids := mapInstancesIds(asg.Instances)
+	return c.uncordon(instanceHostnames(ids, instanceMap), ids)
+}
+
+// recordRolloutEvent records an event for the rollout of an ASG, if the readiness handler can
+func recordRolloutEvent(readinessHandler readiness, asg string, eventType, reason, message string) {
+	if e, ok := readinessHandler.(eventer); ok && supports(readinessHandler, capabilityEvents) {
+		e.rolloutEvent(asg, eventType, reason, message)
+	}
+}
+
+// protectNewNodes stops an autoscaler scaling down the new instances of an ASG during its rollout,
+// if the readiness handler can. Failing to is not an error, as the rollout can still make progress.
+func protectNewNodes(asg string, newInstances []*autoscaling.Instance, instanceMap map[string]*instanceInfo, readinessHandler readiness) {
+	p, ok := readinessHandler.(protector)
+	if !ok || !supports(readinessHandler, capabilityProtect) {
+		log.Printf("Unable to protect new nodes of ASG %s from scale down without a kubernetes connection", asg)
+		return
+	}
+	ids := mapInstancesIds(newInstances)
+	if err := p.protect(instanceHostnames(ids, instanceMap), ids); err != nil {
+		log.Printf("Unable to protect new nodes of ASG %s from scale down: %v", asg, err)
+	}
+}
+
+// unprotectNodes removes the protection protectNewNodes added to any instances in the ASG
+func unprotectNodes(asg *autoscaling.Group, instanceMap map[string]*instanceInfo, readinessHandler readiness) error {
+	p, ok := readinessHandler.(protector)
+	if !ok || !supports(readinessHandler, capabilityProtect) {
+		return nil
+	}
+	ids := mapInstancesIds(asg.Instances)
+	return p.unprotect(instanceHostnames(ids, instanceMap), ids)
+}
+
+// notSuspended returns those of the processes that are not suspended in the ASG
+func notSuspended(asg *autoscaling.Group, processes []string) []string {
+	suspended := map[string]bool{}
+	for _, p := range asg.SuspendedProcesses {
+		suspended[aws.StringValue(p.ProcessName)] = true
+	}
+	ret := make([]string, 0)
+	for _, p := range processes {
+		if !suspended[p] {
+			ret = append(ret, p)
+		}
+	}
+	return ret
+}
+
+// reconcileOriginalDesired returns the original desired of a rollout, adjusted by however much anything
+// else changed the desired capacity since we last set it
+func reconcileOriginalDesired(asg *autoscaling.Group, state *rolloutState) int64 {
+	current := aws.Int64Value(asg.DesiredCapacity)
+	if state.LastDesired == 0 || current == state.LastDesired {
+		return state.OriginalDesired
+	}
+	reconciled := state.OriginalDesired + current - state.LastDesired
+	// 0 would mean there is no rollout
+	if reconciled < 1 {
+		reconciled = 1
+	}
+	log.Printf("Desired capacity of ASG %s was changed from %d to %d by something else, changing original desired from %d to %d", aws.StringValue(asg.AutoScalingGroupName), state.LastDesired, current, state.OriginalDesired, reconciled)
+	return reconciled
+}
+
+// rolloutComplete checks if every ASG is fully rolled: no instances with an old launch configuration
+// or template, including ones still terminating, and no rollout left to finish. With no ASGs, there is
+// nothing that could have been rolled, so it is an error.
+func rolloutComplete(ctx context.Context, asgList []string, ec2Svc ec2iface.EC2API, asgSvc autoscalingiface.AutoScalingAPI, states map[string]*rolloutState) (bool, error) {
+	if len(asgList) == 0 {
+		return false, fmt.Errorf("No ASGs to check")
+	}
+	asgs, err := awsDescribeGroups(ctx, asgSvc, asgList)
+	if err != nil {
+		return false, fmt.Errorf("Unexpected error describing ASGs: %v", err)
+	}
+	if len(asgs) != len(asgList) {
+		return false, fmt.Errorf("Found %d of %d ASGs %v", len(asgs), len(asgList), asgList)
+	}
+	for _, asg := range asgs {
+		if states[*asg.AutoScalingGroupName] != nil {
+			return false, nil
+		}
+		oldI, _, err := groupInstances(ctx, asg, ec2Svc)
+		if err != nil {
+			return false, fmt.Errorf("unable to group instances into new and old: %v", err)
+		}
+		if len(oldI) > 0 {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// calculateAdjustment calculates the new settings for the desired number, and which nodes (if any) to terminate
 // this makes no actual adjustment, only calculates what new settings should be
 // returns:
 //   what the new desired number of instances should be
 //   what the new original desired should be, primarily if it should be reset
-//   ID of an instance to terminate, "" if none
+//   IDs of instances to terminate, empty if none
 //   error
-func calculateAdjustment(asg *autoscaling.Group, ec2Svc ec2iface.EC2API, hostnameMap map[string]string, readinessHandler readiness, originalDesired int64) (int64, int64, string, error) {
+func calculateAdjustment(ctx context.Context, asg *autoscaling.Group, ec2Svc ec2iface.EC2API, instanceMap map[string]*instanceInfo, readinessHandler readiness, originalDesired int64, settings asgSettings) (int64, int64, []string, error) {
 	desired := *asg.DesiredCapacity
 
 	// get instances with old launch config
-	oldInstances, newInstances, err := groupInstances(asg, ec2Svc)
+	oldInstances, newInstances, err := groupInstances(ctx, asg, ec2Svc)
 	if err != nil {
-		return originalDesired, 0, "", fmt.Errorf("unable to group instances into new and old: %v", err)
+		return originalDesired, 0, nil, fmt.Errorf("unable to group instances into new and old: %v", err)
 	}
+	// instances on their way out cannot be counted on, nor terminated again
+	terminating := len(oldInstances)
+	oldInstances = filterTerminating(oldInstances)
+	terminating -= len(oldInstances)
 
 	// Possibilities:
 	// 1- we have some old ones, but have not started updates yet: set the desired, increment and loop
 	// 2- we have no old ones, but have started updates: we must be at end, so finish
 	// 3- we have some old ones, but have started updates: run the updates
 	if len(oldInstances) == 0 {
+		// only finish once the old ones on their way out are gone, rather than restoring desired,
+		// and uncordoning nodes, while they are still there
+		if originalDesired > 0 && terminating > 0 {
+			return desired, originalDesired, nil, nil
+		}
 		if originalDesired > 0 {
-			return originalDesired, 0, "", nil
+			return originalDesired, 0, nil, nil
 		}
+		return desired, 0, nil, nil
 	}
 	if originalDesired == 0 {
-		return desired + 1, desired, "", nil
+		if settings.strategy == strategyUnavailable {
+			// record that we have started, but do not add any instances
+			return desired, desired, nil, nil
+		}
+		return desired + surgeSize(asg, desired, len(oldInstances), settings), desired, nil, nil
+	}
+	// when surging, the rollout state is saved before desired is raised; if raising it failed, e.g. because
+	// the ASG was busy or we were shut down, raise it now rather than terminating old instances without
+	// their replacements
+	surging := desired > originalDesired
+	if settings.strategy != strategyUnavailable && !surging {
+		if surge := surgeSize(asg, originalDesired, len(oldInstances), settings); surge > 0 {
+			log.Printf("Desired capacity of ASG %s was not raised to surge, raising it by %d", aws.StringValue(asg.AutoScalingGroupName), surge)
+			return originalDesired + surge, originalDesired, nil, nil
+		}
 	}
 
-	// how we determine if we can terminate one
-	// we already know we have increased desired capacity
+	// how we determine if we can terminate some
+	// we already know we have started, and if surging, have increased desired capacity
 	// check if:
-	// a- actual instance count matches our new desired
+	// a- actual instance count matches our desired
 	// b- all new config instances are in valid state
-	// if yes, terminate one old one
+	// if yes, terminate as many old ones as we have surged by, or as may be unavailable
 	// if not, loop around again - eventually it will be
 
-	// do we have at least one more more ready instances than the original desired? if not, loop again until we do
+	// do we have as many ready instances as the desired? if not, loop again until we do
 	readyCount := 0
 	for _, i := range asg.Instances {
-		if *i.HealthStatus == healthy {
+		if *i.HealthStatus == healthy && !isTerminating(i) {
 			readyCount++
 		}
 	}
-	if int64(readyCount) < originalDesired+1 {
-		return desired, originalDesired, "", nil
+	if int64(readyCount) < desired {
+		return desired, originalDesired, nil, nil
 	}
 	// are any of the updated config instances not ready?
 	unReadyCount := 0
@@ -144,51 +424,187 @@ func calculateAdjustment(asg *autoscaling.Group, ec2Svc ec2iface.EC2API, hostnam
 		}
 	}
 	if unReadyCount > 0 {
-		return desired, originalDesired, "", nil
+		return desired, originalDesired, nil, nil
 	}
 	// do we have additional requirements for readiness?
 	if readinessHandler != nil {
-		var (
-			hostnames []string
-			err       error
-		)
 		// check if the new nodes all are in ready state
 		ids := mapInstancesIds(newInstances)
-		hostnames = make([]string, 0)
-		for _, i := range ids {
-			hostnames = append(hostnames, hostnameMap[i])
+		for _, id := range ids {
+			// without its hostname, we cannot tell if it is ready
+			if _, ok := instanceMap[id]; !ok {
+				log.Printf("Instance %s in ASG %s was not found in EC2, treating it as not ready", id, aws.StringValue(asg.AutoScalingGroupName))
+				return desired, originalDesired, nil, nil
+			}
 		}
-		unReadyCount, err = readinessHandler.getUnreadyCount(hostnames, ids)
+		var results []instanceReadiness
+		results, err = readinessHandler.getReadiness(ctx, instanceDescriptors(ids, instanceMap), settings.readiness)
 		if err != nil {
-			return desired, originalDesired, "", fmt.Errorf("Error getting readiness new node status: %v", err)
+			return desired, originalDesired, nil, fmt.Errorf("Error getting readiness new node status: %v", err)
 		}
-		if unReadyCount > 0 {
-			return desired, originalDesired, "", nil
+		if unready := unreadyInstances(ids, results); len(unready) > 0 {
+			for _, r := range unready {
+				log.Printf("Instance %s in ASG %s is not ready: %s", r.id, aws.StringValue(asg.AutoScalingGroupName), r.reason)
+			}
+			return desired, originalDesired, nil, nil
 		}
 	}
-	candidate := *oldInstances[0].InstanceId
+	recordNodesReady(aws.StringValue(asg.AutoScalingGroupName), mapInstancesIds(newInstances), instanceMap)
 
-	if readinessHandler != nil {
-		// get the node reference - first need the hostname
-		var (
-			hostname string
-			err      error
-		)
-		hostname = hostnameMap[candidate]
-		err = readinessHandler.prepareTermination([]string{hostname}, []string{candidate})
-		if err != nil {
-			return desired, originalDesired, "", fmt.Errorf("Unexpected error readiness handler terminating node %s: %v", hostname, err)
+	var count int64
+	if surging {
+		// surging: terminate as many as we have ready above the original desired, up to maxSurge
+		count = int64(readyCount) - originalDesired
+		if maxSurge := settings.maxSurge.resolve(originalDesired); maxSurge > 0 && count > maxSurge {
+			count = maxSurge
+		}
+	} else {
+		// not surging, either by choice or for lack of room: everything is up, so terminate
+		// up to maxUnavailable, and the ASG will replace them
+		count = settings.maxUnavailable.resolve(originalDesired)
+		if count < 1 {
+			count = 1
+		}
+	}
+	if count > int64(len(oldInstances)) {
+		count = int64(len(oldInstances))
+	}
+	// pick which old instances go first
+	order, err := newTerminationOrder(settings.terminationOrder, instanceMap, readinessHandler)
+	if err != nil {
+		return desired, originalDesired, nil, err
+	}
+	oldInstances, err = order.order(oldInstances)
+	if err != nil {
+		return desired, originalDesired, nil, fmt.Errorf("Unable to order instances for termination: %v", err)
+	}
+	candidates := make([]string, 0)
+	for _, i := range oldInstances[:count] {
+		candidate := *i.InstanceId
+		if readinessHandler != nil {
+			// get the node reference - first need the hostname
+			info, ok := instanceMap[candidate]
+			if !ok {
+				// we cannot tell which node to drain, so leave it for now
+				log.Printf("Instance %s in ASG %s was not found in EC2, not terminating it", candidate, aws.StringValue(asg.AutoScalingGroupName))
+				continue
+			}
+			hostname := info.privateDNSName
+			start := time.Now()
+			err = readinessHandler.prepareTermination(ctx, instanceDescriptors([]string{candidate}, instanceMap), settings.drain)
+			recordDrain(aws.StringValue(asg.AutoScalingGroupName), start, err)
+			if skip, ok := err.(*skipTerminationError); ok {
+				log.Printf("Not terminating instance %s in ASG %s for now: %v", candidate, aws.StringValue(asg.AutoScalingGroupName), skip)
+				continue
+			}
+			if err != nil {
+				// anything we already prepared is safe to terminate
+				return desired, originalDesired, candidates, fmt.Errorf("Unexpected error readiness handler terminating node %s: %v", hostname, err)
+			}
+		}
+		candidates = append(candidates, candidate)
+	}
+
+	// all new config instances are ready, terminate old ones
+	return desired, originalDesired, candidates, nil
+}
+
+// surgeSize returns how many instances to add above desired to surge: up to maxSurge, but never more than we need
+// to replace the old ones, nor more than MaxSize has room for unless we may raise it. 0 if there is no room.
+func surgeSize(asg *autoscaling.Group, desired int64, oldCount int, settings asgSettings) int64 {
+	surge := settings.maxSurge.resolve(desired)
+	if surge < 1 {
+		surge = 1
+	}
+	if surge > int64(oldCount) {
+		surge = int64(oldCount)
+	}
+	// SetDesiredCapacity will refuse to go above MaxSize
+	if exceedsMaxSize(asg, desired+surge) && !settings.raiseMaxSize {
+		room := *asg.MaxSize - desired
+		if room < 1 {
+			log.Printf("ASG %s is at its MaxSize %d, replacing instances without surging", aws.StringValue(asg.AutoScalingGroupName), *asg.MaxSize)
+			return 0
+		}
+		log.Printf("ASG %s only has room to surge by %d below its MaxSize %d", aws.StringValue(asg.AutoScalingGroupName), room, *asg.MaxSize)
+		surge = room
+	}
+	return surge
+}
+
+// instanceHostnames returns the private DNS name of each instance, in the same order as ids
+func instanceHostnames(ids []string, instanceMap map[string]*instanceInfo) []string {
+	hostnames := make([]string, 0, len(ids))
+	for _, id := range ids {
+		var hostname string
+		if info, ok := instanceMap[id]; ok {
+			hostname = info.privateDNSName
+		}
+		hostnames = append(hostnames, hostname)
+	}
+	return hostnames
+}
+
+// instanceDescriptors describes each instance to a readiness handler, in the same order as ids
+func instanceDescriptors(ids []string, instanceMap map[string]*instanceInfo) []instanceDescriptor {
+	instances := make([]instanceDescriptor, 0, len(ids))
+	for _, id := range ids {
+		d := instanceDescriptor{id: id}
+		if info, ok := instanceMap[id]; ok {
+			d.hostname = info.privateDNSName
+			d.privateIP = info.privateIP
+			d.availabilityZone = info.availabilityZone
+			d.tags = info.tags
+		}
+		instances = append(instances, d)
+	}
+	return instances
+}
+
+// unreadyInstances returns the results for instances that are not ready, in the same order as ids. An
+// instance the readiness handler said nothing about is not ready either.
+func unreadyInstances(ids []string, results []instanceReadiness) []instanceReadiness {
+	byID := map[string]instanceReadiness{}
+	for _, r := range results {
+		byID[r.id] = r
+	}
+	unready := make([]instanceReadiness, 0)
+	for _, id := range ids {
+		r, ok := byID[id]
+		if !ok {
+			r = instanceReadiness{id: id, reason: "readiness handler did not report on it"}
+		}
+		if !r.ready {
+			unready = append(unready, r)
 		}
 	}
+	return unready
+}
 
-	// all new config instances are ready, terminate an old one
-	return desired, originalDesired, candidate, nil
+// exceedsMaxSize checks if the desired capacity would be more than the ASG's MaxSize allows
+func exceedsMaxSize(asg *autoscaling.Group, desired int64) bool {
+	return asg.MaxSize != nil && desired > *asg.MaxSize
+}
+
+// isTerminating checks if the instance is already being terminated
+func isTerminating(i *autoscaling.Instance) bool {
+	return strings.HasPrefix(aws.StringValue(i.LifecycleState), autoscaling.LifecycleStateTerminating)
+}
+
+func filterTerminating(instances []*autoscaling.Instance) []*autoscaling.Instance {
+	ret := make([]*autoscaling.Instance, 0)
+	for _, i := range instances {
+		if !isTerminating(i) {
+			ret = append(ret, i)
+		}
+	}
+	return ret
 }
 
 // groupInstances handles all of the logic for determining which nodes in the ASG have an old or outdated
 // config, and which are up to date. It should to nothing else.
 // The entire rest of the code should rely on this for making the determination
-func groupInstances(asg *autoscaling.Group, ec2Svc ec2iface.EC2API) ([]*autoscaling.Instance, []*autoscaling.Instance, error) {
+func groupInstances(ctx context.Context, asg *autoscaling.Group, ec2Svc ec2iface.EC2API) ([]*autoscaling.Instance, []*autoscaling.Instance, error) {
 	oldInstances := make([]*autoscaling.Instance, 0)
 	newInstances := make([]*autoscaling.Instance, 0)
 	// we want to be able to handle LaunchTemplate as well
@@ -200,25 +616,9 @@ func groupInstances(asg *autoscaling.Group, ec2Svc ec2iface.EC2API) ([]*autoscal
 		//  with the same LT name, same ID but different versions, so need to check version.
 		//  they even can have the same version, if the version is `$Latest` or `$Default`, so need
 		//  to get actual versions for each
-		var (
-			targetTemplate *ec2.LaunchTemplate
-			err            error
-		)
-		switch {
-		case targetLt.LaunchTemplateId != nil && *targetLt.LaunchTemplateId != "":
-			if targetTemplate, err = awsGetLaunchTemplateByID(ec2Svc, *targetLt.LaunchTemplateId); err != nil {
-				return nil, nil, fmt.Errorf("error retrieving information about launch template ID %s: %v", *targetLt.LaunchTemplateId, err)
-			}
-		case targetLt.LaunchTemplateName != nil && *targetLt.LaunchTemplateName != "":
-			if targetTemplate, err = awsGetLaunchTemplateByName(ec2Svc, *targetLt.LaunchTemplateName); err != nil {
-				return nil, nil, fmt.Errorf("error retrieving information about launch template name %s: %v", *targetLt.LaunchTemplateName, err)
-			}
-		default:
-			return nil, nil, fmt.Errorf("AutoScaling Group %s had invalid Launch Template", *asg.AutoScalingGroupName)
-		}
-		// extra safety check
-		if targetTemplate == nil {
-			return nil, nil, fmt.Errorf("no template found")
+		targetTemplate, err := getTargetTemplate(ctx, asg, ec2Svc)
+		if err != nil {
+			return nil, nil, err
 		}
 		// now we can loop through each node and compare
 		for _, i := range asg.Instances {
@@ -252,6 +652,50 @@ func groupInstances(asg *autoscaling.Group, ec2Svc ec2iface.EC2API) ([]*autoscal
 	return oldInstances, newInstances, nil
 }
 
+// getTargetTemplate retrieves the launch template that the ASG is configured to use
+func getTargetTemplate(ctx context.Context, asg *autoscaling.Group, ec2Svc ec2iface.EC2API) (*ec2.LaunchTemplate, error) {
+	var (
+		targetTemplate *ec2.LaunchTemplate
+		err            error
+	)
+	targetLt := asg.LaunchTemplate
+	switch {
+	case targetLt.LaunchTemplateId != nil && *targetLt.LaunchTemplateId != "":
+		if targetTemplate, err = awsGetLaunchTemplateByID(ctx, ec2Svc, *targetLt.LaunchTemplateId); err != nil {
+			return nil, fmt.Errorf("error retrieving information about launch template ID %s: %v", *targetLt.LaunchTemplateId, err)
+		}
+	case targetLt.LaunchTemplateName != nil && *targetLt.LaunchTemplateName != "":
+		if targetTemplate, err = awsGetLaunchTemplateByName(ctx, ec2Svc, *targetLt.LaunchTemplateName); err != nil {
+			return nil, fmt.Errorf("error retrieving information about launch template name %s: %v", *targetLt.LaunchTemplateName, err)
+		}
+	default:
+		return nil, fmt.Errorf("AutoScaling Group %s had invalid Launch Template", aws.StringValue(asg.AutoScalingGroupName))
+	}
+	// extra safety check
+	if targetTemplate == nil {
+		return nil, fmt.Errorf("no template found")
+	}
+	return targetTemplate, nil
+}
+
+// targetVersion describes the launch configuration or launch template version that the ASG is rolling to,
+// with `$Latest` and `$Default` resolved to the actual version number
+func targetVersion(ctx context.Context, asg *autoscaling.Group, ec2Svc ec2iface.EC2API) (string, error) {
+	targetLt := asg.LaunchTemplate
+	if targetLt == nil {
+		return aws.StringValue(asg.LaunchConfigurationName), nil
+	}
+	targetTemplate, err := getTargetTemplate(ctx, asg, ec2Svc)
+	if err != nil {
+		return "", err
+	}
+	name := aws.StringValue(targetLt.LaunchTemplateId)
+	if name == "" {
+		name = aws.StringValue(targetLt.LaunchTemplateName)
+	}
+	return fmt.Sprintf("%s:%s", name, resolveLaunchTemplateVersion(targetTemplate, targetLt.Version)), nil
+}
+
 func mapInstancesIds(instances []*autoscaling.Instance) []string {
 	ids := make([]string, 0)
 	for _, i := range instances {
@@ -277,22 +721,17 @@ func compareLaunchTemplateVersions(targetTemplate *ec2.LaunchTemplate, lt1, lt2
 		return false
 	}
 	// if either version starts with `$`, then resolve to actual version from LaunchTemplate
-	var lt1version, lt2version string
-	switch *lt1.Version {
-	case "$Default":
-		lt1version = fmt.Sprintf("%d", targetTemplate.DefaultVersionNumber)
-	case "$Latest":
-		lt1version = fmt.Sprintf("%d", targetTemplate.LatestVersionNumber)
-	default:
-		lt1version = *lt1.Version
-	}
-	switch *lt2.Version {
+	return resolveLaunchTemplateVersion(targetTemplate, lt1.Version) == resolveLaunchTemplateVersion(targetTemplate, lt2.Version)
+}
+
+// resolveLaunchTemplateVersion resolves `$Latest` and `$Default` to the actual version number from the template
+func resolveLaunchTemplateVersion(targetTemplate *ec2.LaunchTemplate, version *string) string {
+	switch aws.StringValue(version) {
 	case "$Default":
-		lt2version = fmt.Sprintf("%d", targetTemplate.DefaultVersionNumber)
+		return fmt.Sprintf("%d", aws.Int64Value(targetTemplate.DefaultVersionNumber))
 	case "$Latest":
-		lt2version = fmt.Sprintf("%d", targetTemplate.LatestVersionNumber)
+		return fmt.Sprintf("%d", aws.Int64Value(targetTemplate.LatestVersionNumber))
 	default:
-		lt2version = *lt2.Version
+		return aws.StringValue(version)
 	}
-	return lt1version == lt2version
 }
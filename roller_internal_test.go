@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"strings"
 	"testing"
@@ -16,10 +17,22 @@ type testReadyHandler struct {
 	terminateError error
 }
 
-func (t *testReadyHandler) getUnreadyCount(hostnames []string, ids []string) (int, error) {
-	return t.unreadyCount, t.unreadyError
+// getReadiness reports the first unreadyCount instances as not ready
+func (t *testReadyHandler) getReadiness(ctx context.Context, instances []instanceDescriptor, opts readinessSettings) ([]instanceReadiness, error) {
+	if t.unreadyError != nil {
+		return nil, t.unreadyError
+	}
+	results := make([]instanceReadiness, 0, len(instances))
+	for i, instance := range instances {
+		if i < t.unreadyCount {
+			results = append(results, instanceReadiness{id: instance.id, reason: "not ready"})
+		} else {
+			results = append(results, instanceReadiness{id: instance.id, ready: true})
+		}
+	}
+	return results, nil
 }
-func (t *testReadyHandler) prepareTermination(hostnames []string, ids []string) error {
+func (t *testReadyHandler) prepareTermination(ctx context.Context, instances []instanceDescriptor, opts drainSettings) error {
 	return t.terminateError
 }
 
@@ -56,6 +69,9 @@ func TestCalculateAdjustment(t *testing.T) {
 	terminateErrorHandler := &testReadyHandler{
 		terminateError: fmt.Errorf("Error"),
 	}
+	terminateSkipHandler := &testReadyHandler{
+		terminateError: &skipTerminationError{reason: "drain timed out"},
+	}
 
 	tests := []struct {
 		oldInstances          []string
@@ -68,34 +84,57 @@ func TestCalculateAdjustment(t *testing.T) {
 		targetOriginalDesired int64
 		targetTerminate       string
 		err                   error
+		maxSurge              intOrPercent
 	}{
 		// 1 old, 2 new healthy, 0 new unhealthy, should terminate old
-		{[]string{"1"}, []string{"2", "3"}, []string{}, 3, 2, nil, 3, 2, "1", nil},
+		{[]string{"1"}, []string{"2", "3"}, []string{}, 3, 2, nil, 3, 2, "1", nil, intOrPercent{value: 1}},
 		// 0 old, 2 new healthy, 0 new unhealthy, should indicate end of process
-		{[]string{}, []string{"2", "3"}, []string{}, 3, 2, nil, 2, 0, "", nil},
+		{[]string{}, []string{"2", "3"}, []string{}, 3, 2, nil, 2, 0, "", nil, intOrPercent{value: 1}},
 		// 2 old, 0 new healthy, 0 new unhealthy, should indicate start of process
-		{[]string{"1", "2"}, []string{}, []string{}, 2, 0, nil, 3, 2, "", nil},
+		{[]string{"1", "2"}, []string{}, []string{}, 2, 0, nil, 3, 2, "", nil, intOrPercent{value: 1}},
 		// 2 old, 0 new healthy, 0 new unhealthy, started, should not do anything until new healthy one
-		{[]string{"1", "2"}, []string{}, []string{}, 3, 2, nil, 3, 2, "", nil},
+		{[]string{"1", "2"}, []string{}, []string{}, 3, 2, nil, 3, 2, "", nil, intOrPercent{value: 1}},
 		// 2 old, 1 new healthy, 0 new unhealthy, remove an old one
-		{[]string{"1", "2"}, []string{"3"}, []string{}, 3, 2, nil, 3, 2, "1", nil},
+		{[]string{"1", "2"}, []string{"3"}, []string{}, 3, 2, nil, 3, 2, "1", nil, intOrPercent{value: 1}},
 		// 2 old, 0 new healthy, 1 new unhealthy, started, should not do anything until new one is healthy
-		{[]string{"1", "2"}, []string{}, []string{"3"}, 3, 2, nil, 3, 2, "", nil},
+		{[]string{"1", "2"}, []string{}, []string{"3"}, 3, 2, nil, 3, 2, "", nil, intOrPercent{value: 1}},
 
 		// 2 old, 1 new healthy, 0 new unhealthy, 1 new unready, should not change anything
-		{[]string{"1", "2"}, []string{"3"}, []string{}, 3, 2, unreadyCountHandler, 3, 2, "", nil},
+		{[]string{"1", "2"}, []string{"3"}, []string{}, 3, 2, unreadyCountHandler, 3, 2, "", nil, intOrPercent{value: 1}},
 		// 2 old, 1 new healthy, 0 new unhealthy, 0 new unready, 1 error: should not change anything
-		{[]string{"1", "2"}, []string{"3"}, []string{}, 3, 2, unreadyErrorHandler, 3, 2, "", fmt.Errorf("Error")},
+		{[]string{"1", "2"}, []string{"3"}, []string{}, 3, 2, unreadyErrorHandler, 3, 2, "", fmt.Errorf("Error"), intOrPercent{value: 1}},
 		// 2 old, 1 new healthy, 0 new unhealthy, 0 unready, remove an old one
-		{[]string{"1", "2"}, []string{"3"}, []string{}, 3, 2, readyHandler, 3, 2, "1", nil},
+		{[]string{"1", "2"}, []string{"3"}, []string{}, 3, 2, readyHandler, 3, 2, "1", nil, intOrPercent{value: 1}},
 		// 2 old, 1 new healthy, 0 new unhealthy, 0 new unready, 1 error: should not change anything
-		{[]string{"1", "2"}, []string{"3"}, []string{}, 3, 2, terminateErrorHandler, 3, 2, "", fmt.Errorf("Unexpected error")},
+		{[]string{"1", "2"}, []string{"3"}, []string{}, 3, 2, terminateErrorHandler, 3, 2, "", fmt.Errorf("Unexpected error"), intOrPercent{value: 1}},
 		// 2 old, 1 new healthy, 0 new unhealthy, 0 unready, successful terminate: remove an old one
-		{[]string{"1", "2"}, []string{"3"}, []string{}, 3, 2, terminateHandler, 3, 2, "1", nil},
+		{[]string{"1", "2"}, []string{"3"}, []string{}, 3, 2, terminateHandler, 3, 2, "1", nil, intOrPercent{value: 1}},
+		// 2 old, 1 new healthy, 0 new unhealthy, 0 unready, terminate skipped: no error, but nothing to remove
+		{[]string{"1", "2"}, []string{"3"}, []string{}, 3, 2, terminateSkipHandler, 3, 2, "", nil, intOrPercent{value: 1}},
+
+		// surge: 4 old, 0 new, not started, surge by 3
+		{[]string{"1", "2", "3", "4"}, []string{}, []string{}, 4, 0, nil, 7, 4, "", nil, intOrPercent{value: 3}},
+		// surge: 2 old, 0 new, not started, surge by only as many as are old
+		{[]string{"1", "2"}, []string{}, []string{}, 4, 0, nil, 6, 4, "", nil, intOrPercent{value: 3}},
+		// surge: 4 old, 0 new, not started, surge by 50% rounded up
+		{[]string{"1", "2", "3", "4"}, []string{}, []string{}, 3, 0, nil, 5, 3, "", nil, intOrPercent{value: 50, percent: true}},
+		// surge: 4 old, 2 new healthy, not all new ones up yet, wait
+		{[]string{"1", "2", "3", "4"}, []string{"5", "6"}, []string{}, 7, 4, nil, 7, 4, "", nil, intOrPercent{value: 3}},
+		// surge: 4 old, 2 new healthy, 1 new unhealthy, wait
+		{[]string{"1", "2", "3", "4"}, []string{"5", "6"}, []string{"7"}, 7, 4, nil, 7, 4, "", nil, intOrPercent{value: 3}},
+		// surge: 4 old, 3 new healthy, terminate 3 old
+		{[]string{"1", "2", "3", "4"}, []string{"5", "6", "7"}, []string{}, 7, 4, readyHandler, 7, 4, "1,2,3", nil, intOrPercent{value: 3}},
+		// surge: 1 old, 6 new healthy, terminate the last old one
+		{[]string{"1"}, []string{"5", "6", "7", "8", "9", "10"}, []string{}, 7, 4, nil, 7, 4, "1", nil, intOrPercent{value: 3}},
+		// surge: 0 old, 7 new healthy, scale back to original
+		{[]string{}, []string{"5", "6", "7", "8", "9", "10", "11"}, []string{}, 7, 4, nil, 4, 0, "", nil, intOrPercent{value: 3}},
+		// surge: state saved, desired not raised, e.g. setting it failed: raise it rather than terminating
+		{[]string{"1", "2", "3", "4"}, []string{}, []string{}, 4, 4, readyHandler, 7, 4, "", nil, intOrPercent{value: 3}},
 	}
-	hostnameMap := map[string]string{}
+	instanceMap := map[string]*instanceInfo{}
 	for i := 0; i < 20; i++ {
-		hostnameMap[fmt.Sprintf("%d", i)] = fmt.Sprintf("host%d", i)
+		id := fmt.Sprintf("%d", i)
+		instanceMap[id] = &instanceInfo{id: id, privateDNSName: fmt.Sprintf("host%d", i)}
 	}
 	for i, tt := range tests {
 		// construct Instances for the group
@@ -138,7 +177,8 @@ func TestCalculateAdjustment(t *testing.T) {
 		ec2Svc := &mockEc2Svc{
 			autodescribe: true,
 		}
-		desired, originalDesired, terminate, err := calculateAdjustment(asg, ec2Svc, hostnameMap, tt.readiness, tt.originalDesired)
+		desired, originalDesired, terminateIDs, err := calculateAdjustment(context.Background(), asg, ec2Svc, instanceMap, tt.readiness, tt.originalDesired, asgSettings{maxSurge: tt.maxSurge})
+		terminate := strings.Join(terminateIDs, ",")
 		switch {
 		case (err == nil && tt.err != nil) || (err != nil && tt.err == nil) || (err != nil && tt.err != nil && !strings.HasPrefix(err.Error(), tt.err.Error())):
 			t.Errorf("%d: mismatched errors, actual then expected", i)
@@ -182,10 +222,11 @@ func TestAdjust(t *testing.T) {
 				"myasg":      {"2", "3"},
 				"anotherasg": {"8", "9", "10"},
 			},
-			map[string]int64{"myasg": 2, "anotherasg": 10},
+			// myasg has already surged by 1 above its original desired
+			map[string]int64{"myasg": 3, "anotherasg": 10},
 			map[string]int64{"myasg": 2, "anotherasg": 10},
 			map[string]int64{"myasg": 2, "anotherasg": 0},
-			map[string]int64{"myasg": 2},
+			map[string]int64{"myasg": 3, "anotherasg": 10},
 			map[string]int64{"myasg": 2, "anotherasg": 0},
 			[]string{"1"},
 		},
@@ -206,7 +247,7 @@ func TestAdjust(t *testing.T) {
 			map[string]int64{},
 			map[string]int64{"myasg": 2},
 			map[string]int64{"myasg": 3},
-			map[string]int64{"myasg": 2},
+			map[string]int64{"myasg": 2, "anotherasg": 0},
 			[]string{},
 		},
 	}
@@ -251,28 +292,40 @@ func TestAdjust(t *testing.T) {
 			ec2Svc := &mockEc2Svc{
 				autodescribe: true,
 			}
-			// convert maps from map[string] to map[*string]
-			originalDesiredPtr := map[*string]int64{}
+			store := newMemoryStateStore()
 			for k, v := range tt.originalDesired {
-				ks := k
-				originalDesiredPtr[&ks] = v
+				_ = store.save(context.Background(), k, &rolloutState{OriginalDesired: v})
 			}
-			newDesiredPtr := map[*string]int64{}
-			for k, v := range tt.newDesired {
-				ks := k
-				newDesiredPtr[&ks] = v
+			states, _ := store.load(context.Background(), tt.asgs)
+			err := adjust(context.Background(), tt.asgs, ec2Svc, asgSvc, tt.handler, states, store, &rollerConfig{defaults: asgSettings{maxSurge: intOrPercent{value: 1}}})
+			// what original desired did we end up with, in memory and persisted?
+			resultOriginalDesired := map[string]int64{}
+			storedOriginalDesired := map[string]int64{}
+			stored, _ := store.load(context.Background(), tt.asgs)
+			for _, name := range tt.asgs {
+				resultOriginalDesired[name] = 0
+				storedOriginalDesired[name] = 0
+				if state, ok := states[name]; ok {
+					resultOriginalDesired[name] = state.OriginalDesired
+				}
+				if state, ok := stored[name]; ok {
+					storedOriginalDesired[name] = state.OriginalDesired
+				}
 			}
-			err := adjust(tt.asgs, ec2Svc, asgSvc, tt.handler, tt.originalDesired)
 			// what were our last calls to each?
 			switch {
 			case (err == nil && tt.err != nil) || (err != nil && tt.err == nil) || (err != nil && tt.err != nil && !strings.HasPrefix(err.Error(), tt.err.Error())):
 				t.Errorf("%d: mismatched errors, actual then expected", i)
 				t.Logf("%v", err)
 				t.Logf("%v", tt.err)
-			case !testStringInt64MapEq(tt.newOriginalDesired, tt.expectedOriginalDesired):
-				t.Errorf("%d: Mismatched desired, actual then expected", i)
-				t.Logf("%v", tt.originalDesired)
-				t.Logf("%v", tt.newOriginalDesired)
+			case !testStringInt64MapEq(resultOriginalDesired, tt.expectedOriginalDesired):
+				t.Errorf("%d: Mismatched original desired, actual then expected", i)
+				t.Logf("%v", resultOriginalDesired)
+				t.Logf("%v", tt.expectedOriginalDesired)
+			case !testStringInt64MapEq(storedOriginalDesired, tt.expectedOriginalDesired):
+				t.Errorf("%d: Mismatched persisted original desired, actual then expected", i)
+				t.Logf("%v", storedOriginalDesired)
+				t.Logf("%v", tt.expectedOriginalDesired)
 			}
 
 			// check each svc with its correct calls
@@ -314,7 +367,7 @@ func TestGroupInstances(t *testing.T) {
 		ec2Svc := &mockEc2Svc{
 			autodescribe: true,
 		}
-		oldInstances, newInstances, err := groupInstances(asg, ec2Svc)
+		oldInstances, newInstances, err := groupInstances(context.Background(), asg, ec2Svc)
 		if err != nil {
 			t.Errorf("unexpected error grouping instances: %v", err)
 			return
@@ -440,3 +493,480 @@ func TestCompareLaunchTemplateVersions(t *testing.T) {
 		}
 	}
 }
+
+func TestResolveLaunchTemplateVersion(t *testing.T) {
+	template := &ec2.LaunchTemplate{
+		DefaultVersionNumber: aws.Int64(25),
+		LatestVersionNumber:  aws.Int64(64),
+	}
+	tests := []struct {
+		desc     string
+		version  *string
+		resolved string
+	}{
+		{"latest", aws.String("$Latest"), "64"},
+		{"default", aws.String("$Default"), "25"},
+		{"numeric", aws.String("31"), "31"},
+		{"none", nil, ""},
+	}
+	for _, tt := range tests {
+		if resolved := resolveLaunchTemplateVersion(template, tt.version); resolved != tt.resolved {
+			t.Errorf("%s: mismatched version, actual %s expected %s", tt.desc, resolved, tt.resolved)
+		}
+	}
+
+	// an instance on the version that $Latest or $Default resolves to is up to date
+	compare := []struct {
+		desc     string
+		target   string
+		instance string
+		expected bool
+	}{
+		{"latest is the same version", "$Latest", "64", true},
+		{"latest is a later version", "$Latest", "25", false},
+		{"default is the same version", "$Default", "25", true},
+		{"default is an earlier version", "$Default", "64", false},
+		{"both latest", "$Latest", "$Latest", true},
+		{"latest and default differ", "$Latest", "$Default", false},
+	}
+	for _, tt := range compare {
+		target := &autoscaling.LaunchTemplateSpecification{Version: aws.String(tt.target)}
+		instance := &autoscaling.LaunchTemplateSpecification{Version: aws.String(tt.instance)}
+		if result := compareLaunchTemplateVersions(template, target, instance); result != tt.expected {
+			t.Errorf("%s: mismatched results, received %v expected %v", tt.desc, result, tt.expected)
+		}
+	}
+}
+
+func TestTargetVersion(t *testing.T) {
+	tests := []struct {
+		asg     *autoscaling.Group
+		version string
+	}{
+		{&autoscaling.Group{LaunchConfigurationName: aws.String("lcname")}, "lcname"},
+		{&autoscaling.Group{LaunchTemplate: &autoscaling.LaunchTemplateSpecification{LaunchTemplateName: aws.String("lt1"), Version: aws.String("3")}}, "lt1:3"},
+		{&autoscaling.Group{LaunchTemplate: &autoscaling.LaunchTemplateSpecification{LaunchTemplateName: aws.String("lt1"), Version: aws.String("$Latest")}}, "lt1:4"},
+		{&autoscaling.Group{LaunchTemplate: &autoscaling.LaunchTemplateSpecification{LaunchTemplateId: aws.String("12345"), Version: aws.String("$Default")}}, "12345:59"},
+	}
+	for i, tt := range tests {
+		version, err := targetVersion(context.Background(), tt.asg, &mockEc2Svc{})
+		if err != nil {
+			t.Errorf("%d: unexpected error: %v", i, err)
+			continue
+		}
+		if version != tt.version {
+			t.Errorf("%d: mismatched version, actual %s expected %s", i, version, tt.version)
+		}
+	}
+}
+
+func testGroup(name string, desired, maxSize int64, oldIds, newIdsHealthy, newIdsUnhealthy []string) *autoscaling.Group {
+	lcName := "newconf"
+	lcNameOld := fmt.Sprintf("mod-%s", lcName)
+	instances := make([]*autoscaling.Instance, 0)
+	add := func(ids []string, lc, status string) {
+		for _, id := range ids {
+			instances = append(instances, &autoscaling.Instance{
+				InstanceId:              aws.String(id),
+				LaunchConfigurationName: aws.String(lc),
+				HealthStatus:            aws.String(status),
+			})
+		}
+	}
+	add(oldIds, lcNameOld, healthy)
+	add(newIdsHealthy, lcName, healthy)
+	add(newIdsUnhealthy, lcName, "Down")
+	return &autoscaling.Group{
+		AutoScalingGroupName:    aws.String(name),
+		DesiredCapacity:         aws.Int64(desired),
+		MaxSize:                 aws.Int64(maxSize),
+		LaunchConfigurationName: aws.String(lcName),
+		Instances:               instances,
+	}
+}
+
+func TestCalculateAdjustmentUnavailable(t *testing.T) {
+	surge := asgSettings{strategy: strategySurge, maxSurge: intOrPercent{value: 2}, maxUnavailable: intOrPercent{value: 1}}
+	surgeRaise := surge
+	surgeRaise.raiseMaxSize = true
+	unavailable := asgSettings{strategy: strategyUnavailable, maxSurge: intOrPercent{value: 1}, maxUnavailable: intOrPercent{value: 2}}
+	// the last old instance is on its way out
+	terminating := testGroup("a", 3, 5, []string{"3"}, []string{"4", "5", "6"}, nil)
+	terminating.Instances[0].LifecycleState = aws.String(autoscaling.LifecycleStateTerminating)
+	tests := []struct {
+		desc                  string
+		asg                   *autoscaling.Group
+		originalDesired       int64
+		settings              asgSettings
+		targetDesired         int64
+		targetOriginalDesired int64
+		targetTerminate       string
+	}{
+		{"unavailable: start without surging", testGroup("a", 3, 5, []string{"1", "2", "3"}, nil, nil), 0, unavailable, 3, 3, ""},
+		{"unavailable: terminate up to maxUnavailable", testGroup("a", 3, 5, []string{"1", "2", "3"}, nil, nil), 3, unavailable, 3, 3, "1,2"},
+		{"unavailable: wait for replacements", testGroup("a", 3, 5, []string{"3"}, nil, []string{"4"}), 3, unavailable, 3, 3, ""},
+		{"unavailable: terminate the rest", testGroup("a", 3, 5, []string{"3"}, []string{"4", "5"}, nil), 3, unavailable, 3, 3, "3"},
+		{"unavailable: finish", testGroup("a", 3, 5, nil, []string{"4", "5", "6"}, nil), 3, unavailable, 3, 0, ""},
+		{"unavailable: wait for the last old one to terminate before finishing", terminating, 3, unavailable, 3, 3, ""},
+		{"surge: plenty of room", testGroup("a", 3, 5, []string{"1", "2", "3"}, nil, nil), 0, surge, 5, 3, ""},
+		{"surge: limited room", testGroup("a", 3, 4, []string{"1", "2", "3"}, nil, nil), 0, surge, 4, 3, ""},
+		{"surge: at MaxSize falls back to unavailable", testGroup("a", 3, 3, []string{"1", "2", "3"}, nil, nil), 0, surge, 3, 3, ""},
+		{"surge: at MaxSize terminates up to maxUnavailable", testGroup("a", 3, 3, []string{"1", "2", "3"}, nil, nil), 3, surge, 3, 3, "1"},
+		{"surge: at MaxSize may raise it", testGroup("a", 3, 3, []string{"1", "2", "3"}, nil, nil), 0, surgeRaise, 5, 3, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			desired, originalDesired, terminateIDs, err := calculateAdjustment(context.Background(), tt.asg, &mockEc2Svc{autodescribe: true}, map[string]*instanceInfo{}, nil, tt.originalDesired, tt.settings)
+			terminate := strings.Join(terminateIDs, ",")
+			switch {
+			case err != nil:
+				t.Errorf("unexpected error: %v", err)
+			case desired != tt.targetDesired:
+				t.Errorf("Mismatched desired, actual %d expected %d", desired, tt.targetDesired)
+			case originalDesired != tt.targetOriginalDesired:
+				t.Errorf("Mismatched original desired, actual %d expected %d", originalDesired, tt.targetOriginalDesired)
+			case terminate != tt.targetTerminate:
+				t.Errorf("Mismatched terminate ID, actual %s expected %s", terminate, tt.targetTerminate)
+			}
+		})
+	}
+}
+
+func TestAdjustRaiseMaxSize(t *testing.T) {
+	config := &rollerConfig{defaults: asgSettings{strategy: strategySurge, maxSurge: intOrPercent{value: 1}, maxUnavailable: intOrPercent{value: 1}, raiseMaxSize: true}}
+	store := newMemoryStateStore()
+	states := map[string]*rolloutState{}
+
+	// start: at MaxSize, so raise it and surge
+	asgSvc := &mockAsgSvc{groups: map[string]*autoscaling.Group{
+		"myasg": testGroup("myasg", 3, 3, []string{"1", "2", "3"}, nil, nil),
+	}}
+	if err := adjust(context.Background(), []string{"myasg"}, &mockEc2Svc{autodescribe: true}, asgSvc, nil, states, store, config); err != nil {
+		t.Fatalf("unexpected error starting: %v", err)
+	}
+	maxCalls := asgSvc.counter.filterByName("UpdateAutoScalingGroup")
+	if len(maxCalls) != 1 || *maxCalls[0].params[0].(*autoscaling.UpdateAutoScalingGroupInput).MaxSize != 4 {
+		t.Errorf("expected a single call to raise MaxSize to 4, got %v", maxCalls)
+	}
+	desiredCalls := asgSvc.counter.filterByName("SetDesiredCapacity")
+	if len(desiredCalls) != 1 || *desiredCalls[0].params[0].(*autoscaling.SetDesiredCapacityInput).DesiredCapacity != 4 {
+		t.Errorf("expected a single call to set desired to 4, got %v", desiredCalls)
+	}
+	if states["myasg"] == nil || states["myasg"].OriginalMaxSize != 3 {
+		t.Fatalf("expected state to record original max size 3, got %v", states["myasg"])
+	}
+
+	// finish: all new, so restore desired and MaxSize
+	asgSvc = &mockAsgSvc{groups: map[string]*autoscaling.Group{
+		"myasg": testGroup("myasg", 4, 4, nil, []string{"4", "5", "6", "7"}, nil),
+	}}
+	if err := adjust(context.Background(), []string{"myasg"}, &mockEc2Svc{autodescribe: true}, asgSvc, nil, states, store, config); err != nil {
+		t.Fatalf("unexpected error finishing: %v", err)
+	}
+	desiredCalls = asgSvc.counter.filterByName("SetDesiredCapacity")
+	if len(desiredCalls) != 1 || *desiredCalls[0].params[0].(*autoscaling.SetDesiredCapacityInput).DesiredCapacity != 3 {
+		t.Errorf("expected a single call to restore desired to 3, got %v", desiredCalls)
+	}
+	maxCalls = asgSvc.counter.filterByName("UpdateAutoScalingGroup")
+	if len(maxCalls) != 1 || *maxCalls[0].params[0].(*autoscaling.UpdateAutoScalingGroupInput).MaxSize != 3 {
+		t.Errorf("expected a single call to restore MaxSize to 3, got %v", maxCalls)
+	}
+	if _, ok := states["myasg"]; ok {
+		t.Errorf("expected state to be removed, got %v", states["myasg"])
+	}
+}
+
+// recordingReadyHandler remembers which nodes it was asked about
+type recordingReadyHandler struct {
+	checked  []string
+	prepared []string
+}
+
+func (r *recordingReadyHandler) getReadiness(ctx context.Context, instances []instanceDescriptor, opts readinessSettings) ([]instanceReadiness, error) {
+	results := make([]instanceReadiness, 0, len(instances))
+	for _, i := range instances {
+		r.checked = append(r.checked, fmt.Sprintf("%s=%s", i.id, i.hostname))
+		results = append(results, instanceReadiness{id: i.id, ready: true})
+	}
+	return results, nil
+}
+func (r *recordingReadyHandler) prepareTermination(ctx context.Context, instances []instanceDescriptor, opts drainSettings) error {
+	for _, i := range instances {
+		r.prepared = append(r.prepared, fmt.Sprintf("%s=%s", i.id, i.hostname))
+	}
+	return nil
+}
+
+func TestAdjustInstanceMapping(t *testing.T) {
+	config := &rollerConfig{defaults: asgSettings{strategy: strategySurge, maxSurge: intOrPercent{value: 2}, maxUnavailable: intOrPercent{value: 1}}}
+	store := newMemoryStateStore()
+	_ = store.save(context.Background(), "myasg", &rolloutState{OriginalDesired: 3})
+	states, _ := store.load(context.Background(), []string{"myasg"})
+	asgSvc := &mockAsgSvc{groups: map[string]*autoscaling.Group{
+		"myasg": testGroup("myasg", 5, 5, []string{"gone", "1", "2"}, []string{"4", "5"}, nil),
+	}}
+	// EC2 returns the instances in a different order, and without the one that is gone
+	ec2Svc := &mockEc2Svc{reverse: true, instances: map[string]*ec2.Instance{}}
+	for _, id := range []string{"1", "2", "4", "5"} {
+		ec2Svc.instances[id] = &ec2.Instance{InstanceId: aws.String(id), PrivateDnsName: aws.String("ip-" + id)}
+	}
+	ec2Svc.instances["gone"] = nil
+	handler := &recordingReadyHandler{}
+	if err := adjust(context.Background(), []string{"myasg"}, ec2Svc, asgSvc, handler, states, store, config); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !testStringEq(handler.checked, []string{"4=ip-4", "5=ip-5"}) {
+		t.Errorf("mismatched readiness checks, actual %v", handler.checked)
+	}
+	// the one that is gone cannot be drained, so is left alone
+	if !testStringEq(handler.prepared, []string{"1=ip-1"}) {
+		t.Errorf("mismatched drains, actual %v", handler.prepared)
+	}
+	terminated := make([]string, 0)
+	for _, c := range asgSvc.counter.filterByName("TerminateInstanceInAutoScalingGroup") {
+		terminated = append(terminated, *c.params[0].(*autoscaling.TerminateInstanceInAutoScalingGroupInput).InstanceId)
+	}
+	if !testStringEq(terminated, []string{"1"}) {
+		t.Errorf("mismatched terminations, actual %v", terminated)
+	}
+}
+
+// cordoningReadyHandler also remembers which nodes it was asked to cordon and uncordon
+type cordoningReadyHandler struct {
+	recordingReadyHandler
+	cordoned   []string
+	tainted    bool
+	uncordoned []string
+}
+
+func (c *cordoningReadyHandler) cordon(hostnames []string, ids []string, taint bool) error {
+	c.cordoned = append(c.cordoned, ids...)
+	c.tainted = taint
+	return nil
+}
+func (c *cordoningReadyHandler) uncordon(hostnames []string, ids []string) error {
+	c.uncordoned = append(c.uncordoned, ids...)
+	return nil
+}
+
+func TestAdjustCordon(t *testing.T) {
+	config := &rollerConfig{defaults: asgSettings{strategy: strategySurge, maxSurge: intOrPercent{value: 1}, maxUnavailable: intOrPercent{value: 1}, cordonOldNodes: true, cordonTaint: true}}
+	store := newMemoryStateStore()
+	states := map[string]*rolloutState{}
+	asgSvc := &mockAsgSvc{groups: map[string]*autoscaling.Group{
+		"myasg": testGroup("myasg", 2, 5, []string{"1", "2"}, nil, nil),
+	}}
+	handler := &cordoningReadyHandler{}
+	if err := adjust(context.Background(), []string{"myasg"}, &mockEc2Svc{autodescribe: true}, asgSvc, handler, states, store, config); err != nil {
+		t.Fatalf("unexpected error starting: %v", err)
+	}
+	if !testStringEq(handler.cordoned, []string{"1", "2"}) || !handler.tainted {
+		t.Errorf("expected old nodes to be cordoned and tainted at the start, actual %v tainted %v", handler.cordoned, handler.tainted)
+	}
+	if len(handler.uncordoned) != 0 {
+		t.Errorf("expected nothing to be uncordoned yet, actual %v", handler.uncordoned)
+	}
+
+	// going back to the old launch configuration makes the old instances up to date, so the rollout ends
+	asgSvc.groups["myasg"] = testGroup("myasg", 3, 5, nil, []string{"1", "2", "3"}, nil)
+	handler.cordoned = nil
+	if err := adjust(context.Background(), []string{"myasg"}, &mockEc2Svc{autodescribe: true}, asgSvc, handler, states, store, config); err != nil {
+		t.Fatalf("unexpected error aborting: %v", err)
+	}
+	if len(handler.cordoned) != 0 {
+		t.Errorf("expected no more cordoning, actual %v", handler.cordoned)
+	}
+	if !testStringEq(handler.uncordoned, []string{"1", "2", "3"}) {
+		t.Errorf("expected the nodes to be uncordoned when the rollout ends, actual %v", handler.uncordoned)
+	}
+	if _, ok := states["myasg"]; ok {
+		t.Errorf("expected state to be removed, got %v", states["myasg"])
+	}
+}
+
+// protectingReadyHandler also remembers which nodes it was asked to protect from scale down
+type protectingReadyHandler struct {
+	recordingReadyHandler
+	protected   []string
+	unprotected []string
+}
+
+func (p *protectingReadyHandler) protect(hostnames []string, ids []string) error {
+	p.protected = append(p.protected, ids...)
+	return nil
+}
+func (p *protectingReadyHandler) unprotect(hostnames []string, ids []string) error {
+	p.unprotected = append(p.unprotected, ids...)
+	return nil
+}
+
+func TestAdjustAutoscalerInteraction(t *testing.T) {
+	config := &rollerConfig{defaults: asgSettings{strategy: strategySurge, maxSurge: intOrPercent{value: 1}, maxUnavailable: intOrPercent{value: 1}, protectNewNodes: true, suspendProcesses: []string{"AlarmNotification", "AZRebalance"}}}
+	store := newMemoryStateStore()
+	states := map[string]*rolloutState{}
+	group := testGroup("myasg", 2, 5, []string{"1", "2"}, nil, nil)
+	// someone else suspended this one, so it is not ours to resume
+	group.SuspendedProcesses = []*autoscaling.SuspendedProcess{{ProcessName: aws.String("AZRebalance")}}
+	asgSvc := &mockAsgSvc{groups: map[string]*autoscaling.Group{"myasg": group}}
+	handler := &protectingReadyHandler{}
+	if err := adjust(context.Background(), []string{"myasg"}, &mockEc2Svc{autodescribe: true}, asgSvc, handler, states, store, config); err != nil {
+		t.Fatalf("unexpected error starting: %v", err)
+	}
+	suspendCalls := asgSvc.counter.filterByName("SuspendProcesses")
+	if len(suspendCalls) != 1 || !testStringEq(aws.StringValueSlice(suspendCalls[0].params[0].(*autoscaling.ScalingProcessQuery).ScalingProcesses), []string{"AlarmNotification"}) {
+		t.Errorf("expected a single call to suspend AlarmNotification, got %v", suspendCalls)
+	}
+	if states["myasg"] == nil || !testStringEq(states["myasg"].SuspendedProcesses, []string{"AlarmNotification"}) {
+		t.Errorf("expected state to record the suspended processes, got %v", states["myasg"])
+	}
+
+	// mid-rollout, with the processes suspended, only the new node is protected
+	group = testGroup("myasg", 3, 5, []string{"1", "2"}, []string{"3"}, nil)
+	group.SuspendedProcesses = []*autoscaling.SuspendedProcess{{ProcessName: aws.String("AZRebalance")}, {ProcessName: aws.String("AlarmNotification")}}
+	asgSvc = &mockAsgSvc{groups: map[string]*autoscaling.Group{"myasg": group}}
+	if err := adjust(context.Background(), []string{"myasg"}, &mockEc2Svc{autodescribe: true}, asgSvc, handler, states, store, config); err != nil {
+		t.Fatalf("unexpected error rolling: %v", err)
+	}
+	if calls := asgSvc.counter.filterByName("SuspendProcesses"); len(calls) != 0 {
+		t.Errorf("expected no more calls to suspend, got %v", calls)
+	}
+	if !testStringEq(handler.protected, []string{"3"}) {
+		t.Errorf("mismatched protected nodes, actual %v", handler.protected)
+	}
+
+	// finished: resume what we suspended, and remove the protection
+	group = testGroup("myasg", 3, 5, nil, []string{"3", "4"}, nil)
+	asgSvc = &mockAsgSvc{groups: map[string]*autoscaling.Group{"myasg": group}}
+	if err := adjust(context.Background(), []string{"myasg"}, &mockEc2Svc{autodescribe: true}, asgSvc, handler, states, store, config); err != nil {
+		t.Fatalf("unexpected error finishing: %v", err)
+	}
+	resumeCalls := asgSvc.counter.filterByName("ResumeProcesses")
+	if len(resumeCalls) != 1 || !testStringEq(aws.StringValueSlice(resumeCalls[0].params[0].(*autoscaling.ScalingProcessQuery).ScalingProcesses), []string{"AlarmNotification"}) {
+		t.Errorf("expected a single call to resume AlarmNotification, got %v", resumeCalls)
+	}
+	if !testStringEq(handler.unprotected, []string{"3", "4"}) {
+		t.Errorf("mismatched unprotected nodes, actual %v", handler.unprotected)
+	}
+	if _, ok := states["myasg"]; ok {
+		t.Errorf("expected state to be removed, got %v", states["myasg"])
+	}
+}
+
+func TestAdjustReconcileDesired(t *testing.T) {
+	config := &rollerConfig{defaults: asgSettings{strategy: strategySurge, maxSurge: intOrPercent{value: 1}, maxUnavailable: intOrPercent{value: 1}, reconcileDesired: true}}
+	store := newMemoryStateStore()
+	states := map[string]*rolloutState{}
+	asgSvc := &mockAsgSvc{groups: map[string]*autoscaling.Group{
+		"myasg": testGroup("myasg", 3, 10, []string{"1", "2", "3"}, nil, nil),
+	}}
+	if err := adjust(context.Background(), []string{"myasg"}, &mockEc2Svc{autodescribe: true}, asgSvc, nil, states, store, config); err != nil {
+		t.Fatalf("unexpected error starting: %v", err)
+	}
+	if state := states["myasg"]; state == nil || state.OriginalDesired != 3 || state.LastDesired != 4 {
+		t.Fatalf("expected original desired 3 and last desired 4, got %+v", state)
+	}
+
+	// something else scales up by 2 while we are surging
+	asgSvc.groups["myasg"] = testGroup("myasg", 6, 10, []string{"1", "2", "3"}, []string{"4"}, nil)
+	if err := adjust(context.Background(), []string{"myasg"}, &mockEc2Svc{autodescribe: true}, asgSvc, nil, states, store, config); err != nil {
+		t.Fatalf("unexpected error reconciling: %v", err)
+	}
+	if state := states["myasg"]; state == nil || state.OriginalDesired != 5 || state.LastDesired != 6 {
+		t.Errorf("expected original desired 5 and last desired 6, got %+v", state)
+	}
+}
+
+func TestReconcileOriginalDesired(t *testing.T) {
+	tests := []struct {
+		current         int64
+		originalDesired int64
+		lastDesired     int64
+		reconciled      int64
+	}{
+		{4, 3, 4, 3},
+		{6, 3, 4, 5},
+		{2, 3, 4, 1},
+		{1, 3, 4, 1},
+		{9, 3, 0, 3},
+	}
+	for i, tt := range tests {
+		asg := &autoscaling.Group{AutoScalingGroupName: aws.String("myasg"), DesiredCapacity: aws.Int64(tt.current)}
+		state := &rolloutState{OriginalDesired: tt.originalDesired, LastDesired: tt.lastDesired}
+		if reconciled := reconcileOriginalDesired(asg, state); reconciled != tt.reconciled {
+			t.Errorf("%d: mismatched original desired, actual %d expected %d", i, reconciled, tt.reconciled)
+		}
+	}
+}
+
+// eventingReadyHandler also remembers the events it was asked to record
+type eventingReadyHandler struct {
+	recordingReadyHandler
+	events []string
+}
+
+func (e *eventingReadyHandler) rolloutEvent(asg string, eventType, reason, message string) {
+	e.events = append(e.events, fmt.Sprintf("%s %s %s", asg, eventType, reason))
+}
+func (e *eventingReadyHandler) instanceEvent(hostname string, id string, eventType, reason, message string) {
+	e.events = append(e.events, fmt.Sprintf("%s=%s %s %s", id, hostname, eventType, reason))
+}
+
+func TestAdjustEvents(t *testing.T) {
+	config := &rollerConfig{defaults: asgSettings{strategy: strategySurge, maxSurge: intOrPercent{value: 1}, maxUnavailable: intOrPercent{value: 1}}}
+	store := newMemoryStateStore()
+	states := map[string]*rolloutState{}
+	asgSvc := &mockAsgSvc{groups: map[string]*autoscaling.Group{
+		"myasg": testGroup("myasg", 2, 5, []string{"1", "2"}, nil, nil),
+	}}
+	handler := &eventingReadyHandler{}
+	steps := []struct {
+		group  *autoscaling.Group
+		events []string
+	}{
+		{testGroup("myasg", 2, 5, []string{"1", "2"}, nil, nil), []string{"myasg Normal RolloutStarted"}},
+		{testGroup("myasg", 3, 5, []string{"1", "2"}, []string{"3"}, nil), []string{"1=host1 Normal Terminating"}},
+		{testGroup("myasg", 3, 5, nil, []string{"3", "4", "5"}, nil), []string{"myasg Normal RolloutComplete"}},
+	}
+	for i, step := range steps {
+		asgSvc.groups["myasg"] = step.group
+		handler.events = nil
+		if err := adjust(context.Background(), []string{"myasg"}, &mockEc2Svc{autodescribe: true}, asgSvc, handler, states, store, config); err != nil {
+			t.Fatalf("%d: unexpected error: %v", i, err)
+		}
+		if !testStringEq(handler.events, step.events) {
+			t.Errorf("%d: mismatched events, actual %v expected %v", i, handler.events, step.events)
+		}
+	}
+}
+
+func TestInstanceDescriptors(t *testing.T) {
+	instanceMap := map[string]*instanceInfo{
+		"1": {id: "1", privateDNSName: "ip-1", privateIP: "10.0.0.1", availabilityZone: "us-east-1a", tags: map[string]string{"team": "web"}},
+	}
+	instances := instanceDescriptors([]string{"1", "gone"}, instanceMap)
+	if len(instances) != 2 {
+		t.Fatalf("expected a descriptor for each instance, actual %v", instances)
+	}
+	if d := instances[0]; d.id != "1" || d.hostname != "ip-1" || d.privateIP != "10.0.0.1" || d.availabilityZone != "us-east-1a" || d.tags["team"] != "web" {
+		t.Errorf("mismatched descriptor, actual %+v", d)
+	}
+	// an instance EC2 does not know about is described by its ID alone
+	if d := instances[1]; d.id != "gone" || d.hostname != "" {
+		t.Errorf("mismatched descriptor, actual %+v", d)
+	}
+}
+
+func TestUnreadyInstances(t *testing.T) {
+	results := []instanceReadiness{
+		{id: "3", reason: "booting"},
+		{id: "1", ready: true},
+	}
+	unready := make([]string, 0)
+	for _, r := range unreadyInstances([]string{"1", "2", "3"}, results) {
+		unready = append(unready, fmt.Sprintf("%s=%s", r.id, r.reason))
+	}
+	// in the order asked for, including any not reported on
+	if expected := []string{"2=readiness handler did not report on it", "3=booting"}; !testStringEq(unready, expected) {
+		t.Errorf("mismatched unready instances, actual %v expected %v", unready, expected)
+	}
+}
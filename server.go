@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const defaultHTTPAddress = ":8080" // Default address to serve metrics and health checks on
+
+// Returns the address to serve metrics and health checks on, empty if disabled
+func getHTTPAddress() string {
+	address, exist := os.LookupEnv("ROLLER_HTTP_ADDRESS")
+	if !exist {
+		return defaultHTTPAddress
+	}
+	return address
+}
+
+// newHTTPHandler returns the handler for everything we serve over HTTP
+func newHTTPHandler(h *health) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.Handle("/healthz", healthHandler(func(ctx context.Context) error {
+		return h.live()
+	}))
+	mux.Handle("/readyz", healthHandler(h.ready))
+	return mux
+}
+
+// serveHTTP serves metrics and health checks on address in the background. Since we can roll without
+// them, failing to is not fatal.
+func serveHTTP(address string, h *health) {
+	server := &http.Server{Addr: address, Handler: newHTTPHandler(h)}
+	go func() {
+		log.Printf("Serving metrics and health checks on %s", address)
+		if err := server.ListenAndServe(); err != nil {
+			log.Printf("Unable to serve metrics and health checks on %s: %v", address, err)
+		}
+	}()
+}
@@ -0,0 +1,498 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const (
+	tagMaxSurge         = "aws-asg-roller/max-surge"
+	tagMaxUnavailable   = "aws-asg-roller/max-unavailable"
+	tagStrategy         = "aws-asg-roller/strategy"
+	tagRaiseMaxSize     = "aws-asg-roller/raise-max-size"
+	tagTerminationOrder = "aws-asg-roller/termination-order"
+
+	tagCordonOldNodes = "aws-asg-roller/cordon-old-nodes"
+	tagCordonTaint    = "aws-asg-roller/cordon-taint"
+
+	tagProtectNewNodes  = "aws-asg-roller/protect-new-nodes"
+	tagSuspendProcesses = "aws-asg-roller/suspend-processes"
+	tagReconcileDesired = "aws-asg-roller/reconcile-desired"
+
+	tagDrainTimeout            = "aws-asg-roller/drain-timeout"
+	tagDrainGracePeriod        = "aws-asg-roller/drain-grace-period"
+	tagDrainDeleteEmptyDirData = "aws-asg-roller/drain-delete-emptydir-data"
+	tagDrainForce              = "aws-asg-roller/drain-force"
+	tagDrainSkipPods           = "aws-asg-roller/drain-skip-pods"
+	tagDrainTimeoutPolicy      = "aws-asg-roller/drain-timeout-policy"
+	tagWaitForReschedule       = "aws-asg-roller/wait-for-reschedule"
+	tagRescheduleTimeout       = "aws-asg-roller/reschedule-timeout"
+
+	tagNodeUnhealthyConditions = "aws-asg-roller/node-unhealthy-conditions"
+	tagNodeBlockingTaints      = "aws-asg-roller/node-blocking-taints"
+
+	defaultMaxSurge       = "1"
+	defaultMaxUnavailable = "1"
+
+	// strategySurge adds new instances before terminating old ones
+	strategySurge = "surge"
+	// strategyUnavailable terminates old instances and waits for the ASG to replace them
+	strategyUnavailable = "unavailable"
+
+	// suspendableProcesses are the ASG scaling processes that may be suspended during a rollout.
+	// The others launch, terminate or check the health of instances, which the rollout relies on.
+	suspendableProcesses = "AlarmNotification,ScheduledActions,AZRebalance"
+
+	// drainTimeoutRetry fails the adjustment when a drain times out, so it is tried again next time
+	drainTimeoutRetry = "retry"
+	// drainTimeoutSkip leaves an instance whose drain timed out for now, and moves on to the next one
+	drainTimeoutSkip = "skip"
+	// drainTimeoutForce deletes whatever pods are left when a drain times out, and terminates the instance
+	drainTimeoutForce = "force"
+)
+
+// intOrPercent is a count that is either absolute, e.g. "3", or a percentage of some total, e.g. "25%"
+type intOrPercent struct {
+	value   int64
+	percent bool
+}
+
+func parseIntOrPercent(s string) (intOrPercent, error) {
+	var ret intOrPercent
+	trimmed := strings.TrimSpace(s)
+	if strings.HasSuffix(trimmed, "%") {
+		ret.percent = true
+		trimmed = strings.TrimSuffix(trimmed, "%")
+	}
+	value, err := strconv.ParseInt(trimmed, 10, 64)
+	if err != nil {
+		return ret, fmt.Errorf("%s is not a number or percentage", s)
+	}
+	if value < 0 {
+		return ret, fmt.Errorf("%s must not be negative", s)
+	}
+	ret.value = value
+	return ret, nil
+}
+
+// resolve returns the count, calculating percentages of total and rounding up
+func (i intOrPercent) resolve(total int64) int64 {
+	if !i.percent {
+		return i.value
+	}
+	return (i.value*total + 99) / 100
+}
+
+func (i intOrPercent) String() string {
+	if i.percent {
+		return fmt.Sprintf("%d%%", i.value)
+	}
+	return fmt.Sprintf("%d", i.value)
+}
+
+// asgSettings control how a single ASG is rolled
+type asgSettings struct {
+	// strategy is how we replace instances, one of strategySurge or strategyUnavailable
+	strategy string
+	// maxSurge is how many instances above the original desired we may add, and therefore how many
+	// old instances we may replace, at once
+	maxSurge intOrPercent
+	// maxUnavailable is how many old instances we may terminate at once when not surging
+	maxUnavailable intOrPercent
+	// raiseMaxSize allows us to raise the ASG's MaxSize during a rollout if we need room to surge,
+	// restoring it afterwards. Otherwise, we surge by as much as there is room for, or fall back to
+	// strategyUnavailable if there is none.
+	raiseMaxSize bool
+	// terminationOrder picks which old instances to terminate first, one of terminationOrders
+	terminationOrder string
+	// cordonOldNodes stops new pods being scheduled on any old instance when a rollout starts, so
+	// that pods evicted from one old node do not land on another, only to be evicted again
+	cordonOldNodes bool
+	// cordonTaint also taints old nodes with PreferNoSchedule when cordoning them
+	cordonTaint bool
+	// protectNewNodes stops cluster-autoscaler scaling down new instances during a rollout
+	protectNewNodes bool
+	// suspendProcesses are the ASG's scaling processes to suspend during a rollout, e.g. AlarmNotification,
+	// so scaling policies do not change the desired capacity under us
+	suspendProcesses []string
+	// reconcileDesired keeps track of changes made to the desired capacity by anything else during a rollout,
+	// e.g. a person or autoscaler, and applies them to the original desired we restore at the end
+	reconcileDesired bool
+	// drain controls how the nodes of old instances are drained before they are terminated
+	drain drainSettings
+	// readiness controls when the nodes of new instances are ready for usage
+	readiness readinessSettings
+}
+
+// drainSettings control how the readiness handler prepares an old instance for termination
+type drainSettings struct {
+	// timeout is how long to wait for a drain to finish, 0 for no limit
+	timeout time.Duration
+	// timeoutPolicy is what to do when a drain times out, one of drainTimeoutRetry, drainTimeoutSkip
+	// or drainTimeoutForce
+	timeoutPolicy string
+	// gracePeriod overrides the termination grace period of evicted pods, in seconds, -1 to use each pod's own
+	gracePeriod int
+	// deleteEmptyDirData allows evicting pods with emptyDir volumes, whose data is lost
+	deleteEmptyDirData bool
+	// force allows deleting pods without a controller, which are not recreated anywhere
+	force bool
+	// podSelector selects which pods to drain, leaving the rest on the node; nil drains them all
+	podSelector labels.Selector
+	// waitForReschedule waits after draining a node until its pods are running elsewhere
+	waitForReschedule bool
+	// rescheduleTimeout is how long to wait for them
+	rescheduleTimeout time.Duration
+}
+
+// readinessSettings control when the readiness handler considers a new instance ready
+type readinessSettings struct {
+	// unhealthyConditions are node conditions, besides Ready, that make a node not ready if they are True
+	unhealthyConditions []corev1.NodeConditionType
+	// blockingTaints make a node not ready while it has any of them
+	blockingTaints []taintMatcher
+}
+
+// rollerConfig holds the settings for all of the ASGs we manage
+type rollerConfig struct {
+	// defaults apply to every ASG, unless overridden by the config file or tags on the ASG itself
+	defaults asgSettings
+	// overrides are the settings of ASGs listed in the config file, by name, which tags may override in turn
+	overrides map[string]asgSettings
+}
+
+// getRollerConfig reads the default settings from the environment, and then the config file, if any
+func getRollerConfig(file *configFile) (*rollerConfig, error) {
+	var (
+		defaults asgSettings
+		err      error
+	)
+	defaults.strategy = os.Getenv("ROLLER_STRATEGY")
+	if defaults.strategy == "" {
+		defaults.strategy = strategySurge
+	}
+	if err = validateStrategy(defaults.strategy); err != nil {
+		return nil, fmt.Errorf("ROLLER_STRATEGY is invalid: %v", err)
+	}
+	maxSurge := os.Getenv("ROLLER_MAX_SURGE")
+	if maxSurge == "" {
+		maxSurge = defaultMaxSurge
+	}
+	if defaults.maxSurge, err = parsePositiveIntOrPercent(maxSurge); err != nil {
+		return nil, fmt.Errorf("ROLLER_MAX_SURGE is invalid: %v", err)
+	}
+	maxUnavailable := os.Getenv("ROLLER_MAX_UNAVAILABLE")
+	if maxUnavailable == "" {
+		maxUnavailable = defaultMaxUnavailable
+	}
+	if defaults.maxUnavailable, err = parsePositiveIntOrPercent(maxUnavailable); err != nil {
+		return nil, fmt.Errorf("ROLLER_MAX_UNAVAILABLE is invalid: %v", err)
+	}
+	defaults.raiseMaxSize = os.Getenv("ROLLER_RAISE_MAX_SIZE") == "true"
+	defaults.terminationOrder = os.Getenv("ROLLER_TERMINATION_ORDER")
+	if defaults.terminationOrder == "" {
+		defaults.terminationOrder = orderDefault
+	}
+	if err = validateTerminationOrder(defaults.terminationOrder); err != nil {
+		return nil, fmt.Errorf("ROLLER_TERMINATION_ORDER is invalid: %v", err)
+	}
+	defaults.cordonOldNodes = os.Getenv("ROLLER_CORDON_OLD_NODES") == "true"
+	defaults.cordonTaint = os.Getenv("ROLLER_CORDON_TAINT") == "true"
+	defaults.protectNewNodes = os.Getenv("ROLLER_PROTECT_NEW_NODES") == "true"
+	if defaults.suspendProcesses, err = parseProcesses(os.Getenv("ROLLER_SUSPEND_PROCESSES")); err != nil {
+		return nil, fmt.Errorf("ROLLER_SUSPEND_PROCESSES is invalid: %v", err)
+	}
+	defaults.reconcileDesired = os.Getenv("ROLLER_RECONCILE_DESIRED") == "true"
+	if defaults.drain, err = getDrainSettings(); err != nil {
+		return nil, err
+	}
+	if defaults.readiness, err = getReadinessSettings(); err != nil {
+		return nil, err
+	}
+	config := &rollerConfig{
+		defaults:  defaults,
+		overrides: map[string]asgSettings{},
+	}
+	if file == nil {
+		return config, nil
+	}
+	config.defaults, err = applySettings(defaults, asTags(file.Defaults), func(tag string) string {
+		return fmt.Sprintf("config file defaults setting %s", strings.TrimPrefix(tag, configTagPrefix))
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, values := range file.ASGs {
+		name := string(values[configNameKey])
+		config.overrides[name], err = applySettings(config.defaults, asTags(values), func(tag string) string {
+			return fmt.Sprintf("config file ASG %s setting %s", name, strings.TrimPrefix(tag, configTagPrefix))
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return config, nil
+}
+
+// getDrainSettings reads the default drain settings from the environment
+func getDrainSettings() (drainSettings, error) {
+	var (
+		d   drainSettings
+		err error
+	)
+	if d.timeout, err = parseDrainTimeout(os.Getenv("ROLLER_DRAIN_TIMEOUT")); err != nil {
+		return d, fmt.Errorf("ROLLER_DRAIN_TIMEOUT is invalid: %v", err)
+	}
+	d.timeoutPolicy = os.Getenv("ROLLER_DRAIN_TIMEOUT_POLICY")
+	if d.timeoutPolicy == "" {
+		d.timeoutPolicy = drainTimeoutRetry
+	}
+	if err = validateDrainTimeoutPolicy(d.timeoutPolicy); err != nil {
+		return d, fmt.Errorf("ROLLER_DRAIN_TIMEOUT_POLICY is invalid: %v", err)
+	}
+	if d.gracePeriod, err = parseGracePeriod(os.Getenv("ROLLER_DRAIN_GRACE_PERIOD")); err != nil {
+		return d, fmt.Errorf("ROLLER_DRAIN_GRACE_PERIOD is invalid: %v", err)
+	}
+	d.deleteEmptyDirData = os.Getenv("ROLLER_DRAIN_DELETE_EMPTYDIR_DATA") == "true"
+	d.force = os.Getenv("ROLLER_DRAIN_FORCE") != "false"
+	if d.podSelector, err = parseSkipPods(os.Getenv("ROLLER_DRAIN_SKIP_PODS")); err != nil {
+		return d, fmt.Errorf("ROLLER_DRAIN_SKIP_PODS is invalid: %v", err)
+	}
+	d.waitForReschedule = os.Getenv("ROLLER_WAIT_FOR_RESCHEDULE") == "true"
+	d.rescheduleTimeout = defaultRescheduleTimeout * time.Second
+	if timeoutOverride, exist := os.LookupEnv("ROLLER_RESCHEDULE_TIMEOUT"); exist {
+		if d.rescheduleTimeout, err = parseRescheduleTimeout(timeoutOverride); err != nil {
+			return d, fmt.Errorf("ROLLER_RESCHEDULE_TIMEOUT is invalid: %v", err)
+		}
+	}
+	return d, nil
+}
+
+// getReadinessSettings reads the default readiness settings from the environment
+func getReadinessSettings() (readinessSettings, error) {
+	var (
+		r   readinessSettings
+		err error
+	)
+	r.unhealthyConditions = parseConditionTypes(os.Getenv("ROLLER_NODE_UNHEALTHY_CONDITIONS"))
+	if r.blockingTaints, err = parseTaintMatchers(os.Getenv("ROLLER_NODE_BLOCKING_TAINTS")); err != nil {
+		return r, fmt.Errorf("ROLLER_NODE_BLOCKING_TAINTS is invalid: %v", err)
+	}
+	return r, nil
+}
+
+// settingsFor returns the settings for a specific ASG, applying any overrides from the config file, and then its tags
+func (c *rollerConfig) settingsFor(asg *autoscaling.Group) (asgSettings, error) {
+	name := aws.StringValue(asg.AutoScalingGroupName)
+	settings, ok := c.overrides[name]
+	if !ok {
+		settings = c.defaults
+	}
+	tags := map[string]string{}
+	for _, t := range asg.Tags {
+		tags[aws.StringValue(t.Key)] = aws.StringValue(t.Value)
+	}
+	return applySettings(settings, tags, func(tag string) string {
+		return fmt.Sprintf("ASG %s tag %s", name, tag)
+	})
+}
+
+// applySettings overrides settings with the values of any of tags that are settings, keyed by their tag names.
+// describe says where a tag came from when it is invalid.
+func applySettings(settings asgSettings, tags map[string]string, describe func(tag string) string) (asgSettings, error) {
+	if value, ok := tags[tagMaxSurge]; ok {
+		surge, err := parsePositiveIntOrPercent(value)
+		if err != nil {
+			return settings, fmt.Errorf("%s is invalid: %v", describe(tagMaxSurge), err)
+		}
+		settings.maxSurge = surge
+	}
+	if value, ok := tags[tagMaxUnavailable]; ok {
+		unavailable, err := parsePositiveIntOrPercent(value)
+		if err != nil {
+			return settings, fmt.Errorf("%s is invalid: %v", describe(tagMaxUnavailable), err)
+		}
+		settings.maxUnavailable = unavailable
+	}
+	if value, ok := tags[tagStrategy]; ok {
+		if err := validateStrategy(value); err != nil {
+			return settings, fmt.Errorf("%s is invalid: %v", describe(tagStrategy), err)
+		}
+		settings.strategy = value
+	}
+	if value, ok := tags[tagRaiseMaxSize]; ok {
+		settings.raiseMaxSize = value == "true"
+	}
+	if value, ok := tags[tagTerminationOrder]; ok {
+		if err := validateTerminationOrder(value); err != nil {
+			return settings, fmt.Errorf("%s is invalid: %v", describe(tagTerminationOrder), err)
+		}
+		settings.terminationOrder = value
+	}
+	if value, ok := tags[tagCordonOldNodes]; ok {
+		settings.cordonOldNodes = value == "true"
+	}
+	if value, ok := tags[tagCordonTaint]; ok {
+		settings.cordonTaint = value == "true"
+	}
+	if value, ok := tags[tagProtectNewNodes]; ok {
+		settings.protectNewNodes = value == "true"
+	}
+	if value, ok := tags[tagSuspendProcesses]; ok {
+		processes, err := parseProcesses(value)
+		if err != nil {
+			return settings, fmt.Errorf("%s is invalid: %v", describe(tagSuspendProcesses), err)
+		}
+		settings.suspendProcesses = processes
+	}
+	if value, ok := tags[tagReconcileDesired]; ok {
+		settings.reconcileDesired = value == "true"
+	}
+	if value, ok := tags[tagDrainTimeout]; ok {
+		timeout, err := parseDrainTimeout(value)
+		if err != nil {
+			return settings, fmt.Errorf("%s is invalid: %v", describe(tagDrainTimeout), err)
+		}
+		settings.drain.timeout = timeout
+	}
+	if value, ok := tags[tagDrainTimeoutPolicy]; ok {
+		if err := validateDrainTimeoutPolicy(value); err != nil {
+			return settings, fmt.Errorf("%s is invalid: %v", describe(tagDrainTimeoutPolicy), err)
+		}
+		settings.drain.timeoutPolicy = value
+	}
+	if value, ok := tags[tagDrainGracePeriod]; ok {
+		gracePeriod, err := parseGracePeriod(value)
+		if err != nil {
+			return settings, fmt.Errorf("%s is invalid: %v", describe(tagDrainGracePeriod), err)
+		}
+		settings.drain.gracePeriod = gracePeriod
+	}
+	if value, ok := tags[tagDrainDeleteEmptyDirData]; ok {
+		settings.drain.deleteEmptyDirData = value == "true"
+	}
+	if value, ok := tags[tagDrainForce]; ok {
+		settings.drain.force = value != "false"
+	}
+	if value, ok := tags[tagDrainSkipPods]; ok {
+		selector, err := parseSkipPods(value)
+		if err != nil {
+			return settings, fmt.Errorf("%s is invalid: %v", describe(tagDrainSkipPods), err)
+		}
+		settings.drain.podSelector = selector
+	}
+	if value, ok := tags[tagWaitForReschedule]; ok {
+		settings.drain.waitForReschedule = value == "true"
+	}
+	if value, ok := tags[tagRescheduleTimeout]; ok {
+		timeout, err := parseRescheduleTimeout(value)
+		if err != nil {
+			return settings, fmt.Errorf("%s is invalid: %v", describe(tagRescheduleTimeout), err)
+		}
+		settings.drain.rescheduleTimeout = timeout
+	}
+	if value, ok := tags[tagNodeUnhealthyConditions]; ok {
+		settings.readiness.unhealthyConditions = parseConditionTypes(value)
+	}
+	if value, ok := tags[tagNodeBlockingTaints]; ok {
+		taints, err := parseTaintMatchers(value)
+		if err != nil {
+			return settings, fmt.Errorf("%s is invalid: %v", describe(tagNodeBlockingTaints), err)
+		}
+		settings.readiness.blockingTaints = taints
+	}
+	return settings, nil
+}
+
+func validateStrategy(s string) error {
+	switch s {
+	case strategySurge, strategyUnavailable:
+		return nil
+	default:
+		return fmt.Errorf("unknown strategy %s, must be one of: %s, %s", s, strategySurge, strategyUnavailable)
+	}
+}
+
+// parseProcesses parses a list of ASG scaling processes, separated by commas or spaces, as AWS
+// does not allow commas in tag values
+func parseProcesses(s string) ([]string, error) {
+	allowed := map[string]bool{}
+	for _, p := range strings.Split(suspendableProcesses, ",") {
+		allowed[p] = true
+	}
+	processes := splitList(s)
+	for _, p := range processes {
+		if !allowed[p] {
+			return nil, fmt.Errorf("cannot suspend process %s, must be one of: %s", p, suspendableProcesses)
+		}
+	}
+	return processes, nil
+}
+
+func validateDrainTimeoutPolicy(s string) error {
+	switch s {
+	case drainTimeoutRetry, drainTimeoutSkip, drainTimeoutForce:
+		return nil
+	default:
+		return fmt.Errorf("unknown drain timeout policy %s, must be one of: %s, %s, %s", s, drainTimeoutRetry, drainTimeoutSkip, drainTimeoutForce)
+	}
+}
+
+// parseDrainTimeout parses a number of seconds, where empty or 0 means no timeout
+func parseDrainTimeout(s string) (time.Duration, error) {
+	if s = strings.TrimSpace(s); s == "" {
+		return 0, nil
+	}
+	seconds, err := strconv.Atoi(s)
+	if err != nil || seconds < 0 {
+		return 0, fmt.Errorf("%s is not a valid number of seconds", s)
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// splitList splits a list separated by commas or spaces, as AWS does not allow commas in tag values
+func splitList(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == ' '
+	})
+}
+
+// parseRescheduleTimeout parses a number of seconds, which must be positive
+func parseRescheduleTimeout(s string) (time.Duration, error) {
+	seconds, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil || seconds <= 0 {
+		return 0, fmt.Errorf("%s is not a valid number of seconds", s)
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// parseGracePeriod parses a number of seconds, where empty or -1 means each pod's own grace period
+func parseGracePeriod(s string) (int, error) {
+	if s = strings.TrimSpace(s); s == "" {
+		return -1, nil
+	}
+	seconds, err := strconv.Atoi(s)
+	if err != nil || seconds < -1 {
+		return 0, fmt.Errorf("%s is not a valid number of seconds", s)
+	}
+	return seconds, nil
+}
+
+func parsePositiveIntOrPercent(s string) (intOrPercent, error) {
+	surge, err := parseIntOrPercent(s)
+	if err != nil {
+		return surge, err
+	}
+	if surge.value == 0 {
+		return surge, fmt.Errorf("%s must be greater than zero", s)
+	}
+	return surge, nil
+}
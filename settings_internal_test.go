@@ -0,0 +1,146 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+func TestParseIntOrPercent(t *testing.T) {
+	tests := []struct {
+		value       string
+		total       int64
+		resolved    int64
+		shouldError bool
+	}{
+		{"3", 10, 3, false},
+		{" 3 ", 10, 3, false},
+		{"25%", 10, 3, false},
+		{"50%", 4, 2, false},
+		{"100%", 7, 7, false},
+		{"0", 10, 0, false},
+		{"-1", 10, 0, true},
+		{"abc", 10, 0, true},
+		{"%", 10, 0, true},
+	}
+	for i, tt := range tests {
+		v, err := parseIntOrPercent(tt.value)
+		switch {
+		case err != nil && !tt.shouldError:
+			t.Errorf("%d: unexpected error: %v", i, err)
+		case err == nil && tt.shouldError:
+			t.Errorf("%d: expected error for %s", i, tt.value)
+		case err == nil && v.resolve(tt.total) != tt.resolved:
+			t.Errorf("%d: mismatched resolved value, actual %d expected %d", i, v.resolve(tt.total), tt.resolved)
+		}
+	}
+}
+
+func TestSettingsFor(t *testing.T) {
+	config := &rollerConfig{defaults: asgSettings{maxSurge: intOrPercent{value: 1}, terminationOrder: orderDefault}}
+	tests := []struct {
+		tags             map[string]string
+		maxSurge         intOrPercent
+		terminationOrder string
+		shouldError      bool
+	}{
+		{nil, intOrPercent{value: 1}, orderDefault, false},
+		{map[string]string{"Name": "foo"}, intOrPercent{value: 1}, orderDefault, false},
+		{map[string]string{tagMaxSurge: "5"}, intOrPercent{value: 5}, orderDefault, false},
+		{map[string]string{tagMaxSurge: "20%"}, intOrPercent{value: 20, percent: true}, orderDefault, false},
+		{map[string]string{tagMaxSurge: "0"}, intOrPercent{}, "", true},
+		{map[string]string{tagMaxSurge: "many"}, intOrPercent{}, "", true},
+		{map[string]string{tagTerminationOrder: orderAZBalanced}, intOrPercent{value: 1}, orderAZBalanced, false},
+		{map[string]string{tagTerminationOrder: "newest"}, intOrPercent{}, "", true},
+	}
+	for i, tt := range tests {
+		asg := &autoscaling.Group{AutoScalingGroupName: aws.String("myasg")}
+		for k, v := range tt.tags {
+			asg.Tags = append(asg.Tags, &autoscaling.TagDescription{Key: aws.String(k), Value: aws.String(v)})
+		}
+		settings, err := config.settingsFor(asg)
+		switch {
+		case err != nil && !tt.shouldError:
+			t.Errorf("%d: unexpected error: %v", i, err)
+		case err == nil && tt.shouldError:
+			t.Errorf("%d: expected error", i)
+		case err == nil && settings.maxSurge != tt.maxSurge:
+			t.Errorf("%d: mismatched maxSurge, actual %v expected %v", i, settings.maxSurge, tt.maxSurge)
+		case err == nil && settings.terminationOrder != tt.terminationOrder:
+			t.Errorf("%d: mismatched terminationOrder, actual %s expected %s", i, settings.terminationOrder, tt.terminationOrder)
+		}
+	}
+}
+
+func TestDrainSettingsFor(t *testing.T) {
+	config := &rollerConfig{defaults: asgSettings{drain: drainSettings{timeoutPolicy: drainTimeoutRetry, gracePeriod: -1, force: true}}}
+	tests := []struct {
+		tags        map[string]string
+		expected    drainSettings
+		shouldError bool
+	}{
+		{nil, drainSettings{timeoutPolicy: drainTimeoutRetry, gracePeriod: -1, force: true}, false},
+		{map[string]string{tagDrainTimeout: "120", tagDrainTimeoutPolicy: drainTimeoutSkip}, drainSettings{timeout: 2 * time.Minute, timeoutPolicy: drainTimeoutSkip, gracePeriod: -1, force: true}, false},
+		{map[string]string{tagDrainGracePeriod: "30", tagDrainForce: "false", tagDrainDeleteEmptyDirData: "true"}, drainSettings{timeoutPolicy: drainTimeoutRetry, gracePeriod: 30, deleteEmptyDirData: true}, false},
+		{map[string]string{tagDrainTimeout: "-5"}, drainSettings{}, true},
+		{map[string]string{tagDrainGracePeriod: "-2"}, drainSettings{}, true},
+		{map[string]string{tagDrainTimeoutPolicy: "wait"}, drainSettings{}, true},
+		{map[string]string{tagDrainSkipPods: "replicas>1"}, drainSettings{}, true},
+	}
+	for i, tt := range tests {
+		asg := &autoscaling.Group{AutoScalingGroupName: aws.String("myasg")}
+		for k, v := range tt.tags {
+			asg.Tags = append(asg.Tags, &autoscaling.TagDescription{Key: aws.String(k), Value: aws.String(v)})
+		}
+		settings, err := config.settingsFor(asg)
+		switch {
+		case err != nil && !tt.shouldError:
+			t.Errorf("%d: unexpected error: %v", i, err)
+		case err == nil && tt.shouldError:
+			t.Errorf("%d: expected error", i)
+		case err == nil && settings.drain != tt.expected:
+			t.Errorf("%d: mismatched drain settings, actual %+v expected %+v", i, settings.drain, tt.expected)
+		}
+	}
+
+	// the selector is of the pods to drain, so skipped pods do not match it
+	settings, err := config.settingsFor(&autoscaling.Group{
+		AutoScalingGroupName: aws.String("myasg"),
+		Tags:                 []*autoscaling.TagDescription{{Key: aws.String(tagDrainSkipPods), Value: aws.String("app=critical")}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if settings.drain.podSelector == nil || settings.drain.podSelector.Matches(labels.Set{"app": "critical"}) || !settings.drain.podSelector.Matches(labels.Set{"app": "web"}) {
+		t.Errorf("mismatched pod selector %v", settings.drain.podSelector)
+	}
+}
+
+func TestParseProcesses(t *testing.T) {
+	tests := []struct {
+		value       string
+		processes   []string
+		shouldError bool
+	}{
+		{"", []string{}, false},
+		{"AlarmNotification", []string{"AlarmNotification"}, false},
+		{"AlarmNotification,ScheduledActions", []string{"AlarmNotification", "ScheduledActions"}, false},
+		{"AlarmNotification AZRebalance", []string{"AlarmNotification", "AZRebalance"}, false},
+		{"Launch", nil, true},
+		{"AlarmNotification,Terminate", nil, true},
+	}
+	for _, tt := range tests {
+		processes, err := parseProcesses(tt.value)
+		switch {
+		case err != nil && !tt.shouldError:
+			t.Errorf("%s: unexpected error: %v", tt.value, err)
+		case err == nil && tt.shouldError:
+			t.Errorf("%s: expected error", tt.value)
+		case err == nil && !testStringEq(processes, tt.processes):
+			t.Errorf("%s: mismatched processes, actual %v expected %v", tt.value, processes, tt.processes)
+		}
+	}
+}
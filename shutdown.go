@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultShutdownGracePeriod = 25 // Default time to finish the current step after SIGTERM, in seconds
+
+	exitShutdownTimeout = 4 // Exit code when the current step does not finish within the shutdown grace period
+)
+
+// Returns how long to wait for the current step to finish after SIGTERM, from ROLLER_SHUTDOWN_GRACE_PERIOD
+func getShutdownGracePeriod() (time.Duration, error) {
+	periodOverride, exist := os.LookupEnv("ROLLER_SHUTDOWN_GRACE_PERIOD")
+	if !exist {
+		return defaultShutdownGracePeriod * time.Second, nil
+	}
+	period, err := strconv.Atoi(periodOverride)
+	if err != nil || period < 0 {
+		return 0, fmt.Errorf("ROLLER_SHUTDOWN_GRACE_PERIOD is not a valid number of seconds: %v", periodOverride)
+	}
+	return time.Duration(period) * time.Second, nil
+}
+
+// shutdownContext returns a context that is cancelled on SIGTERM or SIGINT. Once it is, we have the grace
+// period to stop cleanly, after which we exit anyway, so that we are not killed part way through a step
+// without having logged why.
+func shutdownContext(grace time.Duration) context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-signals
+		log.Printf("Received %v, shutting down within %v", sig, grace)
+		cancel()
+		time.AfterFunc(grace, func() {
+			log.Printf("Did not shut down within %v, exiting", grace)
+			os.Exit(exitShutdownTimeout)
+		})
+	}()
+	return ctx
+}
+
+// sleep waits for delay seconds, or until ctx is cancelled
+func sleep(ctx context.Context, delay int) {
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Duration(delay) * time.Second):
+	}
+}
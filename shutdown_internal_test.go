@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+)
+
+// shutdownReadyHandler is a readiness handler that is shut down while preparing an instance for termination
+type shutdownReadyHandler struct {
+	testReadyHandler
+	cancel context.CancelFunc
+}
+
+func (s *shutdownReadyHandler) prepareTermination(ctx context.Context, instances []instanceDescriptor, opts drainSettings) error {
+	s.cancel()
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestGetShutdownGracePeriod(t *testing.T) {
+	tests := []struct {
+		name        string
+		envValue    string
+		want        time.Duration
+		shouldError bool
+	}{
+		{"should return default", "", 25 * time.Second, false},
+		{"should return override", "50", 50 * time.Second, false},
+		{"should allow zero", "0", 0, false},
+		{"should error if override invalid", "fake", 0, true},
+		{"should error if override negative", "-1", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Unsetenv("ROLLER_SHUTDOWN_GRACE_PERIOD")
+			if tt.envValue != "" {
+				os.Setenv("ROLLER_SHUTDOWN_GRACE_PERIOD", tt.envValue)
+				defer os.Unsetenv("ROLLER_SHUTDOWN_GRACE_PERIOD")
+			}
+			got, err := getShutdownGracePeriod()
+			switch {
+			case err != nil && !tt.shouldError:
+				t.Errorf("unexpected error: %v", err)
+			case err == nil && tt.shouldError:
+				t.Errorf("expected error")
+			case err == nil && got != tt.want:
+				t.Errorf("mismatched grace period, actual %v expected %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSleep(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(30 * time.Millisecond)
+		cancel()
+	}()
+	start := time.Now()
+	sleep(ctx, 60)
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("took %v to stop sleeping", time.Since(start))
+	}
+}
+
+func TestAdjustShutdown(t *testing.T) {
+	config := &rollerConfig{defaults: asgSettings{strategy: strategySurge, maxSurge: intOrPercent{value: 1}, maxUnavailable: intOrPercent{value: 1}}}
+	store := newMemoryStateStore()
+	_ = store.save(context.Background(), "myasg", &rolloutState{OriginalDesired: 3, StartTime: time.Now(), TargetVersion: "newconf"})
+	states, _ := store.load(context.Background(), []string{"myasg"})
+	// mid-rollout, with a new instance ready, so the next old one is drained
+	asgSvc := &mockAsgSvc{groups: map[string]*autoscaling.Group{
+		"myasg": testGroup("myasg", 4, 5, []string{"1", "2", "3"}, []string{"4"}, nil),
+	}}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	handler := &shutdownReadyHandler{cancel: cancel}
+
+	if err := adjust(ctx, []string{"myasg"}, &mockEc2Svc{autodescribe: true}, asgSvc, handler, states, store, config); err == nil {
+		t.Errorf("expected error when shut down while draining")
+	}
+	if calls := asgSvc.counter.filterByName("TerminateInstanceInAutoScalingGroup"); len(calls) != 0 {
+		t.Errorf("expected no instance to be terminated once shut down, got %d", len(calls))
+	}
+	// the next run carries on from the saved state
+	saved, err := store.load(context.Background(), []string{"myasg"})
+	if err != nil || saved["myasg"] == nil || saved["myasg"].OriginalDesired != 3 {
+		t.Errorf("expected rollout state to be kept, got %v, %v", saved["myasg"], err)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
+)
+
+const (
+	stateStoreASG       = "asg"
+	stateStoreConfigMap = "configmap"
+	stateStoreMemory    = "memory"
+)
+
+// rolloutState is everything we need to remember about an in-progress rollout of a single ASG
+// so that we can pick up where we left off if the roller is restarted mid-roll
+type rolloutState struct {
+	// OriginalDesired is the desired capacity of the ASG before we started the rollout
+	OriginalDesired int64 `json:"originalDesired"`
+	// StartTime is when the rollout started
+	StartTime time.Time `json:"startTime"`
+	// TargetVersion is the launch configuration or launch template version we are rolling to
+	TargetVersion string `json:"targetVersion"`
+	// OriginalMaxSize is the max size of the ASG before we raised it to make room to surge, 0 if we did not
+	OriginalMaxSize int64 `json:"originalMaxSize,omitempty"`
+	// SuspendedProcesses are the ASG's scaling processes we suspended for the rollout, to resume at the end
+	SuspendedProcesses []string `json:"suspendedProcesses,omitempty"`
+	// LastDesired is the desired capacity we last set, to tell if anything else has changed it since,
+	// 0 if we are not keeping track
+	LastDesired int64 `json:"lastDesired,omitempty"`
+}
+
+// equal reports whether two states describe the same rollout; either may be nil
+func (r *rolloutState) equal(other *rolloutState) bool {
+	if r == nil || other == nil {
+		return r == other
+	}
+	if len(r.SuspendedProcesses) != len(other.SuspendedProcesses) {
+		return false
+	}
+	for i := range r.SuspendedProcesses {
+		if r.SuspendedProcesses[i] != other.SuspendedProcesses[i] {
+			return false
+		}
+	}
+	return r.OriginalDesired == other.OriginalDesired && r.StartTime.Equal(other.StartTime) && r.TargetVersion == other.TargetVersion && r.OriginalMaxSize == other.OriginalMaxSize && r.LastDesired == other.LastDesired
+}
+
+// stateStore persists rollout state between runs of the roller
+type stateStore interface {
+	// load gets the saved rollout state for each of the named ASGs. ASGs with no rollout in progress
+	// are not included in the returned map.
+	load(ctx context.Context, names []string) (map[string]*rolloutState, error)
+	// save persists the rollout state for the named ASG
+	save(ctx context.Context, name string, state *rolloutState) error
+	// remove clears any rollout state for the named ASG
+	remove(ctx context.Context, name string) error
+}
+
+// memoryStateStore keeps rollout state only in memory; it is lost when the roller restarts
+type memoryStateStore struct {
+	states map[string]*rolloutState
+}
+
+func newMemoryStateStore() *memoryStateStore {
+	return &memoryStateStore{states: map[string]*rolloutState{}}
+}
+
+func (m *memoryStateStore) load(ctx context.Context, names []string) (map[string]*rolloutState, error) {
+	ret := map[string]*rolloutState{}
+	for _, n := range names {
+		if s, ok := m.states[n]; ok {
+			state := *s
+			ret[n] = &state
+		}
+	}
+	return ret, nil
+}
+func (m *memoryStateStore) save(ctx context.Context, name string, state *rolloutState) error {
+	s := *state
+	m.states[name] = &s
+	return nil
+}
+func (m *memoryStateStore) remove(ctx context.Context, name string) error {
+	delete(m.states, name)
+	return nil
+}
+
+// getStateStore returns the state store selected by ROLLER_STATE_STORE, defaulting to ASG tags
+func getStateStore(asgSvc autoscalingiface.AutoScalingAPI, readinessHandler readiness) (stateStore, error) {
+	storeType := os.Getenv("ROLLER_STATE_STORE")
+	switch storeType {
+	case "", stateStoreASG:
+		return &asgTagStateStore{svc: asgSvc}, nil
+	case stateStoreConfigMap:
+		kube, ok := readinessHandler.(*kubernetesReadiness)
+		if !ok || kube == nil {
+			return nil, fmt.Errorf("ROLLER_STATE_STORE %s requires a kubernetes connection", stateStoreConfigMap)
+		}
+		name := os.Getenv("ROLLER_STATE_CONFIGMAP")
+		if name == "" {
+			name = defaultStateConfigMap
+		}
+		return newConfigMapStateStore(kube.clientset, kubeGetNamespace(), name), nil
+	case stateStoreMemory:
+		return newMemoryStateStore(), nil
+	default:
+		return nil, fmt.Errorf("ROLLER_STATE_STORE has unknown value %s, must be one of: %s, %s, %s", storeType, stateStoreASG, stateStoreConfigMap, stateStoreMemory)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
+)
+
+const (
+	tagOriginalDesired = "aws-asg-roller/original-desired"
+	tagRolloutStart    = "aws-asg-roller/rollout-start"
+	tagTargetVersion   = "aws-asg-roller/target-version"
+	tagOriginalMaxSize = "aws-asg-roller/original-max-size"
+	tagSuspended       = "aws-asg-roller/suspended-processes"
+	tagLastDesired     = "aws-asg-roller/last-desired"
+)
+
+var stateTagKeys = []string{tagOriginalDesired, tagRolloutStart, tagTargetVersion, tagOriginalMaxSize, tagSuspended, tagLastDesired}
+
+// asgTagStateStore saves rollout state as tags on the ASG itself
+type asgTagStateStore struct {
+	svc autoscalingiface.AutoScalingAPI
+}
+
+func (a *asgTagStateStore) load(ctx context.Context, names []string) (map[string]*rolloutState, error) {
+	ret := map[string]*rolloutState{}
+	if len(names) == 0 {
+		return ret, nil
+	}
+	tags, err := awsDescribeTags(ctx, a.svc, names, stateTagKeys)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read rollout state tags: %v", err)
+	}
+	// group the tags by ASG
+	groupTags := map[string]map[string]string{}
+	for _, t := range tags {
+		name := aws.StringValue(t.ResourceId)
+		if _, ok := groupTags[name]; !ok {
+			groupTags[name] = map[string]string{}
+		}
+		groupTags[name][aws.StringValue(t.Key)] = aws.StringValue(t.Value)
+	}
+	for name, values := range groupTags {
+		// without the original desired, there is nothing to resume
+		desiredValue, ok := values[tagOriginalDesired]
+		if !ok {
+			continue
+		}
+		desired, err := strconv.ParseInt(desiredValue, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("ASG %s has invalid %s tag %s: %v", name, tagOriginalDesired, desiredValue, err)
+		}
+		state := &rolloutState{
+			OriginalDesired: desired,
+			TargetVersion:   values[tagTargetVersion],
+		}
+		if start, ok := values[tagRolloutStart]; ok && start != "" {
+			if state.StartTime, err = time.Parse(time.RFC3339, start); err != nil {
+				return nil, fmt.Errorf("ASG %s has invalid %s tag %s: %v", name, tagRolloutStart, start, err)
+			}
+		}
+		if maxSize, ok := values[tagOriginalMaxSize]; ok && maxSize != "" {
+			if state.OriginalMaxSize, err = strconv.ParseInt(maxSize, 10, 64); err != nil {
+				return nil, fmt.Errorf("ASG %s has invalid %s tag %s: %v", name, tagOriginalMaxSize, maxSize, err)
+			}
+		}
+		if suspended, ok := values[tagSuspended]; ok && suspended != "" {
+			state.SuspendedProcesses = splitList(suspended)
+		}
+		if last, ok := values[tagLastDesired]; ok && last != "" {
+			if state.LastDesired, err = strconv.ParseInt(last, 10, 64); err != nil {
+				return nil, fmt.Errorf("ASG %s has invalid %s tag %s: %v", name, tagLastDesired, last, err)
+			}
+		}
+		ret[name] = state
+	}
+	return ret, nil
+}
+
+func (a *asgTagStateStore) save(ctx context.Context, name string, state *rolloutState) error {
+	tags := map[string]string{
+		tagOriginalDesired: strconv.FormatInt(state.OriginalDesired, 10),
+		tagRolloutStart:    state.StartTime.UTC().Format(time.RFC3339),
+		tagTargetVersion:   state.TargetVersion,
+	}
+	// optional fields that are no longer set are removed, so a later load does not pick up stale values
+	cleared := make([]string, 0)
+	if state.OriginalMaxSize > 0 {
+		tags[tagOriginalMaxSize] = strconv.FormatInt(state.OriginalMaxSize, 10)
+	} else {
+		cleared = append(cleared, tagOriginalMaxSize)
+	}
+	if len(state.SuspendedProcesses) > 0 {
+		// separated by spaces, as AWS does not allow commas in tag values
+		tags[tagSuspended] = strings.Join(state.SuspendedProcesses, " ")
+	} else {
+		cleared = append(cleared, tagSuspended)
+	}
+	if state.LastDesired > 0 {
+		tags[tagLastDesired] = strconv.FormatInt(state.LastDesired, 10)
+	} else {
+		cleared = append(cleared, tagLastDesired)
+	}
+	if err := awsSetTags(ctx, a.svc, name, tags); err != nil {
+		return err
+	}
+	if len(cleared) == 0 {
+		return nil
+	}
+	return awsDeleteTags(ctx, a.svc, name, cleared)
+}
+
+func (a *asgTagStateStore) remove(ctx context.Context, name string) error {
+	return awsDeleteTags(ctx, a.svc, name, stateTagKeys)
+}
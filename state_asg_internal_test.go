@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+)
+
+func TestAsgTagStateStore(t *testing.T) {
+	start := time.Date(2019, 10, 1, 12, 30, 0, 0, time.UTC)
+	asgSvc := &mockAsgSvc{
+		tags: map[string]map[string]string{
+			"other": {"Name": "other"},
+		},
+	}
+	store := &asgTagStateStore{svc: asgSvc}
+
+	// nothing saved yet
+	states, err := store.load(context.Background(), []string{"myasg", "other"})
+	if err != nil {
+		t.Fatalf("unexpected error loading empty state: %v", err)
+	}
+	if len(states) != 0 {
+		t.Fatalf("expected no states, got %v", states)
+	}
+
+	// save and read it back
+	saved := &rolloutState{OriginalDesired: 3, StartTime: start, TargetVersion: "lt1:4", SuspendedProcesses: []string{"AlarmNotification", "AZRebalance", "ScheduledActions"}, LastDesired: 4}
+	if err := store.save(context.Background(), "myasg", saved); err != nil {
+		t.Fatalf("unexpected error saving state: %v", err)
+	}
+	if asgSvc.tags["myasg"][tagOriginalDesired] != "3" {
+		t.Errorf("mismatched original desired tag, actual %s expected 3", asgSvc.tags["myasg"][tagOriginalDesired])
+	}
+	// AWS does not allow commas in tag values
+	if expected := "AlarmNotification AZRebalance ScheduledActions"; asgSvc.tags["myasg"][tagSuspended] != expected {
+		t.Errorf("mismatched suspended processes tag, actual %s expected %s", asgSvc.tags["myasg"][tagSuspended], expected)
+	}
+	states, err = store.load(context.Background(), []string{"myasg", "other"})
+	if err != nil {
+		t.Fatalf("unexpected error loading state: %v", err)
+	}
+	if len(states) != 1 {
+		t.Fatalf("expected 1 state, got %v", states)
+	}
+	state := states["myasg"]
+	switch {
+	case state == nil:
+		t.Errorf("missing state for myasg")
+	case state.OriginalDesired != saved.OriginalDesired:
+		t.Errorf("mismatched original desired, actual %d expected %d", state.OriginalDesired, saved.OriginalDesired)
+	case !state.StartTime.Equal(saved.StartTime):
+		t.Errorf("mismatched start time, actual %v expected %v", state.StartTime, saved.StartTime)
+	case state.TargetVersion != saved.TargetVersion:
+		t.Errorf("mismatched target version, actual %s expected %s", state.TargetVersion, saved.TargetVersion)
+	case !testStringEq(state.SuspendedProcesses, saved.SuspendedProcesses):
+		t.Errorf("mismatched suspended processes, actual %v expected %v", state.SuspendedProcesses, saved.SuspendedProcesses)
+	case state.LastDesired != saved.LastDesired:
+		t.Errorf("mismatched last desired, actual %d expected %d", state.LastDesired, saved.LastDesired)
+	}
+
+	// fields that are cleared are removed, rather than left to be loaded again
+	saved.SuspendedProcesses, saved.LastDesired = nil, 0
+	if err := store.save(context.Background(), "myasg", saved); err != nil {
+		t.Fatalf("unexpected error saving state: %v", err)
+	}
+	for _, key := range []string{tagSuspended, tagLastDesired} {
+		if value, ok := asgSvc.tags["myasg"][key]; ok {
+			t.Errorf("expected tag %s to be removed, actual %s", key, value)
+		}
+	}
+	states, err = store.load(context.Background(), []string{"myasg"})
+	if err != nil {
+		t.Fatalf("unexpected error loading state: %v", err)
+	}
+	if !states["myasg"].equal(saved) {
+		t.Errorf("mismatched state after clearing fields, actual %+v expected %+v", states["myasg"], saved)
+	}
+
+	// remove it and make sure it is gone, without touching other tags
+	if err := store.remove(context.Background(), "myasg"); err != nil {
+		t.Fatalf("unexpected error removing state: %v", err)
+	}
+	states, err = store.load(context.Background(), []string{"myasg", "other"})
+	if err != nil {
+		t.Fatalf("unexpected error loading state: %v", err)
+	}
+	if len(states) != 0 {
+		t.Errorf("expected no states after remove, got %v", states)
+	}
+	if asgSvc.tags["other"]["Name"] != "other" {
+		t.Errorf("unrelated tags were modified: %v", asgSvc.tags["other"])
+	}
+}
+
+func TestAsgTagStateStoreErrors(t *testing.T) {
+	tests := []struct {
+		tags   map[string]string
+		awsErr error
+		err    error
+	}{
+		{map[string]string{tagOriginalDesired: "abc"}, nil, fmt.Errorf("ASG myasg has invalid aws-asg-roller/original-desired tag")},
+		{map[string]string{tagOriginalDesired: "2", tagRolloutStart: "yesterday"}, nil, fmt.Errorf("ASG myasg has invalid aws-asg-roller/rollout-start tag")},
+		{nil, awserr.New(autoscaling.ErrCodeResourceContentionFault, "", nil), fmt.Errorf("Unable to read rollout state tags")},
+	}
+	for i, tt := range tests {
+		store := &asgTagStateStore{svc: &mockAsgSvc{
+			err:  tt.awsErr,
+			tags: map[string]map[string]string{"myasg": tt.tags},
+		}}
+		_, err := store.load(context.Background(), []string{"myasg"})
+		if (err == nil && tt.err != nil) || (err != nil && tt.err == nil) || (err != nil && tt.err != nil && !strings.HasPrefix(err.Error(), tt.err.Error())) {
+			t.Errorf("%d: mismatched errors, actual then expected", i)
+			t.Logf("%v", err)
+			t.Logf("%v", tt.err)
+		}
+	}
+}
+
+func TestAsgTagStateStoreCanceled(t *testing.T) {
+	asgSvc := &mockAsgSvc{tags: map[string]map[string]string{}}
+	store := &asgTagStateStore{svc: asgSvc}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	// once we are shutting down, the state is neither read nor written
+	if _, err := store.load(ctx, []string{"myasg"}); err == nil {
+		t.Errorf("expected error loading with a cancelled context")
+	}
+	if err := store.save(ctx, "myasg", &rolloutState{OriginalDesired: 3}); err == nil {
+		t.Errorf("expected error saving with a cancelled context")
+	}
+	if err := store.remove(ctx, "myasg"); err == nil {
+		t.Errorf("expected error removing with a cancelled context")
+	}
+	if len(asgSvc.tags["myasg"]) != 0 {
+		t.Errorf("expected no tags to be written, actual %v", asgSvc.tags["myasg"])
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	defaultStateConfigMap = "aws-asg-roller-state"
+	stateConfigMapKey     = "rollouts"
+	// how many times to retry a write that lost a race with another writer
+	stateConfigMapRetries = 3
+)
+
+// configMapStateStore saves rollout state for all ASGs as JSON in a single ConfigMap.
+// Every write is a read-modify-write protected by the ConfigMap's resourceVersion. On top of that,
+// we remember the state we last read or wrote for each ASG, and refuse to overwrite it if someone
+// else changed it in the meantime, so two rollers cannot both drive the same ASG.
+type configMapStateStore struct {
+	clientset kubernetes.Interface
+	namespace string
+	name      string
+	// known is the last state we saw for each ASG, nil if none
+	known map[string]*rolloutState
+}
+
+func newConfigMapStateStore(clientset kubernetes.Interface, namespace, name string) *configMapStateStore {
+	return &configMapStateStore{
+		clientset: clientset,
+		namespace: namespace,
+		name:      name,
+		known:     map[string]*rolloutState{},
+	}
+}
+
+func (c *configMapStateStore) load(ctx context.Context, names []string) (map[string]*rolloutState, error) {
+	// the kubernetes client cannot be cancelled, so at least do not start once we are shutting down
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	_, states, err := c.get()
+	if err != nil {
+		return nil, err
+	}
+	ret := map[string]*rolloutState{}
+	for _, n := range names {
+		c.known[n] = states[n]
+		if s, ok := states[n]; ok {
+			ret[n] = s
+		}
+	}
+	return ret, nil
+}
+
+func (c *configMapStateStore) save(ctx context.Context, name string, state *rolloutState) error {
+	return c.update(ctx, name, state)
+}
+
+func (c *configMapStateStore) remove(ctx context.Context, name string) error {
+	return c.update(ctx, name, nil)
+}
+
+// get reads the ConfigMap and decodes the states in it. If the ConfigMap does not exist, returns a nil ConfigMap.
+func (c *configMapStateStore) get() (*corev1.ConfigMap, map[string]*rolloutState, error) {
+	states := map[string]*rolloutState{}
+	cm, err := c.clientset.CoreV1().ConfigMaps(c.namespace).Get(c.name, v1.GetOptions{})
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil, states, nil
+		}
+		return nil, nil, fmt.Errorf("Unable to get state ConfigMap %s/%s: %v", c.namespace, c.name, err)
+	}
+	if data, ok := cm.Data[stateConfigMapKey]; ok && data != "" {
+		if err := json.Unmarshal([]byte(data), &states); err != nil {
+			return nil, nil, fmt.Errorf("Invalid rollout state in ConfigMap %s/%s: %v", c.namespace, c.name, err)
+		}
+	}
+	return cm, states, nil
+}
+
+// update sets the state for a single ASG, or removes it if state is nil
+func (c *configMapStateStore) update(ctx context.Context, name string, state *rolloutState) error {
+	for i := 0; i < stateConfigMapRetries; i++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		cm, states, err := c.get()
+		if err != nil {
+			return err
+		}
+		if !states[name].equal(c.known[name]) {
+			return fmt.Errorf("Rollout state for ASG %s in ConfigMap %s/%s was changed by another roller", name, c.namespace, c.name)
+		}
+		if state == nil {
+			delete(states, name)
+		} else {
+			states[name] = state
+		}
+		data, err := json.Marshal(states)
+		if err != nil {
+			return fmt.Errorf("Unable to encode rollout state: %v", err)
+		}
+		if cm == nil {
+			_, err = c.clientset.CoreV1().ConfigMaps(c.namespace).Create(&corev1.ConfigMap{
+				ObjectMeta: v1.ObjectMeta{
+					Name:      c.name,
+					Namespace: c.namespace,
+				},
+				Data: map[string]string{stateConfigMapKey: string(data)},
+			})
+		} else {
+			// cm carries the resourceVersion we read, so the update fails if anyone wrote in between
+			if cm.Data == nil {
+				cm.Data = map[string]string{}
+			}
+			cm.Data[stateConfigMapKey] = string(data)
+			_, err = c.clientset.CoreV1().ConfigMaps(c.namespace).Update(cm)
+		}
+		switch {
+		case err == nil:
+			c.known[name] = state
+			return nil
+		case errors.IsConflict(err) || errors.IsAlreadyExists(err):
+			// someone else wrote in between; read again and see if it touched our ASG
+			continue
+		default:
+			return fmt.Errorf("Unable to save state ConfigMap %s/%s: %v", c.namespace, c.name, err)
+		}
+	}
+	return fmt.Errorf("Unable to save state ConfigMap %s/%s: too many conflicting updates", c.namespace, c.name)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestConfigMapStateStore(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	store := newConfigMapStateStore(clientset, "kube-system", defaultStateConfigMap)
+	start := time.Date(2019, 10, 1, 12, 30, 0, 0, time.UTC)
+
+	states, err := store.load(context.Background(), []string{"myasg"})
+	if err != nil {
+		t.Fatalf("unexpected error loading with no ConfigMap: %v", err)
+	}
+	if len(states) != 0 {
+		t.Fatalf("expected no states, got %v", states)
+	}
+
+	saved := &rolloutState{OriginalDesired: 3, StartTime: start, TargetVersion: "lt1:4"}
+	if err := store.save(context.Background(), "myasg", saved); err != nil {
+		t.Fatalf("unexpected error creating state: %v", err)
+	}
+	if err := store.save(context.Background(), "anotherasg", &rolloutState{OriginalDesired: 5, StartTime: start}); err != nil {
+		t.Fatalf("unexpected error updating state: %v", err)
+	}
+
+	// a fresh store, as if after a restart
+	restarted := newConfigMapStateStore(clientset, "kube-system", defaultStateConfigMap)
+	states, err = restarted.load(context.Background(), []string{"myasg", "anotherasg"})
+	if err != nil {
+		t.Fatalf("unexpected error loading state: %v", err)
+	}
+	if len(states) != 2 {
+		t.Fatalf("expected 2 states, got %v", states)
+	}
+	if !states["myasg"].equal(saved) {
+		t.Errorf("mismatched state, actual %v expected %v", states["myasg"], saved)
+	}
+	if err := restarted.remove(context.Background(), "myasg"); err != nil {
+		t.Fatalf("unexpected error removing state: %v", err)
+	}
+	states, err = restarted.load(context.Background(), []string{"myasg", "anotherasg"})
+	if err != nil {
+		t.Fatalf("unexpected error loading state: %v", err)
+	}
+	if _, ok := states["myasg"]; ok || len(states) != 1 {
+		t.Errorf("expected only anotherasg after remove, got %v", states)
+	}
+}
+
+func TestConfigMapStateStoreConflict(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	start := time.Date(2019, 10, 1, 12, 30, 0, 0, time.UTC)
+	first := newConfigMapStateStore(clientset, "kube-system", defaultStateConfigMap)
+	second := newConfigMapStateStore(clientset, "kube-system", defaultStateConfigMap)
+	if _, err := first.load(context.Background(), []string{"myasg"}); err != nil {
+		t.Fatalf("unexpected error loading state: %v", err)
+	}
+	if _, err := second.load(context.Background(), []string{"myasg"}); err != nil {
+		t.Fatalf("unexpected error loading state: %v", err)
+	}
+	if err := first.save(context.Background(), "myasg", &rolloutState{OriginalDesired: 3, StartTime: start}); err != nil {
+		t.Fatalf("unexpected error saving state: %v", err)
+	}
+	// the second roller has not seen the first one's write, so must not overwrite it
+	err := second.save(context.Background(), "myasg", &rolloutState{OriginalDesired: 4, StartTime: start})
+	expected := fmt.Errorf("Rollout state for ASG myasg in ConfigMap kube-system/%s was changed by another roller", defaultStateConfigMap)
+	if err == nil || !strings.HasPrefix(err.Error(), expected.Error()) {
+		t.Errorf("mismatched errors, actual %v expected %v", err, expected)
+	}
+	// but it can write state for other ASGs
+	if err := second.save(context.Background(), "anotherasg", &rolloutState{OriginalDesired: 4, StartTime: start}); err != nil {
+		t.Errorf("unexpected error saving state for another ASG: %v", err)
+	}
+}
+
+func TestConfigMapStateStoreResourceVersionConflict(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	store := newConfigMapStateStore(clientset, "kube-system", defaultStateConfigMap)
+	if err := store.save(context.Background(), "myasg", &rolloutState{OriginalDesired: 3}); err != nil {
+		t.Fatalf("unexpected error saving state: %v", err)
+	}
+	// the fake clientset does not check resourceVersion, so simulate a conflicting writer
+	conflicts := 0
+	clientset.PrependReactor("update", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if conflicts < 2 {
+			conflicts++
+			return true, nil, errors.NewConflict(schema.GroupResource{Resource: "configmaps"}, defaultStateConfigMap, fmt.Errorf("modified"))
+		}
+		return false, nil, nil
+	})
+	if err := store.save(context.Background(), "myasg", &rolloutState{OriginalDesired: 4}); err != nil {
+		t.Fatalf("expected retry to succeed after conflicts, got %v", err)
+	}
+	if conflicts != 2 {
+		t.Errorf("expected 2 conflicts, had %d", conflicts)
+	}
+	conflicts = 0
+	clientset.PrependReactor("update", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.NewConflict(schema.GroupResource{Resource: "configmaps"}, defaultStateConfigMap, fmt.Errorf("modified"))
+	})
+	if err := store.save(context.Background(), "myasg", &rolloutState{OriginalDesired: 5}); err == nil {
+		t.Errorf("expected error after repeated conflicts")
+	}
+}
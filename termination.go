@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+)
+
+const (
+	// orderDefault terminates old instances in the order AWS lists them
+	orderDefault = "default"
+	// orderOldest terminates the instances launched longest ago first
+	orderOldest = "oldest"
+	// orderAZBalanced terminates from whichever availability zone has the most old instances left
+	orderAZBalanced = "az-balanced"
+	// orderFewestPods terminates the instances running the fewest pods first, to minimize disruption
+	orderFewestPods = "fewest-pods"
+	// orderPriorityTag terminates instances with the highest tagTerminationPriority first
+	orderPriorityTag = "priority-tag"
+
+	tagTerminationPriority = "aws-asg-roller/termination-priority"
+)
+
+var terminationOrders = []string{orderDefault, orderOldest, orderAZBalanced, orderFewestPods, orderPriorityTag}
+
+// terminationOrder sorts old instances into the order in which they should be terminated
+type terminationOrder interface {
+	order(instances []*autoscaling.Instance) ([]*autoscaling.Instance, error)
+}
+
+// podCounter is implemented by readiness handlers that know how many workloads run on each node
+type podCounter interface {
+	// getPodCounts returns the number of pods running on each node, keyed by instance ID
+	getPodCounts(hostnames []string, ids []string) (map[string]int, error)
+}
+
+// newTerminationOrder returns the named termination order, with whatever it needs to look up instances
+func newTerminationOrder(name string, instanceMap map[string]*instanceInfo, readinessHandler readiness) (terminationOrder, error) {
+	switch name {
+	case "", orderDefault:
+		return defaultOrder{}, nil
+	case orderOldest:
+		return &oldestOrder{instanceMap: instanceMap}, nil
+	case orderAZBalanced:
+		return azBalancedOrder{}, nil
+	case orderFewestPods:
+		counter, ok := readinessHandler.(podCounter)
+		if !ok || counter == nil || !supports(readinessHandler, capabilityCountPods) {
+			return nil, fmt.Errorf("termination order %s requires a kubernetes connection", orderFewestPods)
+		}
+		return &fewestPodsOrder{counter: counter, instanceMap: instanceMap}, nil
+	case orderPriorityTag:
+		return &priorityTagOrder{instanceMap: instanceMap}, nil
+	default:
+		return nil, fmt.Errorf("unknown termination order %s", name)
+	}
+}
+
+func validateTerminationOrder(name string) error {
+	for _, o := range terminationOrders {
+		if name == o {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown termination order %s, must be one of: %v", name, terminationOrders)
+}
+
+type defaultOrder struct{}
+
+func (defaultOrder) order(instances []*autoscaling.Instance) ([]*autoscaling.Instance, error) {
+	return instances, nil
+}
+
+type oldestOrder struct {
+	instanceMap map[string]*instanceInfo
+}
+
+func (o *oldestOrder) order(instances []*autoscaling.Instance) ([]*autoscaling.Instance, error) {
+	ret := append([]*autoscaling.Instance{}, instances...)
+	sort.SliceStable(ret, func(i, j int) bool {
+		a, b := o.instanceMap[*ret[i].InstanceId], o.instanceMap[*ret[j].InstanceId]
+		if a == nil || a.launchTime.IsZero() {
+			return false
+		}
+		if b == nil || b.launchTime.IsZero() {
+			return true
+		}
+		return a.launchTime.Before(b.launchTime)
+	})
+	return ret, nil
+}
+
+type azBalancedOrder struct{}
+
+func (azBalancedOrder) order(instances []*autoscaling.Instance) ([]*autoscaling.Instance, error) {
+	// group the instances by AZ, keeping their original order within each
+	byAZ := map[string][]*autoscaling.Instance{}
+	azs := make([]string, 0)
+	for _, i := range instances {
+		az := aws.StringValue(i.AvailabilityZone)
+		if _, ok := byAZ[az]; !ok {
+			azs = append(azs, az)
+		}
+		byAZ[az] = append(byAZ[az], i)
+	}
+	sort.Strings(azs)
+	// repeatedly take one from whichever AZ has the most left
+	ret := make([]*autoscaling.Instance, 0, len(instances))
+	for len(ret) < len(instances) {
+		var most string
+		for _, az := range azs {
+			if len(byAZ[az]) > len(byAZ[most]) {
+				most = az
+			}
+		}
+		ret = append(ret, byAZ[most][0])
+		byAZ[most] = byAZ[most][1:]
+	}
+	return ret, nil
+}
+
+type fewestPodsOrder struct {
+	counter     podCounter
+	instanceMap map[string]*instanceInfo
+}
+
+func (f *fewestPodsOrder) order(instances []*autoscaling.Instance) ([]*autoscaling.Instance, error) {
+	ids := mapInstancesIds(instances)
+	counts, err := f.counter.getPodCounts(instanceHostnames(ids, f.instanceMap), ids)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to count pods on nodes: %v", err)
+	}
+	ret := append([]*autoscaling.Instance{}, instances...)
+	sort.SliceStable(ret, func(i, j int) bool {
+		return counts[*ret[i].InstanceId] < counts[*ret[j].InstanceId]
+	})
+	return ret, nil
+}
+
+type priorityTagOrder struct {
+	instanceMap map[string]*instanceInfo
+}
+
+func (p *priorityTagOrder) order(instances []*autoscaling.Instance) ([]*autoscaling.Instance, error) {
+	// instances without the tag have priority 0
+	priorities := map[string]int64{}
+	for _, i := range instances {
+		info, ok := p.instanceMap[*i.InstanceId]
+		if !ok {
+			continue
+		}
+		value, ok := info.tags[tagTerminationPriority]
+		if !ok {
+			continue
+		}
+		priority, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("instance %s has invalid %s tag %s", info.id, tagTerminationPriority, value)
+		}
+		priorities[info.id] = priority
+	}
+	ret := append([]*autoscaling.Instance{}, instances...)
+	sort.SliceStable(ret, func(i, j int) bool {
+		return priorities[*ret[i].InstanceId] > priorities[*ret[j].InstanceId]
+	})
+	return ret, nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+type mockPodCounter struct {
+	counts map[string]int
+}
+
+func (m *mockPodCounter) getReadiness(ctx context.Context, instances []instanceDescriptor, opts readinessSettings) ([]instanceReadiness, error) {
+	return nil, nil
+}
+func (m *mockPodCounter) prepareTermination(ctx context.Context, instances []instanceDescriptor, opts drainSettings) error {
+	return nil
+}
+func (m *mockPodCounter) getPodCounts(hostnames []string, ids []string) (map[string]int, error) {
+	return m.counts, nil
+}
+
+func testOrderInstances(azs map[string]string, ids ...string) []*autoscaling.Instance {
+	instances := make([]*autoscaling.Instance, 0)
+	for _, id := range ids {
+		instances = append(instances, &autoscaling.Instance{
+			InstanceId:       aws.String(id),
+			AvailabilityZone: aws.String(azs[id]),
+		})
+	}
+	return instances
+}
+
+func TestTerminationOrder(t *testing.T) {
+	now := time.Now()
+	instanceMap := map[string]*instanceInfo{
+		"a": {id: "a", launchTime: now.Add(-1 * time.Hour)},
+		"b": {id: "b", launchTime: now.Add(-3 * time.Hour), tags: map[string]string{tagTerminationPriority: "-1"}},
+		"c": {id: "c", launchTime: now.Add(-2 * time.Hour), tags: map[string]string{tagTerminationPriority: "10"}},
+		"d": {id: "d", launchTime: now.Add(-4 * time.Hour)},
+		"e": {id: "e", tags: map[string]string{tagTerminationPriority: "high"}},
+	}
+	azs := map[string]string{"a": "us-east-1a", "b": "us-east-1b", "c": "us-east-1b", "d": "us-east-1a", "e": "us-east-1b"}
+	tests := []struct {
+		name     string
+		handler  readiness
+		ids      []string
+		expected string
+		err      bool
+	}{
+		{orderDefault, nil, []string{"a", "b", "c", "d"}, "a,b,c,d", false},
+		{"", nil, []string{"a", "b", "c", "d"}, "a,b,c,d", false},
+		{orderOldest, nil, []string{"a", "b", "c", "d"}, "d,b,c,a", false},
+		{orderAZBalanced, nil, []string{"a", "b", "c", "d"}, "a,b,d,c", false},
+		{orderAZBalanced, nil, []string{"a", "b", "c", "d", "e"}, "b,a,c,d,e", false},
+		{orderPriorityTag, nil, []string{"a", "b", "c", "d"}, "c,a,d,b", false},
+		{orderPriorityTag, nil, []string{"a", "e"}, "", true},
+		{orderFewestPods, &mockPodCounter{counts: map[string]int{"a": 5, "b": 0, "c": 3, "d": 3}}, []string{"a", "b", "c", "d"}, "b,c,d,a", false},
+		{orderFewestPods, nil, []string{"a"}, "", true},
+		{"random", nil, []string{"a"}, "", true},
+	}
+	for i, tt := range tests {
+		order, err := newTerminationOrder(tt.name, instanceMap, tt.handler)
+		if err == nil {
+			var ordered []*autoscaling.Instance
+			ordered, err = order.order(testOrderInstances(azs, tt.ids...))
+			if err == nil && strings.Join(mapInstancesIds(ordered), ",") != tt.expected {
+				t.Errorf("%d: %s mismatched order, actual %v expected %s", i, tt.name, mapInstancesIds(ordered), tt.expected)
+			}
+		}
+		switch {
+		case err != nil && !tt.err:
+			t.Errorf("%d: %s unexpected error: %v", i, tt.name, err)
+		case err == nil && tt.err:
+			t.Errorf("%d: %s expected error", i, tt.name)
+		}
+	}
+}
+
+func TestGetPodCounts(t *testing.T) {
+	pod := func(name, node string, phase corev1.PodPhase, owner string) *corev1.Pod {
+		p := &corev1.Pod{
+			ObjectMeta: v1.ObjectMeta{Name: name, Namespace: "default"},
+			Spec:       corev1.PodSpec{NodeName: node},
+			Status:     corev1.PodStatus{Phase: phase},
+		}
+		if owner != "" {
+			p.OwnerReferences = []v1.OwnerReference{{Kind: owner, Name: "owner", APIVersion: appsv1.SchemeGroupVersion.String()}}
+		}
+		return p
+	}
+	clientset := fake.NewSimpleClientset(
+		&corev1.Node{ObjectMeta: v1.ObjectMeta{Name: "host1"}},
+		&corev1.Node{ObjectMeta: v1.ObjectMeta{Name: "host2"}},
+		&corev1.Node{ObjectMeta: v1.ObjectMeta{Name: "host3"}},
+		pod("web-1", "host1", corev1.PodRunning, "ReplicaSet"),
+		pod("web-2", "host1", corev1.PodRunning, "ReplicaSet"),
+		pod("logs-1", "host1", corev1.PodRunning, "DaemonSet"),
+		pod("job-1", "host2", corev1.PodSucceeded, "Job"),
+		pod("logs-2", "host2", corev1.PodRunning, "DaemonSet"),
+		pod("web-3", "host3", corev1.PodPending, ""),
+	)
+	k := &kubernetesReadiness{clientset: clientset}
+	counts, err := k.getPodCounts([]string{"host1", "host2", "host3"}, []string{"i-1", "i-2", "i-3"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := map[string]int{"i-1": 2, "i-2": 0, "i-3": 1}
+	for id, count := range expected {
+		if counts[id] != count {
+			t.Errorf("%s: mismatched count, actual %d expected %d", id, counts[id], count)
+		}
+	}
+}
@@ -74,3 +74,16 @@ func (f *funcCounter) filterByName(name string) []funcCounterImpl {
 	}
 	return ret
 }
+
+// testInstances describes instances by their IDs, with hostnames if given
+func testInstances(ids []string, hostnames ...string) []instanceDescriptor {
+	instances := make([]instanceDescriptor, 0, len(ids))
+	for i, id := range ids {
+		d := instanceDescriptor{id: id}
+		if i < len(hostnames) {
+			d.hostname = hostnames[i]
+		}
+		instances = append(instances, d)
+	}
+	return instances
+}